@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"syscall"
 	"time"
 	"tunnel/internal/client"
@@ -16,23 +20,31 @@ import (
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs the manager until it is stopped or, with RUN_ONCE, a single sync
+// completes, and returns the process exit code: 1 on startup failures and
+// on a failed RUN_ONCE sync, 0 otherwise. It returns instead of exiting so
+// that deferred cleanups run.
+func run() int {
 	config, err := config.LoadConfig()
 	if err != nil {
 		log.Printf("Fatal error: failed to load config: %v\n", err)
-		return
+		return 1
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: config.LogLevel,
-	}))
+	handler := runtime.NewSamplingHandler(config.NewLogHandler(os.Stdout), config.LogSampleRate)
+	logger := runtime.NewLeveledLogger(handler, config.LogLevel, "")
 
 	config.Print(logger)
 
 	client, err := client.NewClient(config)
 	if err != nil {
 		fmt.Printf("Fatal error: failed to create clients: %v\n", err)
-		return
+		return 1
 	}
+	logger.Info("kubernetes client", slog.String("mode", client.KubeMode))
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -42,28 +54,163 @@ func main() {
 		Config: config,
 		Client: client,
 		Logger: logger,
+		ModuleLoggers: map[string]*slog.Logger{
+			runtime.ModuleKube:   runtime.NewLeveledLogger(handler, config.LogLevelKube, runtime.ModuleKube),
+			runtime.ModuleTunnel: runtime.NewLeveledLogger(handler, config.LogLevelTunnel, runtime.ModuleTunnel),
+			runtime.ModuleDNS:    runtime.NewLeveledLogger(handler, config.LogLevelDNS, runtime.ModuleDNS),
+		},
+	}
+
+	if err := sync.LoadSoftDeleteLedger(runtime); err != nil {
+		logger.Error("failed to load soft-delete ledger", slog.String("error", err.Error()))
+		return 1
+	}
+
+	if err := sync.ProbePermissions(runtime); err != nil {
+		logger.Error("permission probe failed", slog.String("error", err.Error()))
+		return 1
+	}
+
+	if err := sync.CheckZoneLayout(runtime); err != nil {
+		logger.Error("zone layout check failed", slog.String("error", err.Error()))
+		return 1
+	}
+
+	if config.MetricsAddr != "" {
+		_, stop, err := serveMetrics(runtime)
+		if err != nil {
+			logger.Error("failed to serve metrics", slog.String("error", err.Error()))
+			return 1
+		}
+		defer stop()
+	}
+
+	if config.RunOnce {
+		if err := runSyncCycle(runtime); err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	syncLoop(runtime, time.After)
+	return 0
+}
+
+// syncLoop syncs immediately unless SYNC_ON_STARTUP is disabled, then once
+// per SYNC_INTERVAL as timed by after, until the runtime context is done.
+func syncLoop(runtime *runtime.Runtime, after func(time.Duration) <-chan time.Time) {
+	if runtime.Config.SyncOnStartup && runtime.Ctx.Err() == nil {
+		_ = runSyncCycle(runtime)
 	}
 
-	logger.Info("starting tunnel sync loop")
+	runtime.Logger.Info("starting tunnel sync loop")
 	for {
 		select {
-		case <-ctx.Done():
-			logger.Info("shutting down")
+		case <-runtime.Ctx.Done():
+			runtime.Logger.Info("shutting down")
 			return
-		case <-time.After(config.SyncInterval):
-			logger.Info("sync start")
-			if state, err := sync.SyncKube(runtime); err != nil {
-				logger.Warn("kubernetes sync failed", slog.String("error", err.Error()))
-			} else {
-				state.Print(runtime.Logger)
-				if err := sync.SyncTunnel(runtime, state); err != nil {
-					logger.Warn("tunnel sync failed", slog.String("error", err.Error()))
-				}
-				if err := sync.SyncDNS(runtime, state); err != nil {
-					logger.Warn("dns sync failed", slog.String("error", err.Error()))
-				}
+		case <-after(runtime.Config.SyncInterval):
+			_ = runSyncCycle(runtime)
+		}
+	}
+}
+
+// runSyncCycle runs a single Kubernetes -> tunnel -> DNS sync, returning the
+// errors of the failed steps. Unless RECOVER_PANICS is disabled, a panic is
+// logged and returned as an error instead of crashing the process.
+func runSyncCycle(runtime *runtime.Runtime) (syncErr error) {
+	defer runtime.BeginCycle()()
+	logger := runtime.Logger
+	if runtime.Config.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("sync panicked", slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+				syncErr = fmt.Errorf("sync panicked: %v", r)
+			}
+		}()
+	}
+
+	logger.Info("sync start")
+	runtime.Skipped = nil
+	runtime.Failed = nil
+	runtime.Changes = 0
+	var stateErr error
+	state, err := sync.SyncKube(runtime)
+	if err != nil {
+		logger.Warn("kubernetes sync failed", slog.String("error", err.Error()))
+		syncErr = fmt.Errorf("kubernetes sync failed: %w", err)
+	} else if limit := runtime.Config.MaxTotalHostnames; limit > 0 && state.Len() > limit {
+		// Guards against runaway growth, e.g. a bad annotation template.
+		logger.Error("desired state exceeds MAX_TOTAL_HOSTNAMES; not applying tunnel and dns sync", slog.Int("hostnames", state.Len()), slog.Int("limit", limit))
+		stateErr = fmt.Errorf("desired state has %d hostnames, exceeding MAX_TOTAL_HOSTNAMES=%d", state.Len(), limit)
+		syncErr = stateErr
+	} else {
+		state.Print(runtime)
+		if !runtime.TunnelSyncDisabled {
+			if err := sync.SyncTunnel(runtime, state); err != nil {
+				logger.Warn("tunnel sync failed", slog.String("error", err.Error()))
+				syncErr = errors.Join(syncErr, err)
+			}
+		}
+		// DUMP_TUNNEL_CONFIG is a dry run: only the tunnel configuration is
+		// computed, and nothing is written to Cloudflare or Kubernetes.
+		if !runtime.DNSSyncDisabled && runtime.Config.DumpTunnelConfigPath == "" {
+			if err := sync.SyncDNS(runtime, state); err != nil {
+				logger.Warn("dns sync failed", slog.String("error", err.Error()))
+				syncErr = errors.Join(syncErr, err)
 			}
-			logger.Info("sync stop")
 		}
 	}
+	sync.PrintSkipped(runtime)
+	if state != nil && runtime.Config.WriteServiceStatus && runtime.Config.DumpTunnelConfigPath == "" {
+		sync.WriteServiceStatus(runtime, state, stateErr)
+	}
+	if syncErr == nil && runtime.Changes == 0 {
+		logger.Info("sync made no changes")
+	}
+	logRequestCounts(runtime)
+	logger.Info("sync stop")
+	return syncErr
+}
+
+// serveMetrics serves the Cloudflare request counter on METRICS_ADDR at
+// /metrics until the returned stop function is called, and returns the
+// address listened on.
+func serveMetrics(runtime *runtime.Runtime) (addr net.Addr, stop func(), err error) {
+	listener, err := net.Listen("tcp", runtime.Config.MetricsAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", runtime.Client.RequestCounter)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			runtime.Logger.Error("metrics server failed", slog.String("error", err.Error()))
+		}
+	}()
+	runtime.Logger.Info("serving metrics", slog.String("addr", listener.Addr().String()))
+
+	return listener.Addr(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+// logRequestCounts logs, at debug level, the number of Cloudflare API
+// requests made since startup, per method, endpoint, zone and result. The
+// same counts are served as metrics with METRICS_ADDR.
+func logRequestCounts(runtime *runtime.Runtime) {
+	keys, counts := runtime.Client.RequestCounter.Snapshot()
+	for i, key := range keys {
+		runtime.Logger.Debug("cloudflare request count",
+			slog.String("method", key.Method),
+			slog.String("endpoint", key.Endpoint),
+			slog.String("zone", key.Zone),
+			slog.String("result", key.Result),
+			slog.Int("count", counts[i]),
+		)
+	}
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tunnel/internal/client"
+	"tunnel/internal/config"
+	"tunnel/internal/runtime"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/option"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestRuntime returns a runtime using kube as Kubernetes client, whose
+// tunnel and DNS syncs are disabled.
+func newTestRuntime(t *testing.T, kube kubernetes.Interface, recoverPanics string) *runtime.Runtime {
+	t.Helper()
+
+	t.Setenv("CLOUDFLARE_ACCOUNT_ID", "0123456789abcdef0123456789abcdef")
+	t.Setenv("CLOUDFLARE_TUNNEL_ID", "00000000-0000-4000-8000-000000000001")
+	t.Setenv("CLOUDFLARE_API_TOKEN", "test-token")
+	t.Setenv("RECOVER_PANICS", recoverPanics)
+	args := os.Args
+	os.Args = []string{"tunnel-manager"}
+	defer func() { os.Args = args }()
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	return &runtime.Runtime{
+		Ctx:    t.Context(),
+		Config: cfg,
+		Client: &client.Client{
+			KubeClient:     kube,
+			RequestCounter: client.NewRequestCounter(),
+		},
+		Logger:             slog.New(slog.NewTextHandler(io.Discard, nil)),
+		TunnelSyncDisabled: true,
+		DNSSyncDisabled:    true,
+	}
+}
+
+// newPanickingRuntime returns a runtime whose Kubernetes client panics on
+// the first namespace listing, and whose tunnel and DNS syncs are disabled.
+func newPanickingRuntime(t *testing.T, recoverPanics string) *runtime.Runtime {
+	t.Helper()
+
+	kube := fake.NewClientset()
+	panicked := false
+	kube.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		if !panicked {
+			panicked = true
+			panic("boom")
+		}
+		return false, nil, nil
+	})
+	return newTestRuntime(t, kube, recoverPanics)
+}
+
+func TestRunSyncCycleRecoversPanics(t *testing.T) {
+	rt := newPanickingRuntime(t, "true")
+
+	if err := runSyncCycle(rt); err == nil {
+		t.Fatalf("panicking cycle returned no error")
+	}
+	if err := runSyncCycle(rt); err != nil {
+		t.Fatalf("next cycle failed: %v", err)
+	}
+}
+
+func TestRunSyncCyclePanicsWithoutRecovery(t *testing.T) {
+	rt := newPanickingRuntime(t, "false")
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("cycle did not panic with RECOVER_PANICS=false")
+		}
+	}()
+	runSyncCycle(rt)
+}
+
+func TestRunSyncCycleLogsShareCycleID(t *testing.T) {
+	kube := fake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "default",
+				Annotations: map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"},
+			},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+		},
+	)
+	rt := newTestRuntime(t, kube, "true")
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	rt.Logger = slog.New(handler)
+	rt.ModuleLoggers = map[string]*slog.Logger{
+		runtime.ModuleKube: runtime.NewLeveledLogger(handler, slog.LevelDebug, runtime.ModuleKube),
+	}
+
+	var cycleIDs []string
+	for range 2 {
+		buf.Reset()
+		if err := runSyncCycle(rt); err != nil {
+			t.Fatalf("runSyncCycle: %v", err)
+		}
+
+		var cycleID string
+		modules := make(map[string]bool)
+		for line := range strings.Lines(buf.String()) {
+			var entry struct {
+				Msg     string `json:"msg"`
+				Module  string `json:"module"`
+				CycleID string `json:"cycle_id"`
+			}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("decode log line %q: %v", line, err)
+			}
+			if entry.CycleID == "" {
+				t.Fatalf("log line %q has no cycle_id", line)
+			}
+			if cycleID == "" {
+				cycleID = entry.CycleID
+			}
+			if entry.CycleID != cycleID {
+				t.Errorf("log line %q has cycle_id %q, want %q", line, entry.CycleID, cycleID)
+			}
+			modules[entry.Module] = true
+		}
+		if !modules[runtime.ModuleKube] {
+			t.Errorf("no log line of module %q in %q", runtime.ModuleKube, buf.String())
+		}
+		cycleIDs = append(cycleIDs, cycleID)
+	}
+
+	if cycleIDs[0] == cycleIDs[1] {
+		t.Errorf("two cycles share cycle_id %q", cycleIDs[0])
+	}
+	buf.Reset()
+	rt.LoggerFor(runtime.ModuleKube).Info("after the cycle")
+	if strings.Contains(buf.String(), "cycle_id") {
+		t.Errorf("logger not restored after the cycle: %q", buf.String())
+	}
+}
+
+func TestRunSyncCycleNoChangesSummary(t *testing.T) {
+	tests := []struct {
+		name        string
+		kubeErr     error
+		wantSummary bool
+	}{
+		{name: "nothing applied", wantSummary: true},
+		{name: "failed cycle", kubeErr: errors.New("connection refused"), wantSummary: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kube := fake.NewClientset()
+			if tt.kubeErr != nil {
+				kube.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+					return true, nil, tt.kubeErr
+				})
+			}
+			rt := newTestRuntime(t, kube, "true")
+			var buf bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+			runSyncCycle(rt)
+
+			if got := strings.Contains(buf.String(), "sync made no changes"); got != tt.wantSummary {
+				t.Errorf("no-change summary logged = %v, want %v: %s", got, tt.wantSummary, buf.String())
+			}
+		})
+	}
+}
+
+func TestRunSyncCycleMaxTotalHostnames(t *testing.T) {
+	tests := []struct {
+		limit        string
+		wantAborted  bool
+		wantRequests bool
+	}{
+		{limit: "", wantAborted: false, wantRequests: true},
+		{limit: "3", wantAborted: false, wantRequests: true},
+		{limit: "2", wantAborted: true, wantRequests: false},
+	}
+	for _, tt := range tests {
+		t.Run("MAX_TOTAL_HOSTNAMES="+tt.limit, func(t *testing.T) {
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				http.NotFound(w, r)
+			}))
+			defer srv.Close()
+
+			t.Setenv("MAX_TOTAL_HOSTNAMES", tt.limit)
+			kube := fake.NewClientset(
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+				&corev1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "app",
+						Namespace:   "default",
+						Annotations: map[string]string{"cloudflare-tunnel-hostnames": "a.example.com,b.example.com,c.example.com"},
+					},
+					Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+				},
+			)
+			rt := newTestRuntime(t, kube, "true")
+			rt.Client.CloudFlareClient = cloudflare.NewClient(
+				option.WithBaseURL(srv.URL+"/"),
+				option.WithAPIToken("test-token"),
+				option.WithMaxRetries(0),
+			)
+			rt.TunnelSyncDisabled, rt.DNSSyncDisabled = false, false
+
+			err := runSyncCycle(rt)
+			const abortErr = "desired state has 3 hostnames, exceeding MAX_TOTAL_HOSTNAMES=2"
+			if aborted := err != nil && strings.Contains(err.Error(), abortErr); aborted != tt.wantAborted {
+				t.Errorf("runSyncCycle error = %v, want aborted %v", err, tt.wantAborted)
+			}
+			if got := requests.Load() > 0; got != tt.wantRequests {
+				t.Errorf("sent requests to Cloudflare = %v, want %v", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestSyncLoopStartupSync(t *testing.T) {
+	tests := []struct {
+		syncOnStartup string
+		wantCycles    int32
+	}{
+		{syncOnStartup: "", wantCycles: 1},
+		{syncOnStartup: "true", wantCycles: 1},
+		{syncOnStartup: "false", wantCycles: 0},
+	}
+	for _, tt := range tests {
+		t.Run("SYNC_ON_STARTUP="+tt.syncOnStartup, func(t *testing.T) {
+			t.Setenv("SYNC_ON_STARTUP", tt.syncOnStartup)
+			t.Setenv("SYNC_INTERVAL", "15m")
+			var cycles atomic.Int32
+			kube := fake.NewClientset()
+			kube.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+				cycles.Add(1)
+				return false, nil, nil
+			})
+			rt := newTestRuntime(t, kube, "true")
+			ctx, cancel := context.WithCancel(t.Context())
+			rt.Ctx = ctx
+
+			// The fake clock hands every timer to the test, which fires it
+			// by hand; no interval ever elapses on its own.
+			timers := make(chan chan time.Time, 10)
+			after := func(d time.Duration) <-chan time.Time {
+				if d != 15*time.Minute {
+					t.Errorf("timer set to %v, want 15m", d)
+				}
+				timer := make(chan time.Time, 1)
+				timers <- timer
+				return timer
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				syncLoop(rt, after)
+			}()
+
+			timer := <-timers
+			if got := cycles.Load(); got != tt.wantCycles {
+				t.Errorf("syncs before the first interval = %d, want %d", got, tt.wantCycles)
+			}
+
+			timer <- time.Now()
+			<-timers
+			if got := cycles.Load(); got != tt.wantCycles+1 {
+				t.Errorf("syncs after the first interval = %d, want %d", got, tt.wantCycles+1)
+			}
+
+			cancel()
+			<-done
+		})
+	}
+}
+
+func TestSyncLoopCanceledBeforeStartup(t *testing.T) {
+	var cycles atomic.Int32
+	kube := fake.NewClientset()
+	kube.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		cycles.Add(1)
+		return false, nil, nil
+	})
+	rt := newTestRuntime(t, kube, "true")
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	rt.Ctx = ctx
+
+	syncLoop(rt, func(time.Duration) <-chan time.Time { return nil })
+
+	if got := cycles.Load(); got != 0 {
+		t.Errorf("syncs after cancellation = %d, want 0", got)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	t.Setenv("METRICS_ADDR", "127.0.0.1:0")
+	rt := newTestRuntime(t, fake.NewClientset(), "true")
+
+	addr, stop, err := serveMetrics(rt)
+	if err != nil {
+		t.Fatalf("serveMetrics: %v", err)
+	}
+	defer stop()
+
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	const want = "# TYPE tunnel_manager_cloudflare_requests_total counter"
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+		t.Errorf("GET /metrics = %d %q, want 200 with %q", resp.StatusCode, body, want)
+	}
+
+	stop()
+	if _, err := http.Get("http://" + addr.String() + "/metrics"); err == nil {
+		t.Errorf("metrics still served after stop")
+	}
+}
@@ -2,23 +2,37 @@ package client
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"tunnel/internal/config"
 
 	"github.com/cloudflare/cloudflare-go/v6"
 	"github.com/cloudflare/cloudflare-go/v6/option"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Kubernetes client modes, see Client.KubeMode.
+const (
+	KubeModeInCluster  = "in-cluster"
+	KubeModeKubeconfig = "kubeconfig"
 )
 
 type Client struct {
-	KubeClient       *kubernetes.Clientset
+	KubeClient       kubernetes.Interface
 	CloudFlareClient *cloudflare.Client
+	RequestCounter   *RequestCounter
+
+	// KubeMode tells how the Kubernetes client was configured, one of the
+	// KubeMode constants.
+	KubeMode string
 }
 
 func NewClient(config *config.Config) (*Client, error) {
-	cfg, err := rest.InClusterConfig()
+	cfg, kubeMode, err := kubeConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load kubernetes in-cluster config: %v", err)
+		return nil, err
 	}
 
 	kubeClient, err := kubernetes.NewForConfig(cfg)
@@ -26,10 +40,47 @@ func NewClient(config *config.Config) (*Client, error) {
 		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
 	}
 
-	cfClient := cloudflare.NewClient(option.WithAPIToken(config.CloudFlareAPIToken))
+	requestCounter := NewRequestCounter()
+	cfClient := cloudflare.NewClient(
+		option.WithAPIToken(config.CloudFlareAPIToken),
+		option.WithMiddleware(
+			requestCounterMiddleware(requestCounter),
+			nonJSONResponseMiddleware(config.CloudFlareAPIToken),
+		),
+	)
 
 	return &Client{
 		KubeClient:       kubeClient,
 		CloudFlareClient: cfClient,
+		RequestCounter:   requestCounter,
+		KubeMode:         kubeMode,
 	}, nil
 }
+
+// kubeConfig returns the in-cluster config, falling back to the kubeconfig
+// file at KUBECONFIG or ~/.kube/config when not running inside a pod.
+func kubeConfig(config *config.Config) (*rest.Config, string, error) {
+	cfg, err := rest.InClusterConfig()
+	if err == nil {
+		return cfg, KubeModeInCluster, nil
+	}
+
+	path := config.KubeconfigPath
+	if path == "" {
+		if home, homeErr := os.UserHomeDir(); homeErr == nil {
+			path = filepath.Join(home, ".kube", "config")
+		}
+	}
+	if path == "" {
+		return nil, "", fmt.Errorf("failed to load kubernetes in-cluster config: %v", err)
+	}
+	if _, statErr := os.Stat(path); statErr != nil {
+		return nil, "", fmt.Errorf("failed to load kubernetes in-cluster config: %v; no kubeconfig at %s", err, path)
+	}
+
+	cfg, err = clientcmd.BuildConfigFromFlags("", path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load kubeconfig %s: %v", path, err)
+	}
+	return cfg, KubeModeKubeconfig, nil
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"tunnel/internal/config"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://kube.example.com:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user:
+    token: test-token
+`
+
+func TestKubeConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kubeconfig")
+	if err := os.WriteFile(path, []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(home, ".kube"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".kube", "config"), []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		home     string
+		wantMode string // "" if an error is expected
+	}{
+		{name: "KUBECONFIG", path: path, home: dir, wantMode: KubeModeKubeconfig},
+		{name: "home kubeconfig", home: home, wantMode: KubeModeKubeconfig},
+		{name: "missing KUBECONFIG", path: filepath.Join(dir, "missing"), home: home},
+		{name: "no kubeconfig", home: dir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Not running inside a pod.
+			t.Setenv("KUBERNETES_SERVICE_HOST", "")
+			t.Setenv("KUBERNETES_SERVICE_PORT", "")
+			t.Setenv("HOME", tt.home)
+
+			cfg, mode, err := kubeConfig(&config.Config{KubeconfigPath: tt.path})
+			if tt.wantMode == "" {
+				if err == nil {
+					t.Fatalf("kubeConfig succeeded in mode %q, want an error", mode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("kubeConfig: %v", err)
+			}
+			if mode != tt.wantMode {
+				t.Errorf("mode = %q, want %q", mode, tt.wantMode)
+			}
+			if cfg.Host != "https://kube.example.com:6443" || cfg.BearerToken != "test-token" {
+				t.Errorf("config host %q, token %q not loaded from the kubeconfig", cfg.Host, cfg.BearerToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go/v6/option"
+)
+
+// maxBodySnippet is the maximum number of characters of an unexpected
+// response body included in the error.
+const maxBodySnippet = 256
+
+// nonJSONResponseMiddleware turns responses that are not JSON (e.g. an HTML
+// error page served by a WAF in front of the API) into an error carrying a
+// truncated snippet of the body, instead of letting the SDK fail with an
+// opaque decode error. secret is redacted from the snippet.
+func nonJSONResponseMiddleware(secret string) option.Middleware {
+	return func(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+		res, err := next(req)
+		if err != nil || res == nil || res.Body == nil {
+			return res, err
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if strings.Contains(mediaType, "application/json") || strings.HasSuffix(mediaType, "+json") {
+			return res, nil
+		}
+
+		contents, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading response body: %w", err)
+		}
+		res.Body = io.NopCloser(bytes.NewReader(contents))
+		if len(bytes.TrimSpace(contents)) == 0 {
+			return res, nil
+		}
+
+		return res, fmt.Errorf("unexpected non-JSON response from Cloudflare: %s %s: %d %s, content-type %q: %s",
+			req.Method, req.URL.Path, res.StatusCode, http.StatusText(res.StatusCode),
+			res.Header.Get("Content-Type"), bodySnippet(contents, secret))
+	}
+}
+
+// bodySnippet collapses whitespace in body, redacts secret and truncates the
+// result to maxBodySnippet characters.
+func bodySnippet(body []byte, secret string) string {
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	if secret != "" {
+		snippet = strings.ReplaceAll(snippet, secret, "[REDACTED]")
+	}
+	if runes := []rune(snippet); len(runes) > maxBodySnippet {
+		snippet = string(runes[:maxBodySnippet]) + "..."
+	}
+	return snippet
+}
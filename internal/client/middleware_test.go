@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/option"
+)
+
+func TestNonJSONResponseMiddleware(t *testing.T) {
+	const token = "secret-token"
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		body        string
+		wantErr     []string // substrings of the error, nil for no error
+		notInErr    []string
+	}{
+		{
+			name:        "JSON",
+			contentType: "application/json",
+			status:      http.StatusOK,
+			body:        `{"success":true,"errors":[],"result":{}}`,
+		},
+		{
+			name:        "HTML error page",
+			contentType: "text/html; charset=utf-8",
+			status:      http.StatusForbidden,
+			body:        "<html>\n  <body>Blocked by WAF, token " + token + "</body>\n</html>",
+			wantErr:     []string{"unexpected non-JSON response", "403 Forbidden", `"text/html; charset=utf-8"`, "<html> <body>Blocked by WAF, token [REDACTED]</body> </html>"},
+			notInErr:    []string{token},
+		},
+		{
+			name:        "long body is truncated",
+			contentType: "text/plain",
+			status:      http.StatusBadGateway,
+			body:        strings.Repeat("x", 2*maxBodySnippet),
+			wantErr:     []string{strings.Repeat("x", maxBodySnippet) + "..."},
+			notInErr:    []string{strings.Repeat("x", maxBodySnippet+1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			client := cloudflare.NewClient(
+				option.WithBaseURL(srv.URL+"/"),
+				option.WithAPIToken(token),
+				option.WithMaxRetries(0),
+				option.WithMiddleware(nonJSONResponseMiddleware(token)),
+			)
+			var res map[string]any
+			err := client.Get(context.Background(), "/zones", nil, &res)
+
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Get: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Get succeeded, want an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+			for _, unwanted := range tt.notInErr {
+				if strings.Contains(err.Error(), unwanted) {
+					t.Errorf("error %q contains %q", err, unwanted)
+				}
+			}
+		})
+	}
+}
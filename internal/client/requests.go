@@ -0,0 +1,139 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cloudflare-go/v6/option"
+)
+
+// idSegment matches path segments holding Cloudflare IDs (32 hex characters)
+// or tunnel UUIDs.
+var idSegment = regexp.MustCompile(`^([0-9a-f]{32}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+
+// RequestKey identifies a counted Cloudflare API request.
+type RequestKey struct {
+	Method   string
+	Endpoint string // normalized, e.g. /zones/{id}/dns_records
+	Zone     string // zone ID, empty for non-zone endpoints
+	Result   string // HTTP status code or "error"
+}
+
+// RequestCounter counts Cloudflare API requests. The counts are logged at
+// debug level after each sync and served as the
+// tunnel_manager_cloudflare_requests_total metric, see ServeHTTP. It is safe
+// for concurrent use.
+type RequestCounter struct {
+	mu     sync.Mutex
+	counts map[RequestKey]int
+}
+
+// NewRequestCounter returns an empty RequestCounter.
+func NewRequestCounter() *RequestCounter {
+	return &RequestCounter{counts: make(map[RequestKey]int)}
+}
+
+// Snapshot returns the current counts, sorted by key.
+func (c *RequestCounter) Snapshot() ([]RequestKey, []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]RequestKey, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Endpoint != b.Endpoint {
+			return a.Endpoint < b.Endpoint
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		if a.Zone != b.Zone {
+			return a.Zone < b.Zone
+		}
+		return a.Result < b.Result
+	})
+	counts := make([]int, len(keys))
+	for i, key := range keys {
+		counts[i] = c.counts[key]
+	}
+	return keys, counts
+}
+
+// requestsMetric is the name of the request counter metric.
+const requestsMetric = "tunnel_manager_cloudflare_requests_total"
+
+// labelEscaper escapes label values for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP serves the counts in the Prometheus text exposition format.
+func (c *RequestCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keys, counts := c.Snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintf(w, "# HELP %s Cloudflare API requests by method, normalized endpoint, zone ID and result.\n", requestsMetric)
+	fmt.Fprintf(w, "# TYPE %s counter\n", requestsMetric)
+	for i, key := range keys {
+		fmt.Fprintf(w, "%s{method=\"%s\",endpoint=\"%s\",zone=\"%s\",result=\"%s\"} %d\n",
+			requestsMetric,
+			labelEscaper.Replace(key.Method),
+			labelEscaper.Replace(key.Endpoint),
+			labelEscaper.Replace(key.Zone),
+			labelEscaper.Replace(key.Result),
+			counts[i],
+		)
+	}
+}
+
+func (c *RequestCounter) inc(key RequestKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]++
+}
+
+// requestCounterMiddleware counts every request sent through the Cloudflare
+// client.
+func requestCounterMiddleware(counter *RequestCounter) option.Middleware {
+	return func(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+		res, err := next(req)
+
+		endpoint, zone := normalizeEndpoint(req.URL.Path)
+		result := "error"
+		if res != nil {
+			result = strconv.Itoa(res.StatusCode)
+		}
+		counter.inc(RequestKey{
+			Method:   req.Method,
+			Endpoint: endpoint,
+			Zone:     zone,
+			Result:   result,
+		})
+
+		return res, err
+	}
+}
+
+// normalizeEndpoint replaces IDs in an API path with {id}, to keep the number
+// of distinct endpoints bounded, and returns the zone ID of zone endpoints.
+func normalizeEndpoint(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/client/v4")
+	segments := strings.Split(path, "/")
+	zone := ""
+	for i, segment := range segments {
+		if !idSegment.MatchString(segment) {
+			continue
+		}
+		if i > 0 && segments[i-1] == "zones" {
+			zone = segment
+		}
+		segments[i] = "{id}"
+	}
+	return strings.Join(segments, "/"), zone
+}
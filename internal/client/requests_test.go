@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/option"
+)
+
+const (
+	testZoneID   = "0123456789abcdef0123456789abcdef"
+	testRecordID = "fedcba9876543210fedcba9876543210"
+	testTunnelID = "00000000-0000-4000-8000-000000000001"
+)
+
+func TestNormalizeEndpoint(t *testing.T) {
+	tests := []struct {
+		path         string
+		wantEndpoint string
+		wantZone     string
+	}{
+		{path: "/client/v4/zones", wantEndpoint: "/zones"},
+		{path: "/client/v4/zones/" + testZoneID + "/dns_records", wantEndpoint: "/zones/{id}/dns_records", wantZone: testZoneID},
+		{path: "/zones/" + testZoneID + "/dns_records/" + testRecordID, wantEndpoint: "/zones/{id}/dns_records/{id}", wantZone: testZoneID},
+		{path: "/accounts/" + testZoneID + "/cfd_tunnel/" + testTunnelID + "/configurations", wantEndpoint: "/accounts/{id}/cfd_tunnel/{id}/configurations"},
+		{path: "/user/tokens/verify", wantEndpoint: "/user/tokens/verify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			endpoint, zone := normalizeEndpoint(tt.path)
+			if endpoint != tt.wantEndpoint || zone != tt.wantZone {
+				t.Errorf("normalizeEndpoint = %q, %q, want %q, %q", endpoint, zone, tt.wantEndpoint, tt.wantZone)
+			}
+		})
+	}
+}
+
+func TestRequestCounterMiddleware(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":1,"message":"not found"}]}`))
+			return
+		}
+		w.Write([]byte(`{"success":true,"errors":[],"result":{}}`))
+	}))
+	defer srv.Close()
+
+	counter := NewRequestCounter()
+	client := cloudflare.NewClient(
+		option.WithBaseURL(srv.URL+"/"),
+		option.WithAPIToken("test-token"),
+		option.WithMaxRetries(0),
+		option.WithMiddleware(requestCounterMiddleware(counter)),
+	)
+	ctx := context.Background()
+	var res map[string]any
+	records := "/zones/" + testZoneID + "/dns_records"
+	client.Get(ctx, records, nil, &res)
+	client.Get(ctx, records, nil, &res)
+	client.Post(ctx, records, map[string]any{}, &res)
+	client.Delete(ctx, records+"/"+testRecordID, nil, &res)
+
+	keys, counts := counter.Snapshot()
+	wantKeys := []RequestKey{
+		{Method: http.MethodGet, Endpoint: "/zones/{id}/dns_records", Zone: testZoneID, Result: "200"},
+		{Method: http.MethodPost, Endpoint: "/zones/{id}/dns_records", Zone: testZoneID, Result: "200"},
+		{Method: http.MethodDelete, Endpoint: "/zones/{id}/dns_records/{id}", Zone: testZoneID, Result: "404"},
+	}
+	if !slices.Equal(keys, wantKeys) {
+		t.Errorf("keys = %+v, want %+v", keys, wantKeys)
+	}
+	if want := []int{2, 1, 1}; !slices.Equal(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
+
+func TestRequestCounterServeHTTP(t *testing.T) {
+	counter := NewRequestCounter()
+	records := RequestKey{Method: http.MethodGet, Endpoint: "/zones/{id}/dns_records", Zone: testZoneID, Result: "200"}
+	counter.inc(records)
+	counter.inc(records)
+	counter.inc(RequestKey{Method: http.MethodPut, Endpoint: "/accounts/{id}/cfd_tunnel/{id}/configurations", Result: "error"})
+	counter.inc(RequestKey{Method: http.MethodGet, Endpoint: `/odd"\path`, Result: "200"})
+
+	rec := httptest.NewRecorder()
+	counter.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body, _ := io.ReadAll(rec.Body)
+	want := `# HELP tunnel_manager_cloudflare_requests_total Cloudflare API requests by method, normalized endpoint, zone ID and result.
+# TYPE tunnel_manager_cloudflare_requests_total counter
+tunnel_manager_cloudflare_requests_total{method="PUT",endpoint="/accounts/{id}/cfd_tunnel/{id}/configurations",zone="",result="error"} 1
+tunnel_manager_cloudflare_requests_total{method="GET",endpoint="/odd\"\\path",zone="",result="200"} 1
+tunnel_manager_cloudflare_requests_total{method="GET",endpoint="/zones/{id}/dns_records",zone="` + testZoneID + `",result="200"} 2
+`
+	if string(body) != want {
+		t.Errorf("metrics =\n%s\nwant\n%s", body, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", ct)
+	}
+}
@@ -1,18 +1,121 @@
 package config
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
 	defaultServiceHostnamesAnnotation    = "cloudflare-tunnel-hostnames"
 	defaultServiceUpstreamPortAnnotation = "cloudflare-tunnel-upstream-port"
+	defaultServiceRedirectAnnotation     = "cloudflare-tunnel-redirect-to"
+	defaultServiceDNSOnlyAnnotation      = "cloudflare-tunnel-dns-only"
+	defaultServiceIngressOnlyAnnotation  = "cloudflare-tunnel-ingress-only"
+	defaultServiceTXTAnnotation          = "cloudflare-tunnel-txt"
+	defaultServiceRecreateAnnotation     = "cloudflare-tunnel-recreate"
+	defaultServiceCAPoolAnnotation       = "cloudflare-tunnel-ca-pool"
+	defaultServiceClientCertAnnotation   = "cloudflare-tunnel-client-cert"
+	defaultServiceClientKeyAnnotation    = "cloudflare-tunnel-client-key"
+	defaultServiceStatusAnnotation       = "cloudflare-tunnel-status"
+	defaultServiceSchemeAnnotation       = "cloudflare-tunnel-upstream-scheme"
+	defaultServiceNoTLSVerifyAnnotation  = "cloudflare-tunnel-no-tls-verify"
+	defaultServiceProxiedAnnotation      = "cloudflare-tunnel-proxied"
+	defaultServicePassthroughAnnotation  = "cloudflare-tunnel-tls-passthrough"
+	defaultTXTRecordPrefix               = "_verify"
 	defaultSyncInterval                  = 15 * time.Second
 	defaultLogLevel                      = slog.LevelInfo
+	defaultOnRelease                     = OnReleaseDelete
+	defaultRecordNameForm                = RecordNameFormFQDN
+	defaultApexPolicy                    = ApexPolicyFlatten
+	defaultDuplicatePolicy               = DuplicatePolicyWarn
+	defaultMXNSConflictPolicy            = MXNSConflictPolicySkip
+	defaultPermissionProbe               = PermissionProbeOff
+	defaultDeletableRecordType           = "CNAME"
+	defaultLogFormat                     = LogFormatText
+	defaultOtherTypeConflictPolicy       = OtherTypeConflictPolicySkip
+	defaultCatchAllService               = "http_status:404"
+	defaultManagedCommentMarker          = "managed by tunnel-manager"
+	defaultDNSListingConcurrency         = 3
+)
+
+const (
+	// LogFormatText writes logs as logfmt-style key=value lines.
+	LogFormatText = "text"
+	// LogFormatJSON writes logs as one JSON object per line.
+	LogFormatJSON = "json"
+)
+
+const (
+	// OnReleaseDelete deletes managed records for hostnames that are no
+	// longer present in the desired state.
+	OnReleaseDelete = "delete"
+	// OnReleaseOrphan strips the managed marker from such records and leaves
+	// them in place, so DNS keeps resolving until cleaned up manually.
+	OnReleaseOrphan = "orphan"
+)
+
+const (
+	// RecordNameFormFQDN sends record names as fully qualified hostnames.
+	RecordNameFormFQDN = "fqdn"
+	// RecordNameFormRelative sends record names relative to the zone, using
+	// "@" for the zone apex.
+	RecordNameFormRelative = "relative"
+)
+
+const (
+	// ApexPolicyFlatten creates CNAMEs at the zone apex, relying on
+	// Cloudflare's CNAME flattening to coexist with the apex NS/SOA records.
+	ApexPolicyFlatten = "flatten"
+	// ApexPolicySkip refuses to create CNAMEs at the zone apex.
+	ApexPolicySkip = "skip"
+)
+
+const (
+	// DuplicatePolicyWarn leaves extra CNAMEs with the same name in place.
+	DuplicatePolicyWarn = "warn"
+	// DuplicatePolicyDelete deletes extra managed CNAMEs with the same name.
+	DuplicatePolicyDelete = "delete"
+)
+
+const (
+	// MXNSConflictPolicySkip refuses to create CNAMEs for hostnames that
+	// already have MX or NS records.
+	MXNSConflictPolicySkip = "skip"
+	// MXNSConflictPolicyIgnore creates CNAMEs regardless of MX/NS records.
+	MXNSConflictPolicyIgnore = "ignore"
+)
+
+const (
+	// OtherTypeConflictPolicySkip refuses to create CNAMEs for hostnames that
+	// already have records of other types (TXT, SRV, CAA, ...), which a CNAME
+	// cannot coexist with.
+	OtherTypeConflictPolicySkip = "skip"
+	// OtherTypeConflictPolicyIgnore attempts to create CNAMEs regardless, and
+	// lets Cloudflare reject them.
+	OtherTypeConflictPolicyIgnore = "ignore"
+)
+
+const (
+	// PermissionProbeOff does not check the API token permissions.
+	PermissionProbeOff = "off"
+	// PermissionProbeWarn warns at startup about missing permissions.
+	PermissionProbeWarn = "warn"
+	// PermissionProbeDisable warns about missing permissions and disables
+	// the sync phases that need them.
+	PermissionProbeDisable = "disable"
 )
 
 type Config struct {
@@ -21,17 +124,125 @@ type Config struct {
 	CloudFlareAPIToken            string
 	ServiceHostnamesAnnotation    string
 	ServiceUpstreamPortAnnotation string
+	ServiceRedirectAnnotation     string
+	ServiceDNSOnlyAnnotation      string
+	ServiceIngressOnlyAnnotation  string
+	ServiceTXTAnnotation          string
+	ServiceRecreateAnnotation     string
+	ServiceCAPoolAnnotation       string
+	ServiceClientCertAnnotation   string
+	ServiceClientKeyAnnotation    string
+	ServiceStatusAnnotation       string
+	ServiceSchemeAnnotation       string
+	ServiceNoTLSVerifyAnnotation  string
+	ServiceProxiedAnnotation      string
+	ServicePassthroughAnnotation  string
+	TXTRecordPrefix               string
 	SyncInterval                  time.Duration
 	LogLevel                      slog.Level
+	LogLevelKube                  slog.Level
+	LogLevelTunnel                slog.Level
+	LogLevelDNS                   slog.Level
+	OnRelease                     string
+	DNSFilteredListing            bool
+	DNSParallelListing            bool
+	DNSListingConcurrency         int
+	LogRedactHostnames            bool
+	RecordNameForm                string
+	DNSOnlyZones                  []string
+	ZoneProxiedDefaults           map[string]bool
+	ProxiedByServiceType          map[string]bool
+	ApexPolicy                    string
+	DuplicatePolicy               string
+	MXNSConflictPolicy            string
+	SkipUnchangedZones            bool
+	ZoneFullSyncInterval          time.Duration
+	TunnelCheckInterval           time.Duration
+	DestructiveCooldown           time.Duration
+	IngressOutputFile             string
+	IngressOutputOnly             bool
+	RedirectsEnabled              bool
+	DumpTunnelConfigPath          string
+	RequireSelectorlessEndpoints  bool
+	RecoverPanics                 bool
+	InferSchemeFromPort           bool
+	OmitDefaultPort               bool
+	TXTOwnership                  bool
+	DNSHostnameExclude            []string
+	TunnelHostnameExclude         []string
+	FailServiceOnAnyConflict      bool
+	PermissionProbe               string
+	CloudFlarePageSize            int
+	DeletableRecordTypes          []string
+	OwnerID                       string
+	RetargetForeignTunnel         bool
+	TunnelLockLease               string
+	TunnelLockNamespace           string
+	TunnelLockIdentity            string
+	MaxRecordAge                  time.Duration
+	RequirePortAnnotation         bool
+	CommentIncludeSource          bool
+	WriteCacheTTL                 time.Duration
+	HostnameRetries               int
+	MaxTotalHostnames             int
+	StreamZones                   bool
+	LogSampleRate                 int
+	AdoptRecords                  bool
+	AdoptReconcileSettings        bool
+	SoftDeleteConfirm             bool
+	SoftDeleteLedgerFile          string
+	TunnelName                    string
+	TunnelNameFix                 bool
+	TunnelConfigSecret            string
+	TunnelConfigSecretNamespace   string
+	WriteServiceStatus            bool
+	KubeconfigPath                string
+	LogFormat                     string
+	RunOnce                       bool
+	SyncOnStartup                 bool
+	MetricsAddr                   string
+	OtherTypeConflictPolicy       string
+	Namespaces                    []string
+	ExcludeNamespaces             []string
+	ServiceLabelSelector          string
+	CatchAllService               string
+	ManagedCommentMarker          string
+	Proxied                       bool
+	DNSTTL                        int
 }
 
 func LoadConfig() (*Config, error) {
-	accountID := os.Getenv("CLOUDFLARE_ACCOUNT_ID")
-	tunnelID := os.Getenv("CLOUDFLARE_TUNNEL_ID")
-	apiToken := os.Getenv("CLOUDFLARE_API_TOKEN")
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	dumpTunnelConfigPath := flags.String("dump-tunnel-config", os.Getenv("DUMP_TUNNEL_CONFIG"),
+		"write the tunnel configuration JSON to this path and exit, without changing the tunnel, DNS or services")
+	runOnceDefault, err := parseBool("RUN_ONCE", false)
+	if err != nil {
+		return nil, err
+	}
+	runOnce := flags.Bool("once", runOnceDefault, "run a single sync and exit, with a non-zero status if it failed")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+	// Dumping the tunnel configuration is a dry run, done once.
+	if *dumpTunnelConfigPath != "" {
+		*runOnce = true
+	}
+
+	accountID, err := parseFileOrEnv("CLOUDFLARE_ACCOUNT_ID")
+	if err != nil {
+		return nil, err
+	}
+	tunnelID, err := parseFileOrEnv("CLOUDFLARE_TUNNEL_ID")
+	if err != nil {
+		return nil, err
+	}
+	apiToken, err := parseFileOrEnv("CLOUDFLARE_API_TOKEN")
+	if err != nil {
+		return nil, err
+	}
 
 	if accountID == "" || tunnelID == "" || apiToken == "" {
-		return nil, fmt.Errorf("CLOUDFLARE_ACCOUNT_ID, CLOUDFLARE_TUNNEL_ID and CLOUDFLARE_API_TOKEN must be set")
+		return nil, fmt.Errorf("CLOUDFLARE_ACCOUNT_ID, CLOUDFLARE_TUNNEL_ID and CLOUDFLARE_API_TOKEN (or their _FILE variants) must be set")
 	}
 
 	serviceHostnamesAnnotation := os.Getenv("SERVICE_HOSTNAMES_ANNOTATION")
@@ -44,22 +255,455 @@ func LoadConfig() (*Config, error) {
 		serviceUpstreamPortAnnotation = defaultServiceUpstreamPortAnnotation
 	}
 
-	logLevelEnv := os.Getenv("LOG_LEVEL")
-	logLevel := defaultLogLevel
-	switch logLevelEnv {
-	case "debug":
-		logLevel = slog.LevelDebug
-	case "warn":
-		logLevel = slog.LevelWarn
-	case "error":
-		logLevel = slog.LevelError
+	serviceRedirectAnnotation := os.Getenv("SERVICE_REDIRECT_ANNOTATION")
+	if serviceRedirectAnnotation == "" {
+		serviceRedirectAnnotation = defaultServiceRedirectAnnotation
+	}
+
+	serviceDNSOnlyAnnotation := os.Getenv("SERVICE_DNS_ONLY_ANNOTATION")
+	if serviceDNSOnlyAnnotation == "" {
+		serviceDNSOnlyAnnotation = defaultServiceDNSOnlyAnnotation
+	}
+
+	serviceIngressOnlyAnnotation := os.Getenv("SERVICE_INGRESS_ONLY_ANNOTATION")
+	if serviceIngressOnlyAnnotation == "" {
+		serviceIngressOnlyAnnotation = defaultServiceIngressOnlyAnnotation
+	}
+
+	serviceTXTAnnotation := os.Getenv("SERVICE_TXT_ANNOTATION")
+	if serviceTXTAnnotation == "" {
+		serviceTXTAnnotation = defaultServiceTXTAnnotation
+	}
+
+	serviceRecreateAnnotation := os.Getenv("SERVICE_RECREATE_ANNOTATION")
+	if serviceRecreateAnnotation == "" {
+		serviceRecreateAnnotation = defaultServiceRecreateAnnotation
+	}
+
+	serviceCAPoolAnnotation := os.Getenv("SERVICE_CA_POOL_ANNOTATION")
+	if serviceCAPoolAnnotation == "" {
+		serviceCAPoolAnnotation = defaultServiceCAPoolAnnotation
+	}
+
+	serviceClientCertAnnotation := os.Getenv("SERVICE_CLIENT_CERT_ANNOTATION")
+	if serviceClientCertAnnotation == "" {
+		serviceClientCertAnnotation = defaultServiceClientCertAnnotation
+	}
+
+	serviceClientKeyAnnotation := os.Getenv("SERVICE_CLIENT_KEY_ANNOTATION")
+	if serviceClientKeyAnnotation == "" {
+		serviceClientKeyAnnotation = defaultServiceClientKeyAnnotation
+	}
+
+	servicePassthroughAnnotation := os.Getenv("SERVICE_TLS_PASSTHROUGH_ANNOTATION")
+	if servicePassthroughAnnotation == "" {
+		servicePassthroughAnnotation = defaultServicePassthroughAnnotation
+	}
+
+	serviceSchemeAnnotation := os.Getenv("SERVICE_SCHEME_ANNOTATION")
+	if serviceSchemeAnnotation == "" {
+		serviceSchemeAnnotation = defaultServiceSchemeAnnotation
+	}
+
+	serviceNoTLSVerifyAnnotation := os.Getenv("SERVICE_NO_TLS_VERIFY_ANNOTATION")
+	if serviceNoTLSVerifyAnnotation == "" {
+		serviceNoTLSVerifyAnnotation = defaultServiceNoTLSVerifyAnnotation
+	}
+
+	serviceProxiedAnnotation := os.Getenv("SERVICE_PROXIED_ANNOTATION")
+	if serviceProxiedAnnotation == "" {
+		serviceProxiedAnnotation = defaultServiceProxiedAnnotation
+	}
+
+	serviceStatusAnnotation := os.Getenv("SERVICE_STATUS_ANNOTATION")
+	if serviceStatusAnnotation == "" {
+		serviceStatusAnnotation = defaultServiceStatusAnnotation
+	}
+
+	txtRecordPrefix := os.Getenv("TXT_RECORD_PREFIX")
+	if txtRecordPrefix == "" {
+		txtRecordPrefix = defaultTXTRecordPrefix
+	}
+
+	logLevel, err := parseLogLevel("LOG_LEVEL", defaultLogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logLevelKube, err := parseLogLevel("LOG_LEVEL_KUBE", logLevel)
+	if err != nil {
+		return nil, err
+	}
+	logLevelTunnel, err := parseLogLevel("LOG_LEVEL_TUNNEL", logLevel)
+	if err != nil {
+		return nil, err
+	}
+	logLevelDNS, err := parseLogLevel("LOG_LEVEL_DNS", logLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	syncInterval, err := parseSyncInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelCheckInterval, err := parseDuration("TUNNEL_CHECK_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	destructiveCooldown, err := parseDuration("DESTRUCTIVE_COOLDOWN", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	onRelease := os.Getenv("ON_RELEASE")
+	switch onRelease {
+	case OnReleaseDelete, OnReleaseOrphan:
+		// valid
 	case "":
-		// use default
+		onRelease = defaultOnRelease
 	default:
-		return nil, fmt.Errorf("invalid LOG_LEVEL=%q", logLevelEnv)
+		return nil, fmt.Errorf("invalid ON_RELEASE=%q", onRelease)
 	}
 
-	syncInterval, err := parseSyncInterval()
+	recordNameForm := os.Getenv("RECORD_NAME_FORM")
+	switch recordNameForm {
+	case RecordNameFormFQDN, RecordNameFormRelative:
+		// valid
+	case "":
+		recordNameForm = defaultRecordNameForm
+	default:
+		return nil, fmt.Errorf("invalid RECORD_NAME_FORM=%q", recordNameForm)
+	}
+
+	dnsOnlyZones := parseList("DNS_ONLY_ZONES")
+	for i, zone := range dnsOnlyZones {
+		dnsOnlyZones[i] = strings.ToLower(strings.TrimSuffix(zone, "."))
+	}
+
+	zoneProxiedDefaults, err := parseProxiedMap("ZONE_PROXIED_DEFAULTS", true)
+	if err != nil {
+		return nil, err
+	}
+
+	proxiedByServiceType, err := parseProxiedMap("PROXIED_BY_SERVICE_TYPE", false)
+	if err != nil {
+		return nil, err
+	}
+
+	apexPolicy := os.Getenv("APEX_POLICY")
+	switch apexPolicy {
+	case ApexPolicyFlatten, ApexPolicySkip:
+		// valid
+	case "":
+		apexPolicy = defaultApexPolicy
+	default:
+		return nil, fmt.Errorf("invalid APEX_POLICY=%q", apexPolicy)
+	}
+
+	duplicatePolicy := os.Getenv("DUPLICATE_RECORD_POLICY")
+	switch duplicatePolicy {
+	case DuplicatePolicyWarn, DuplicatePolicyDelete:
+		// valid
+	case "":
+		duplicatePolicy = defaultDuplicatePolicy
+	default:
+		return nil, fmt.Errorf("invalid DUPLICATE_RECORD_POLICY=%q", duplicatePolicy)
+	}
+
+	mxNSConflictPolicy := os.Getenv("MX_NS_CONFLICT_POLICY")
+	switch mxNSConflictPolicy {
+	case MXNSConflictPolicySkip, MXNSConflictPolicyIgnore:
+		// valid
+	case "":
+		mxNSConflictPolicy = defaultMXNSConflictPolicy
+	default:
+		return nil, fmt.Errorf("invalid MX_NS_CONFLICT_POLICY=%q", mxNSConflictPolicy)
+	}
+
+	otherTypeConflictPolicy := os.Getenv("OTHER_TYPE_CONFLICT_POLICY")
+	switch otherTypeConflictPolicy {
+	case OtherTypeConflictPolicySkip, OtherTypeConflictPolicyIgnore:
+		// valid
+	case "":
+		otherTypeConflictPolicy = defaultOtherTypeConflictPolicy
+	default:
+		return nil, fmt.Errorf("invalid OTHER_TYPE_CONFLICT_POLICY=%q", otherTypeConflictPolicy)
+	}
+
+	dnsFilteredListing, err := parseBool("DNS_FILTERED_LISTING", false)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsParallelListing, err := parseBool("DNS_PARALLEL_LISTING", false)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsListingConcurrency, err := parsePositiveInt("DNS_LISTING_CONCURRENCY", defaultDNSListingConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	logRedactHostnames, err := parseBool("LOG_REDACT_HOSTNAMES", false)
+	if err != nil {
+		return nil, err
+	}
+
+	skipUnchangedZones, err := parseBool("SKIP_UNCHANGED_ZONES", false)
+	if err != nil {
+		return nil, err
+	}
+	zoneFullSyncInterval, err := parseDuration("ZONE_FULL_SYNC_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	ingressOutputFile := os.Getenv("INGRESS_OUTPUT_FILE")
+	ingressOutputOnly, err := parseBool("INGRESS_OUTPUT_ONLY", false)
+	if err != nil {
+		return nil, err
+	}
+	if ingressOutputOnly && ingressOutputFile == "" {
+		return nil, fmt.Errorf("INGRESS_OUTPUT_ONLY requires INGRESS_OUTPUT_FILE to be set")
+	}
+
+	redirectsEnabled, err := parseBool("REDIRECTS_ENABLED", false)
+	if err != nil {
+		return nil, err
+	}
+
+	requireSelectorlessEndpoints, err := parseBool("REQUIRE_SELECTORLESS_ENDPOINTS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	recoverPanics, err := parseBool("RECOVER_PANICS", true)
+	if err != nil {
+		return nil, err
+	}
+
+	inferSchemeFromPort, err := parseBool("INFER_SCHEME_FROM_PORT", false)
+	if err != nil {
+		return nil, err
+	}
+
+	omitDefaultPort, err := parseBool("OMIT_DEFAULT_PORT", false)
+	if err != nil {
+		return nil, err
+	}
+
+	txtOwnership, err := parseBool("TXT_OWNERSHIP", false)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsHostnameExclude, err := parsePatterns("DNS_HOSTNAME_EXCLUDE")
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelHostnameExclude, err := parsePatterns("TUNNEL_HOSTNAME_EXCLUDE")
+	if err != nil {
+		return nil, err
+	}
+
+	failServiceOnAnyConflict, err := parseBool("FAIL_SERVICE_ON_ANY_CONFLICT", false)
+	if err != nil {
+		return nil, err
+	}
+
+	permissionProbe := os.Getenv("PERMISSION_PROBE")
+	switch permissionProbe {
+	case PermissionProbeOff, PermissionProbeWarn, PermissionProbeDisable:
+		// valid
+	case "":
+		permissionProbe = defaultPermissionProbe
+	default:
+		return nil, fmt.Errorf("invalid PERMISSION_PROBE=%q", permissionProbe)
+	}
+
+	cloudFlarePageSize, err := parsePositiveInt("CLOUDFLARE_PAGE_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	deletableRecordTypes := parseList("DELETABLE_RECORD_TYPES")
+	if len(deletableRecordTypes) == 0 {
+		deletableRecordTypes = []string{defaultDeletableRecordType}
+	}
+	for i, t := range deletableRecordTypes {
+		deletableRecordTypes[i] = strings.ToUpper(t)
+	}
+	// Ownership TXT records follow the lifecycle of the CNAMEs, so they
+	// must be deletable; otherwise they would pile up forever.
+	if txtOwnership && !slices.Contains(deletableRecordTypes, "TXT") {
+		return nil, fmt.Errorf("TXT_OWNERSHIP requires TXT in DELETABLE_RECORD_TYPES (e.g. DELETABLE_RECORD_TYPES=CNAME,TXT)")
+	}
+
+	ownerID := os.Getenv("OWNER_ID")
+	if strings.ContainsAny(ownerID, "() ") {
+		return nil, fmt.Errorf("invalid OWNER_ID=%q", ownerID)
+	}
+
+	retargetForeignTunnel, err := parseBool("RETARGET_FOREIGN_TUNNEL", true)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelLockLease := os.Getenv("TUNNEL_LOCK_LEASE")
+	tunnelLockNamespace := os.Getenv("TUNNEL_LOCK_NAMESPACE")
+	if tunnelLockLease != "" && tunnelLockNamespace == "" {
+		return nil, fmt.Errorf("TUNNEL_LOCK_LEASE requires TUNNEL_LOCK_NAMESPACE to be set")
+	}
+	tunnelLockIdentity := os.Getenv("TUNNEL_LOCK_IDENTITY")
+	if tunnelLockIdentity == "" {
+		tunnelLockIdentity, _ = os.Hostname()
+	}
+
+	maxRecordAge, err := parseDuration("MAX_RECORD_AGE", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	requirePortAnnotation, err := parseBool("REQUIRE_PORT_ANNOTATION", false)
+	if err != nil {
+		return nil, err
+	}
+
+	commentIncludeSource, err := parseBool("COMMENT_INCLUDE_SOURCE", false)
+	if err != nil {
+		return nil, err
+	}
+
+	writeCacheTTL, err := parseDuration("WRITE_CACHE_TTL", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hostnameRetries, err := parseNonNegativeInt("HOSTNAME_RETRIES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	maxTotalHostnames, err := parsePositiveInt("MAX_TOTAL_HOSTNAMES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	streamZones, err := parseBool("STREAM_ZONES", false)
+	if err != nil {
+		return nil, err
+	}
+
+	logSampleRate, err := parsePositiveInt("LOG_SAMPLE_RATE", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	adoptRecords, err := parseBool("ADOPT_RECORDS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	adoptReconcileSettings, err := parseBool("ADOPT_RECONCILE_SETTINGS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	softDeleteConfirm, err := parseBool("SOFT_DELETE_CONFIRM", false)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelName := os.Getenv("TUNNEL_NAME")
+	tunnelNameFix, err := parseBool("TUNNEL_NAME_FIX", false)
+	if err != nil {
+		return nil, err
+	}
+	if tunnelNameFix && tunnelName == "" {
+		return nil, fmt.Errorf("TUNNEL_NAME_FIX requires TUNNEL_NAME to be set")
+	}
+
+	tunnelConfigSecret := os.Getenv("TUNNEL_CONFIG_SECRET")
+	tunnelConfigSecretNamespace := os.Getenv("TUNNEL_CONFIG_SECRET_NAMESPACE")
+	if tunnelConfigSecret != "" && tunnelConfigSecretNamespace == "" {
+		return nil, fmt.Errorf("TUNNEL_CONFIG_SECRET requires TUNNEL_CONFIG_SECRET_NAMESPACE to be set")
+	}
+
+	writeServiceStatus, err := parseBool("WRITE_SERVICE_STATUS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	logFormat := os.Getenv("LOG_FORMAT")
+	switch logFormat {
+	case LogFormatText, LogFormatJSON:
+		// valid
+	case "":
+		logFormat = defaultLogFormat
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT=%q", logFormat)
+	}
+
+	syncOnStartup, err := parseBool("SYNC_ON_STARTUP", true)
+	if err != nil {
+		return nil, err
+	}
+
+	// METRICS_ADDR, e.g. ":9090", enables the /metrics endpoint.
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	if metricsAddr != "" {
+		if _, _, err := net.SplitHostPort(metricsAddr); err != nil {
+			return nil, fmt.Errorf("invalid METRICS_ADDR=%q: %w", metricsAddr, err)
+		}
+	}
+
+	// NAMESPACE_ALLOWLIST and NAMESPACE_DENYLIST are aliases of NAMESPACES
+	// and EXCLUDE_NAMESPACES. Setting both names of a list, or listing a
+	// namespace as both allowed and denied, is ambiguous and rejected.
+	namespaces, err := parseListAlias("NAMESPACES", "NAMESPACE_ALLOWLIST")
+	if err != nil {
+		return nil, err
+	}
+	excludeNamespaces, err := parseListAlias("EXCLUDE_NAMESPACES", "NAMESPACE_DENYLIST")
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range namespaces {
+		if slices.Contains(excludeNamespaces, ns) {
+			return nil, fmt.Errorf("namespace %q is both allowed by NAMESPACES and denied by EXCLUDE_NAMESPACES", ns)
+		}
+	}
+
+	serviceLabelSelector := os.Getenv("SERVICE_LABEL_SELECTOR")
+	if _, err := labels.Parse(serviceLabelSelector); err != nil {
+		return nil, fmt.Errorf("invalid SERVICE_LABEL_SELECTOR=%q: %w", serviceLabelSelector, err)
+	}
+
+	// TUNNEL_FALLBACK_SERVICE is an alias of CATCH_ALL_SERVICE.
+	catchAllServiceEnv := "CATCH_ALL_SERVICE"
+	if os.Getenv(catchAllServiceEnv) == "" {
+		catchAllServiceEnv = "TUNNEL_FALLBACK_SERVICE"
+	}
+	catchAllService, err := parseCatchAllService(catchAllServiceEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	managedCommentMarker := strings.TrimSpace(os.Getenv("MANAGED_COMMENT_MARKER"))
+	if managedCommentMarker == "" {
+		managedCommentMarker = defaultManagedCommentMarker
+	}
+
+	proxied, err := parseBool("CLOUDFLARE_PROXIED", true)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsTTL, err := parseDNSTTL("CLOUDFLARE_DNS_TTL")
 	if err != nil {
 		return nil, err
 	}
@@ -70,8 +714,91 @@ func LoadConfig() (*Config, error) {
 		CloudFlareAPIToken:            apiToken,
 		ServiceHostnamesAnnotation:    serviceHostnamesAnnotation,
 		ServiceUpstreamPortAnnotation: serviceUpstreamPortAnnotation,
+		ServiceRedirectAnnotation:     serviceRedirectAnnotation,
+		ServiceDNSOnlyAnnotation:      serviceDNSOnlyAnnotation,
+		ServiceIngressOnlyAnnotation:  serviceIngressOnlyAnnotation,
+		ServiceTXTAnnotation:          serviceTXTAnnotation,
+		ServiceRecreateAnnotation:     serviceRecreateAnnotation,
+		ServiceCAPoolAnnotation:       serviceCAPoolAnnotation,
+		ServiceClientCertAnnotation:   serviceClientCertAnnotation,
+		ServiceClientKeyAnnotation:    serviceClientKeyAnnotation,
+		ServiceStatusAnnotation:       serviceStatusAnnotation,
+		ServiceSchemeAnnotation:       serviceSchemeAnnotation,
+		ServiceNoTLSVerifyAnnotation:  serviceNoTLSVerifyAnnotation,
+		ServiceProxiedAnnotation:      serviceProxiedAnnotation,
+		ServicePassthroughAnnotation:  servicePassthroughAnnotation,
+		TXTRecordPrefix:               txtRecordPrefix,
 		SyncInterval:                  syncInterval,
 		LogLevel:                      logLevel,
+		LogLevelKube:                  logLevelKube,
+		LogLevelTunnel:                logLevelTunnel,
+		LogLevelDNS:                   logLevelDNS,
+		OnRelease:                     onRelease,
+		DNSFilteredListing:            dnsFilteredListing,
+		DNSParallelListing:            dnsParallelListing,
+		DNSListingConcurrency:         dnsListingConcurrency,
+		LogRedactHostnames:            logRedactHostnames,
+		RecordNameForm:                recordNameForm,
+		DNSOnlyZones:                  dnsOnlyZones,
+		ZoneProxiedDefaults:           zoneProxiedDefaults,
+		ProxiedByServiceType:          proxiedByServiceType,
+		ApexPolicy:                    apexPolicy,
+		DuplicatePolicy:               duplicatePolicy,
+		MXNSConflictPolicy:            mxNSConflictPolicy,
+		SkipUnchangedZones:            skipUnchangedZones,
+		ZoneFullSyncInterval:          zoneFullSyncInterval,
+		TunnelCheckInterval:           tunnelCheckInterval,
+		DestructiveCooldown:           destructiveCooldown,
+		IngressOutputFile:             ingressOutputFile,
+		IngressOutputOnly:             ingressOutputOnly,
+		RedirectsEnabled:              redirectsEnabled,
+		DumpTunnelConfigPath:          *dumpTunnelConfigPath,
+		RequireSelectorlessEndpoints:  requireSelectorlessEndpoints,
+		RecoverPanics:                 recoverPanics,
+		InferSchemeFromPort:           inferSchemeFromPort,
+		OmitDefaultPort:               omitDefaultPort,
+		TXTOwnership:                  txtOwnership,
+		DNSHostnameExclude:            dnsHostnameExclude,
+		TunnelHostnameExclude:         tunnelHostnameExclude,
+		FailServiceOnAnyConflict:      failServiceOnAnyConflict,
+		PermissionProbe:               permissionProbe,
+		CloudFlarePageSize:            cloudFlarePageSize,
+		DeletableRecordTypes:          deletableRecordTypes,
+		OwnerID:                       ownerID,
+		RetargetForeignTunnel:         retargetForeignTunnel,
+		TunnelLockLease:               tunnelLockLease,
+		TunnelLockNamespace:           tunnelLockNamespace,
+		TunnelLockIdentity:            tunnelLockIdentity,
+		MaxRecordAge:                  maxRecordAge,
+		RequirePortAnnotation:         requirePortAnnotation,
+		CommentIncludeSource:          commentIncludeSource,
+		WriteCacheTTL:                 writeCacheTTL,
+		HostnameRetries:               hostnameRetries,
+		MaxTotalHostnames:             maxTotalHostnames,
+		StreamZones:                   streamZones,
+		LogSampleRate:                 logSampleRate,
+		AdoptRecords:                  adoptRecords,
+		AdoptReconcileSettings:        adoptReconcileSettings,
+		SoftDeleteConfirm:             softDeleteConfirm,
+		SoftDeleteLedgerFile:          os.Getenv("SOFT_DELETE_LEDGER_FILE"),
+		TunnelName:                    tunnelName,
+		TunnelNameFix:                 tunnelNameFix,
+		TunnelConfigSecret:            tunnelConfigSecret,
+		TunnelConfigSecretNamespace:   tunnelConfigSecretNamespace,
+		WriteServiceStatus:            writeServiceStatus,
+		KubeconfigPath:                os.Getenv("KUBECONFIG"),
+		LogFormat:                     logFormat,
+		RunOnce:                       *runOnce,
+		SyncOnStartup:                 syncOnStartup,
+		MetricsAddr:                   metricsAddr,
+		OtherTypeConflictPolicy:       otherTypeConflictPolicy,
+		Namespaces:                    namespaces,
+		ExcludeNamespaces:             excludeNamespaces,
+		ServiceLabelSelector:          serviceLabelSelector,
+		CatchAllService:               catchAllService,
+		ManagedCommentMarker:          managedCommentMarker,
+		Proxied:                       proxied,
+		DNSTTL:                        dnsTTL,
 	}, nil
 }
 
@@ -80,18 +807,293 @@ func (c *Config) Print(logger *slog.Logger) {
 	logger.Info("config", slog.String("key", "CloudFlare Tunnel ID"), slog.String("value", c.CloudFlareTunnelID))
 	logger.Info("config", slog.String("key", "service domain label key"), slog.String("value", c.ServiceHostnamesAnnotation))
 	logger.Info("config", slog.String("key", "service upstream port label key"), slog.String("value", c.ServiceUpstreamPortAnnotation))
+	logger.Info("config", slog.String("key", "service redirect label key"), slog.String("value", c.ServiceRedirectAnnotation))
+	logger.Info("config", slog.String("key", "service dns only label key"), slog.String("value", c.ServiceDNSOnlyAnnotation))
+	logger.Info("config", slog.String("key", "service ingress only label key"), slog.String("value", c.ServiceIngressOnlyAnnotation))
+	logger.Info("config", slog.String("key", "service txt label key"), slog.String("value", c.ServiceTXTAnnotation))
+	logger.Info("config", slog.String("key", "service recreate label key"), slog.String("value", c.ServiceRecreateAnnotation))
+	logger.Info("config", slog.String("key", "service ca pool label key"), slog.String("value", c.ServiceCAPoolAnnotation))
+	logger.Info("config", slog.String("key", "service client cert label key"), slog.String("value", c.ServiceClientCertAnnotation))
+	logger.Info("config", slog.String("key", "service client key label key"), slog.String("value", c.ServiceClientKeyAnnotation))
+	logger.Info("config", slog.String("key", "service status label key"), slog.String("value", c.ServiceStatusAnnotation))
+	logger.Info("config", slog.String("key", "service scheme label key"), slog.String("value", c.ServiceSchemeAnnotation))
+	logger.Info("config", slog.String("key", "service no tls verify label key"), slog.String("value", c.ServiceNoTLSVerifyAnnotation))
+	logger.Info("config", slog.String("key", "service proxied label key"), slog.String("value", c.ServiceProxiedAnnotation))
+	logger.Info("config", slog.String("key", "service tls passthrough label key"), slog.String("value", c.ServicePassthroughAnnotation))
+	logger.Info("config", slog.String("key", "txt record prefix"), slog.String("value", c.TXTRecordPrefix))
+	logger.Info("config", slog.String("key", "txt ownership"), slog.Bool("value", c.TXTOwnership))
 	logger.Info("config", slog.String("key", "sync interval"), slog.String("value", c.SyncInterval.String()))
 	logger.Info("config", slog.String("key", "log level"), slog.String("value", c.LogLevel.String()))
+	logger.Info("config", slog.String("key", "log level kube"), slog.String("value", c.LogLevelKube.String()))
+	logger.Info("config", slog.String("key", "log level tunnel"), slog.String("value", c.LogLevelTunnel.String()))
+	logger.Info("config", slog.String("key", "log level dns"), slog.String("value", c.LogLevelDNS.String()))
+	logger.Info("config", slog.String("key", "on release"), slog.String("value", c.OnRelease))
+	logger.Info("config", slog.String("key", "dns filtered listing"), slog.Bool("value", c.DNSFilteredListing))
+	logger.Info("config", slog.String("key", "dns parallel listing"), slog.Bool("value", c.DNSParallelListing))
+	logger.Info("config", slog.String("key", "dns listing concurrency"), slog.Int("value", c.DNSListingConcurrency))
+	logger.Info("config", slog.String("key", "log redact hostnames"), slog.Bool("value", c.LogRedactHostnames))
+	logger.Info("config", slog.String("key", "record name form"), slog.String("value", c.RecordNameForm))
+	logger.Info("config", slog.String("key", "dns only zones"), slog.String("value", strings.Join(c.DNSOnlyZones, ", ")))
+	logger.Info("config", slog.String("key", "dns hostname exclude"), slog.String("value", strings.Join(c.DNSHostnameExclude, ", ")))
+	logger.Info("config", slog.String("key", "tunnel hostname exclude"), slog.String("value", strings.Join(c.TunnelHostnameExclude, ", ")))
+	logger.Info("config", slog.String("key", "fail service on any conflict"), slog.Bool("value", c.FailServiceOnAnyConflict))
+	logger.Info("config", slog.String("key", "permission probe"), slog.String("value", c.PermissionProbe))
+	logger.Info("config", slog.String("key", "cloudflare page size"), slog.Int("value", c.CloudFlarePageSize))
+	logger.Info("config", slog.String("key", "deletable record types"), slog.String("value", strings.Join(c.DeletableRecordTypes, ", ")))
+	logger.Info("config", slog.String("key", "owner id"), slog.String("value", c.OwnerID))
+	logger.Info("config", slog.String("key", "retarget foreign tunnel"), slog.Bool("value", c.RetargetForeignTunnel))
+	logger.Info("config", slog.String("key", "tunnel lock lease"), slog.String("value", c.TunnelLockLease))
+	logger.Info("config", slog.String("key", "tunnel lock namespace"), slog.String("value", c.TunnelLockNamespace))
+	logger.Info("config", slog.String("key", "tunnel lock identity"), slog.String("value", c.TunnelLockIdentity))
+	logger.Info("config", slog.String("key", "max record age"), slog.String("value", c.MaxRecordAge.String()))
+	logger.Info("config", slog.String("key", "require port annotation"), slog.Bool("value", c.RequirePortAnnotation))
+	logger.Info("config", slog.String("key", "comment include source"), slog.Bool("value", c.CommentIncludeSource))
+	logger.Info("config", slog.String("key", "write cache ttl"), slog.String("value", c.WriteCacheTTL.String()))
+	logger.Info("config", slog.String("key", "hostname retries"), slog.Int("value", c.HostnameRetries))
+	logger.Info("config", slog.String("key", "max total hostnames"), slog.Int("value", c.MaxTotalHostnames))
+	logger.Info("config", slog.String("key", "stream zones"), slog.Bool("value", c.StreamZones))
+	logger.Info("config", slog.String("key", "log sample rate"), slog.Int("value", c.LogSampleRate))
+	logger.Info("config", slog.String("key", "adopt records"), slog.Bool("value", c.AdoptRecords))
+	logger.Info("config", slog.String("key", "adopt reconcile settings"), slog.Bool("value", c.AdoptReconcileSettings))
+	logger.Info("config", slog.String("key", "soft delete confirm"), slog.Bool("value", c.SoftDeleteConfirm))
+	logger.Info("config", slog.String("key", "soft delete ledger file"), slog.String("value", c.SoftDeleteLedgerFile))
+	logger.Info("config", slog.String("key", "tunnel name"), slog.String("value", c.TunnelName))
+	logger.Info("config", slog.String("key", "tunnel name fix"), slog.Bool("value", c.TunnelNameFix))
+	logger.Info("config", slog.String("key", "tunnel config secret"), slog.String("value", c.TunnelConfigSecret))
+	logger.Info("config", slog.String("key", "tunnel config secret namespace"), slog.String("value", c.TunnelConfigSecretNamespace))
+	logger.Info("config", slog.String("key", "write service status"), slog.Bool("value", c.WriteServiceStatus))
+	logger.Info("config", slog.String("key", "kubeconfig path"), slog.String("value", c.KubeconfigPath))
+	logger.Info("config", slog.String("key", "log format"), slog.String("value", c.LogFormat))
+	logger.Info("config", slog.String("key", "run once"), slog.Bool("value", c.RunOnce))
+	logger.Info("config", slog.String("key", "sync on startup"), slog.Bool("value", c.SyncOnStartup))
+	logger.Info("config", slog.String("key", "metrics addr"), slog.String("value", c.MetricsAddr))
+	logger.Info("config", slog.String("key", "other type conflict policy"), slog.String("value", c.OtherTypeConflictPolicy))
+	logger.Info("config", slog.String("key", "namespaces"), slog.String("value", strings.Join(c.Namespaces, ", ")))
+	logger.Info("config", slog.String("key", "exclude namespaces"), slog.String("value", strings.Join(c.ExcludeNamespaces, ", ")))
+	logger.Info("config", slog.String("key", "service label selector"), slog.String("value", c.ServiceLabelSelector))
+	logger.Info("config", slog.String("key", "catch all service"), slog.String("value", c.CatchAllService))
+	logger.Info("config", slog.String("key", "managed comment marker"), slog.String("value", c.ManagedCommentMarker))
+	logger.Info("config", slog.String("key", "proxied"), slog.Bool("value", c.Proxied))
+	logger.Info("config", slog.String("key", "dns ttl"), slog.Int("value", c.DNSTTL))
+	logger.Info("config", slog.String("key", "zone proxied defaults"), slog.Any("value", c.ZoneProxiedDefaults))
+	logger.Info("config", slog.String("key", "proxied by service type"), slog.Any("value", c.ProxiedByServiceType))
+	logger.Info("config", slog.String("key", "apex policy"), slog.String("value", c.ApexPolicy))
+	logger.Info("config", slog.String("key", "duplicate record policy"), slog.String("value", c.DuplicatePolicy))
+	logger.Info("config", slog.String("key", "mx/ns conflict policy"), slog.String("value", c.MXNSConflictPolicy))
+	logger.Info("config", slog.String("key", "skip unchanged zones"), slog.Bool("value", c.SkipUnchangedZones))
+	logger.Info("config", slog.String("key", "zone full sync interval"), slog.String("value", c.ZoneFullSyncInterval.String()))
+	logger.Info("config", slog.String("key", "tunnel check interval"), slog.String("value", c.TunnelCheckInterval.String()))
+	logger.Info("config", slog.String("key", "destructive cooldown"), slog.String("value", c.DestructiveCooldown.String()))
+	logger.Info("config", slog.String("key", "ingress output file"), slog.String("value", c.IngressOutputFile))
+	logger.Info("config", slog.String("key", "ingress output only"), slog.Bool("value", c.IngressOutputOnly))
+	logger.Info("config", slog.String("key", "redirects enabled"), slog.Bool("value", c.RedirectsEnabled))
+	logger.Info("config", slog.String("key", "dump tunnel config path"), slog.String("value", c.DumpTunnelConfigPath))
+	logger.Info("config", slog.String("key", "require selectorless endpoints"), slog.Bool("value", c.RequireSelectorlessEndpoints))
+	logger.Info("config", slog.String("key", "recover panics"), slog.Bool("value", c.RecoverPanics))
+	logger.Info("config", slog.String("key", "infer scheme from port"), slog.Bool("value", c.InferSchemeFromPort))
+	logger.Info("config", slog.String("key", "omit default port"), slog.Bool("value", c.OmitDefaultPort))
+}
+
+// MinLogLevel returns the most verbose of the global and per-module log
+// levels, i.e. the level the underlying log handler must accept.
+func (c *Config) MinLogLevel() slog.Level {
+	return min(c.LogLevel, c.LogLevelKube, c.LogLevelTunnel, c.LogLevelDNS)
+}
+
+// NewLogHandler returns a handler writing to w in LOG_FORMAT, accepting
+// records at MinLogLevel and above.
+func (c *Config) NewLogHandler(w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: c.MinLogLevel()}
+	if c.LogFormat == LogFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func parseLogLevel(name string, def slog.Level) (slog.Level, error) {
+	raw := os.Getenv(name)
+	switch raw {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	case "":
+		return def, nil
+	default:
+		return 0, fmt.Errorf("invalid %s=%q", name, raw)
+	}
 }
 
 func parseSyncInterval() (time.Duration, error) {
-	raw := os.Getenv("SYNC_INTERVAL")
+	return parseDuration("SYNC_INTERVAL", defaultSyncInterval)
+}
+
+// parseDuration parses a positive duration from the given env var, either as
+// a Go duration string such as "2m30s" or as a bare number of seconds.
+func parseDuration(name string, def time.Duration) (time.Duration, error) {
+	raw := os.Getenv(name)
 	if raw == "" {
-		return defaultSyncInterval, nil
+		return def, nil
+	}
+	if d, err := time.ParseDuration(raw); err == nil {
+		if d <= 0 {
+			return 0, fmt.Errorf("invalid %s=%q", name, raw)
+		}
+		return d, nil
 	}
 	sec, err := strconv.Atoi(raw)
 	if err != nil || sec <= 0 {
-		return 0, fmt.Errorf("invalid SYNC_INTERVAL=%q", raw)
+		return 0, fmt.Errorf("invalid %s=%q", name, raw)
 	}
 	return time.Duration(sec) * time.Second, nil
 }
+
+// parseDNSTTL parses a DNS record TTL in seconds: 1 for "auto", or 30 to
+// 86400 as accepted by Cloudflare (values below 60 require Enterprise).
+func parseDNSTTL(name string) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return 1, nil
+	}
+	ttl, err := strconv.Atoi(raw)
+	if err != nil || ttl != 1 && (ttl < 30 || ttl > 86400) {
+		return 0, fmt.Errorf("invalid %s=%q", name, raw)
+	}
+	return ttl, nil
+}
+
+// parseCatchAllService parses the service of the terminal tunnel ingress
+// rule: an http_status:<code> directive or an absolute URL.
+func parseCatchAllService(name string) (string, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return defaultCatchAllService, nil
+	}
+	if code, ok := strings.CutPrefix(raw, "http_status:"); ok {
+		if status, err := strconv.Atoi(code); err != nil || status < 100 || status > 599 {
+			return "", fmt.Errorf("invalid %s=%q", name, raw)
+		}
+		return raw, nil
+	}
+	if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid %s=%q: must be http_status:<code> or an absolute URL", name, raw)
+	}
+	return raw, nil
+}
+
+// parseFileOrEnv returns the value of the given env var or, if <name>_FILE
+// is set instead, the trimmed contents of that file, so that secrets can be
+// mounted as files rather than exposed in the environment.
+func parseFileOrEnv(name string) (string, error) {
+	value := os.Getenv(name)
+	file := os.Getenv(name + "_FILE")
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("%s and %s_FILE must not both be set", name, name)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func parsePositiveInt(name string, def int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	val, err := strconv.Atoi(raw)
+	if err != nil || val <= 0 {
+		return 0, fmt.Errorf("invalid %s=%q", name, raw)
+	}
+	return val, nil
+}
+
+func parseNonNegativeInt(name string, def int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	val, err := strconv.Atoi(raw)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid %s=%q", name, raw)
+	}
+	return val, nil
+}
+
+func parseBool(name string, def bool) (bool, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	val, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s=%q", name, raw)
+	}
+	return val, nil
+}
+
+// parseList parses a comma- and/or space-separated list, lowercasing entries.
+func parseList(name string) []string {
+	raw := strings.ReplaceAll(os.Getenv(name), ",", " ")
+	var list []string
+	for _, item := range strings.Fields(raw) {
+		list = append(list, strings.ToLower(strings.TrimSuffix(item, ".")))
+	}
+	return list
+}
+
+// parseListAlias parses the list in name, or in its alias if name is unset,
+// failing if both are set.
+func parseListAlias(name, alias string) ([]string, error) {
+	list, aliasList := parseList(name), parseList(alias)
+	if len(list) > 0 && len(aliasList) > 0 {
+		return nil, fmt.Errorf("%s and %s are aliases; set only one of them", name, alias)
+	}
+	if len(list) == 0 {
+		return aliasList, nil
+	}
+	return list, nil
+}
+
+// parsePatterns parses a list of hostname glob patterns (see path.Match),
+// rejecting malformed ones.
+func parsePatterns(name string) ([]string, error) {
+	patterns := parseList(name)
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", name, pattern, err)
+		}
+		// Hostnames are matched in lower case.
+		patterns[i] = strings.ToLower(pattern)
+	}
+	return patterns, nil
+}
+
+// parseProxiedMap parses a JSON object mapping names (zone names or service
+// types) to a default proxied flag. Zone names are normalized.
+func parseProxiedMap(name string, zones bool) (map[string]bool, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil, nil
+	}
+	var parsed map[string]bool
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil, fmt.Errorf("invalid %s=%q: %w", name, raw, err)
+	}
+	if !zones {
+		return parsed, nil
+	}
+	defaults := make(map[string]bool, len(parsed))
+	for zone, proxied := range parsed {
+		defaults[strings.ToLower(strings.TrimSuffix(zone, "."))] = proxied
+	}
+	return defaults, nil
+}
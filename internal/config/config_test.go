@@ -0,0 +1,274 @@
+package config
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// loadTestConfig runs LoadConfig with the Cloudflare credentials set, env
+// applied on top and args as the command line arguments.
+func loadTestConfig(t *testing.T, env map[string]string, args ...string) (*Config, error) {
+	t.Helper()
+
+	t.Setenv("CLOUDFLARE_ACCOUNT_ID", "0123456789abcdef0123456789abcdef")
+	t.Setenv("CLOUDFLARE_TUNNEL_ID", "00000000-0000-4000-8000-000000000001")
+	t.Setenv("CLOUDFLARE_API_TOKEN", "test-token")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	osArgs := os.Args
+	os.Args = append([]string{"tunnel-manager"}, args...)
+	defer func() { os.Args = osArgs }()
+
+	return LoadConfig()
+}
+
+func TestLoadConfigDumpTunnelConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		wantPath    string
+		wantRunOnce bool
+	}{
+		{name: "disabled", wantPath: "", wantRunOnce: false},
+		{name: "flag", args: []string{"--dump-tunnel-config", "/tmp/tunnel.json"}, wantPath: "/tmp/tunnel.json", wantRunOnce: true},
+		{name: "environment", env: map[string]string{"DUMP_TUNNEL_CONFIG": "/tmp/tunnel.json"}, wantPath: "/tmp/tunnel.json", wantRunOnce: true},
+		{name: "forces a single run", args: []string{"--once=false", "--dump-tunnel-config=/tmp/tunnel.json"}, wantPath: "/tmp/tunnel.json", wantRunOnce: true},
+		{name: "once without dump", args: []string{"--once"}, wantPath: "", wantRunOnce: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tt.env, tt.args...)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if cfg.DumpTunnelConfigPath != tt.wantPath {
+				t.Errorf("DumpTunnelConfigPath = %q, want %q", cfg.DumpTunnelConfigPath, tt.wantPath)
+			}
+			if cfg.RunOnce != tt.wantRunOnce {
+				t.Errorf("RunOnce = %v, want %v", cfg.RunOnce, tt.wantRunOnce)
+			}
+		})
+	}
+}
+
+func TestLoadConfigHostnameExcludePatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantDNS []string
+		wantErr bool
+	}{
+		{name: "unset", wantDNS: nil},
+		{name: "lists", env: map[string]string{"DNS_HOSTNAME_EXCLUDE": "*.internal.example.com, admin.example.com"}, wantDNS: []string{"*.internal.example.com", "admin.example.com"}},
+		{name: "lower-cased", env: map[string]string{"DNS_HOSTNAME_EXCLUDE": "*.Internal.Example.com"}, wantDNS: []string{"*.internal.example.com"}},
+		{name: "malformed DNS pattern", env: map[string]string{"DNS_HOSTNAME_EXCLUDE": "[a-"}, wantErr: true},
+		{name: "malformed tunnel pattern", env: map[string]string{"TUNNEL_HOSTNAME_EXCLUDE": "*.example.com,[z"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !slices.Equal(cfg.DNSHostnameExclude, tt.wantDNS) {
+				t.Errorf("DNSHostnameExclude = %q, want %q", cfg.DNSHostnameExclude, tt.wantDNS)
+			}
+		})
+	}
+}
+
+func TestLoadConfigHostnameRetries(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "3", want: 3},
+		{value: "-1", wantErr: true},
+		{value: "three", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, map[string]string{"HOSTNAME_RETRIES": tt.value})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.HostnameRetries != tt.want {
+				t.Errorf("HostnameRetries = %d, want %d", cfg.HostnameRetries, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: defaultSyncInterval},
+		{value: "30s", want: 30 * time.Second},
+		{value: "1m", want: time.Minute},
+		{value: "2m", want: 2 * time.Minute},
+		{value: "2m30s", want: 150 * time.Second},
+		{value: "90", want: 90 * time.Second},
+		{value: "90s", want: 90 * time.Second},
+		{value: "0", wantErr: true},
+		{value: "0s", wantErr: true},
+		{value: "-5s", wantErr: true},
+		{value: "-5", wantErr: true},
+		{value: "garbage", wantErr: true},
+		{value: "1.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("SYNC_INTERVAL", tt.value)
+			got, err := parseSyncInterval()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSyncInterval error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseSyncInterval = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSyncInterval(t *testing.T) {
+	cfg, err := loadTestConfig(t, map[string]string{"SYNC_INTERVAL": "2m30s"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.SyncInterval != 150*time.Second {
+		t.Errorf("SyncInterval = %v, want 2m30s", cfg.SyncInterval)
+	}
+
+	if _, err := loadTestConfig(t, map[string]string{"SYNC_INTERVAL": "garbage"}); err == nil {
+		t.Error("LoadConfig accepted SYNC_INTERVAL=garbage")
+	}
+}
+
+func TestLoadConfigOtherTypeConflictPolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: OtherTypeConflictPolicySkip},
+		{value: "skip", want: OtherTypeConflictPolicySkip},
+		{value: "ignore", want: OtherTypeConflictPolicyIgnore},
+		{value: "delete", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, map[string]string{"OTHER_TYPE_CONFLICT_POLICY": tt.value})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.OtherTypeConflictPolicy != tt.want {
+				t.Errorf("OtherTypeConflictPolicy = %q, want %q", cfg.OtherTypeConflictPolicy, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigNamespaceFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		wantAllow []string
+		wantDeny  []string
+		wantErr   bool
+	}{
+		{name: "unset"},
+		{name: "allowlist", env: map[string]string{"NAMESPACES": "apps, web"}, wantAllow: []string{"apps", "web"}},
+		{name: "allowlist alias", env: map[string]string{"NAMESPACE_ALLOWLIST": "apps"}, wantAllow: []string{"apps"}},
+		{name: "denylist", env: map[string]string{"EXCLUDE_NAMESPACES": "kube-system"}, wantDeny: []string{"kube-system"}},
+		{name: "denylist alias", env: map[string]string{"NAMESPACE_DENYLIST": "kube-system"}, wantDeny: []string{"kube-system"}},
+		{
+			name:      "disjoint allow and deny",
+			env:       map[string]string{"NAMESPACES": "apps", "EXCLUDE_NAMESPACES": "kube-system"},
+			wantAllow: []string{"apps"},
+			wantDeny:  []string{"kube-system"},
+		},
+		{name: "allowlist under both names", env: map[string]string{"NAMESPACES": "apps", "NAMESPACE_ALLOWLIST": "web"}, wantErr: true},
+		{name: "denylist under both names", env: map[string]string{"EXCLUDE_NAMESPACES": "a", "NAMESPACE_DENYLIST": "b"}, wantErr: true},
+		{name: "allowed and denied", env: map[string]string{"NAMESPACES": "apps,web", "EXCLUDE_NAMESPACES": "web"}, wantErr: true},
+		{name: "allowed and denied via aliases", env: map[string]string{"NAMESPACE_ALLOWLIST": "apps", "NAMESPACE_DENYLIST": "apps"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !slices.Equal(cfg.Namespaces, tt.wantAllow) {
+				t.Errorf("Namespaces = %q, want %q", cfg.Namespaces, tt.wantAllow)
+			}
+			if !slices.Equal(cfg.ExcludeNamespaces, tt.wantDeny) {
+				t.Errorf("ExcludeNamespaces = %q, want %q", cfg.ExcludeNamespaces, tt.wantDeny)
+			}
+		})
+	}
+}
+
+func TestLoadConfigTXTOwnershipRequiresDeletableTXT(t *testing.T) {
+	tests := []struct {
+		name      string
+		ownership string
+		deletable string
+		wantErr   bool
+	}{
+		{name: "ownership off", ownership: "false", deletable: ""},
+		{name: "ownership with default deletable types", ownership: "true", deletable: "", wantErr: true},
+		{name: "ownership with CNAME only", ownership: "true", deletable: "CNAME", wantErr: true},
+		{name: "ownership with TXT deletable", ownership: "true", deletable: "cname,txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, map[string]string{
+				"TXT_OWNERSHIP":          tt.ownership,
+				"DELETABLE_RECORD_TYPES": tt.deletable,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadConfig error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMetricsAddr(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: ""},
+		{value: ":9090"},
+		{value: "127.0.0.1:9090"},
+		{value: "9090", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, map[string]string{"METRICS_ADDR": tt.value})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.MetricsAddr != tt.value {
+				t.Errorf("MetricsAddr = %q, want %q", cfg.MetricsAddr, tt.value)
+			}
+		})
+	}
+}
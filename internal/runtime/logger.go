@@ -0,0 +1,79 @@
+package runtime
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+const (
+	ModuleKube   = "kube"
+	ModuleTunnel = "tunnel"
+	ModuleDNS    = "dns"
+)
+
+// LoggerFor returns the logger of given module, falling back to the global
+// logger if the module has none.
+func (r *Runtime) LoggerFor(module string) *slog.Logger {
+	if logger, ok := r.ModuleLoggers[module]; ok {
+		return logger
+	}
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return slog.Default()
+}
+
+// BeginCycle tags the global and module loggers with a new random cycle_id
+// for the duration of a sync cycle, so that all log lines of one cycle can be
+// correlated. The returned function restores the previous loggers.
+func (r *Runtime) BeginCycle() (restore func()) {
+	var id [4]byte
+	rand.Read(id[:])
+	attr := slog.String("cycle_id", hex.EncodeToString(id[:]))
+
+	logger, moduleLoggers := r.Logger, r.ModuleLoggers
+	r.Logger = logger.With(attr)
+	r.ModuleLoggers = make(map[string]*slog.Logger, len(moduleLoggers))
+	for module, l := range moduleLoggers {
+		r.ModuleLoggers[module] = l.With(attr)
+	}
+
+	return func() {
+		r.Logger, r.ModuleLoggers = logger, moduleLoggers
+	}
+}
+
+// NewLeveledLogger returns a logger writing to handler that drops records
+// below level, tagged with module if non-empty. handler itself must accept
+// at least level for this to have any effect.
+func NewLeveledLogger(handler slog.Handler, level slog.Level, module string) *slog.Logger {
+	logger := slog.New(&levelHandler{level: level, handler: handler})
+	if module != "" {
+		logger = logger.With(slog.String("module", module))
+	}
+	return logger
+}
+
+// levelHandler wraps a handler, dropping records below level.
+type levelHandler struct {
+	level   slog.Level
+	handler slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
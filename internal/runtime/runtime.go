@@ -3,6 +3,7 @@ package runtime
 import (
 	"context"
 	"log/slog"
+	"time"
 	"tunnel/internal/client"
 	"tunnel/internal/config"
 )
@@ -12,4 +13,90 @@ type Runtime struct {
 	Config *config.Config
 	Client *client.Client
 	Logger *slog.Logger
+
+	// ModuleLoggers holds per-module loggers honoring LOG_LEVEL_<MODULE>.
+	// See LoggerFor.
+	ModuleLoggers map[string]*slog.Logger
+
+	// ZoneHashes holds, per zone ID, the hash of the desired DNS state that
+	// was last reconciled successfully. Used by SKIP_UNCHANGED_ZONES.
+	ZoneHashes map[string]ZoneHash
+
+	// LastTunnelCheck is when the tunnel was last verified to exist. Used
+	// by TUNNEL_CHECK_INTERVAL.
+	LastTunnelCheck time.Time
+
+	// RecentRecordOps holds the last create or delete performed per DNS
+	// record, keyed by zone ID and hostname. Used by DESTRUCTIVE_COOLDOWN.
+	RecentRecordOps map[string]RecordOp
+
+	// PreviousServices holds the hostname -> service URL mapping discovered
+	// by the previous sync, to detect hostnames moving between services.
+	PreviousServices map[string]string
+
+	// TunnelSyncDisabled and DNSSyncDisabled disable the respective sync
+	// phase, set when the API token lacks the permissions for it. See
+	// PERMISSION_PROBE.
+	TunnelSyncDisabled bool
+	DNSSyncDisabled    bool
+
+	// StreamZonesDisabled makes SyncDNS load all zones before reconciling
+	// any of them, set when the account has subdomain zones or duplicate
+	// zone names, which STREAM_ZONES cannot match hostnames against safely.
+	StreamZonesDisabled bool
+
+	// RecentWrites holds the DNS records created, updated or deleted within
+	// WRITE_CACHE_TTL, keyed by record ID, to make up for the eventual
+	// consistency of Cloudflare listings.
+	RecentWrites map[string]WrittenRecord
+
+	// SoftDeletes holds the managed records, keyed by zone ID and record ID,
+	// found absent from the desired state on the previous sync. Used by
+	// SOFT_DELETE_CONFIRM.
+	SoftDeletes map[string]bool
+
+	// Changes counts the changes applied to Cloudflare during the current
+	// sync cycle. Reset at the start of each cycle.
+	Changes int
+
+	// LastTunnelConfig holds the tunnel configuration last applied, to tell
+	// whether a sync changed it.
+	LastTunnelConfig string
+
+	// ServiceStatuses holds, per "namespace/name", the status annotation
+	// last written to each Service. Used by WRITE_SERVICE_STATUS.
+	ServiceStatuses map[string]string
+
+	// Skipped holds the services and hostnames skipped during the current
+	// sync cycle. Reset at the start of each cycle.
+	Skipped []SkippedItem
+
+	// Failed holds, per hostname, the error its sync failed with during the
+	// current sync cycle. Reset at the start of each cycle.
+	Failed map[string]string
+}
+
+// WrittenRecord is a DNS record recently written by us.
+type WrittenRecord struct {
+	ZoneID string
+	// Record is the record as returned by Cloudflare, in the representation
+	// of the sync package.
+	Record  any
+	Deleted bool
+	At      time.Time
+}
+
+// ZoneHash is the hash of the desired DNS state of a zone, and when the
+// zone was last fully reconciled against it. Skipped holds the hostnames
+// skipped by that reconciliation, reported again while the zone is skipped.
+type ZoneHash struct {
+	Hash    string
+	At      time.Time
+	Skipped []SkippedItem
+}
+
+// RecordOp is a create or delete performed on a DNS record.
+type RecordOp struct {
+	Op string
+	At time.Time
 }
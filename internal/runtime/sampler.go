@@ -0,0 +1,61 @@
+package runtime
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// NewSamplingHandler wraps handler so that only every rate-th debug record
+// with the same message is emitted, starting with the first one. Records
+// above debug level are always emitted. A rate below 2 disables sampling.
+func NewSamplingHandler(handler slog.Handler, rate int) slog.Handler {
+	if rate < 2 {
+		return handler
+	}
+	return &samplingHandler{
+		handler: handler,
+		state:   &samplingState{rate: rate, counts: make(map[string]int)},
+	}
+}
+
+// samplingState is shared by a samplingHandler and the handlers derived from
+// it, so that loggers with different attributes sample together.
+type samplingState struct {
+	rate   int
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// sample reports whether a debug record with msg should be emitted.
+func (s *samplingState) sample(msg string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.counts[msg]
+	s.counts[msg] = (n + 1) % s.rate
+	return n == 0
+}
+
+type samplingHandler struct {
+	handler slog.Handler
+	state   *samplingState
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level <= slog.LevelDebug && !h.state.sample(r.Message) {
+		return nil
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{handler: h.handler.WithAttrs(attrs), state: h.state}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{handler: h.handler.WithGroup(name), state: h.state}
+}
@@ -0,0 +1,51 @@
+package runtime
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSamplingHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		rate       int
+		wantDebug  int // of 100 repeated debug lines
+		wantWarn   int // of 10 warnings
+		wantUnique int // of 5 distinct debug lines
+	}{
+		{name: "disabled", rate: 1, wantDebug: 100, wantWarn: 10, wantUnique: 5},
+		{name: "1 in 10", rate: 10, wantDebug: 10, wantWarn: 10, wantUnique: 5},
+		{name: "1 in 3", rate: 3, wantDebug: 34, wantWarn: 10, wantUnique: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+			logger := slog.New(NewSamplingHandler(handler, tt.rate))
+
+			for i := range 100 {
+				// Loggers derived with attributes sample together.
+				logger.With("page", i).Debug("requesting DNS records page")
+			}
+			for range 10 {
+				logger.Warn("failed to read endpoints")
+			}
+			for _, service := range []string{"a", "b", "c", "d", "e"} {
+				logger.Debug("traversing service " + service)
+			}
+
+			out := buf.String()
+			if got := strings.Count(out, "requesting DNS records page"); got != tt.wantDebug {
+				t.Errorf("emitted %d repeated debug lines, want %d", got, tt.wantDebug)
+			}
+			if got := strings.Count(out, "failed to read endpoints"); got != tt.wantWarn {
+				t.Errorf("emitted %d warnings, want %d", got, tt.wantWarn)
+			}
+			if got := strings.Count(out, "traversing service"); got != tt.wantUnique {
+				t.Errorf("emitted %d distinct debug lines, want %d", got, tt.wantUnique)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package runtime
+
+// SkippedItem is a service or hostname that was not published during a sync
+// cycle, with the reason why.
+type SkippedItem struct {
+	Phase     string
+	Namespace string
+	Service   string
+	Hostname  string
+	Reason    string
+}
+
+// Skip records item in Skipped.
+func (rt *Runtime) Skip(item SkippedItem) {
+	rt.Skipped = append(rt.Skipped, item)
+}
+
+// Fail records in Failed that the sync of hostname failed with err. Only the
+// first failure of a hostname is kept, as it is the most specific one.
+func (rt *Runtime) Fail(hostname string, err error) {
+	if _, ok := rt.Failed[hostname]; ok {
+		return
+	}
+	if rt.Failed == nil {
+		rt.Failed = make(map[string]string)
+	}
+	rt.Failed[hostname] = err.Error()
+}
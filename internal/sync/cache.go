@@ -0,0 +1,82 @@
+package sync
+
+import (
+	"time"
+	"tunnel/internal/runtime"
+)
+
+// cacheRecordWrite remembers a record we just created or updated for
+// WRITE_CACHE_TTL, see applyRecentWrites.
+func cacheRecordWrite(rt *runtime.Runtime, zoneID string, rec dnsRecord) {
+	if rt.Config.WriteCacheTTL <= 0 || rec.ID == "" {
+		return
+	}
+	if rt.RecentWrites == nil {
+		rt.RecentWrites = make(map[string]runtime.WrittenRecord)
+	}
+	rt.RecentWrites[rec.ID] = runtime.WrittenRecord{
+		ZoneID: zoneID,
+		Record: rec,
+		At:     time.Now(),
+	}
+}
+
+// cacheRecordDelete remembers a record we just deleted for WRITE_CACHE_TTL,
+// see applyRecentWrites.
+func cacheRecordDelete(rt *runtime.Runtime, zoneID string, rec dnsRecord) {
+	if rt.Config.WriteCacheTTL <= 0 || rec.ID == "" {
+		return
+	}
+	if rt.RecentWrites == nil {
+		rt.RecentWrites = make(map[string]runtime.WrittenRecord)
+	}
+	rt.RecentWrites[rec.ID] = runtime.WrittenRecord{
+		ZoneID:  zoneID,
+		Record:  rec,
+		Deleted: true,
+		At:      time.Now(),
+	}
+}
+
+// applyRecentWrites overlays the records we wrote in zoneID within the last
+// WRITE_CACHE_TTL onto the listed records. Cloudflare listings are
+// eventually consistent, so a record created moments ago may be missing
+// (and would be created again), and a deleted one may still be listed.
+func applyRecentWrites(rt *runtime.Runtime, zoneID string, records []dnsRecord) []dnsRecord {
+	if len(rt.RecentWrites) == 0 {
+		return records
+	}
+
+	pending := make(map[string]runtime.WrittenRecord)
+	for id, w := range rt.RecentWrites {
+		if time.Since(w.At) > rt.Config.WriteCacheTTL {
+			delete(rt.RecentWrites, id)
+			continue
+		}
+		if w.ZoneID == zoneID {
+			pending[id] = w
+		}
+	}
+	if len(pending) == 0 {
+		return records
+	}
+
+	merged := make([]dnsRecord, 0, len(records)+len(pending))
+	for _, rec := range records {
+		w, ok := pending[rec.ID]
+		if !ok {
+			merged = append(merged, rec)
+			continue
+		}
+		delete(pending, rec.ID)
+		if !w.Deleted {
+			merged = append(merged, w.Record.(dnsRecord))
+		}
+	}
+	for _, w := range pending {
+		if !w.Deleted {
+			merged = append(merged, w.Record.(dnsRecord))
+		}
+	}
+	return merged
+}
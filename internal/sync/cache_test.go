@@ -0,0 +1,61 @@
+package sync
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSyncDNSWriteCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        string
+		existing   []dnsRecord
+		hostname   string // desired hostname
+		method     string
+		path       string
+		wantWrites int // across two cycles
+	}{
+		{name: "create, disabled", hostname: "app.example.com", method: http.MethodPost, path: "/dns_records", wantWrites: 2},
+		{name: "create, enabled", ttl: "1m", hostname: "app.example.com", method: http.MethodPost, path: "/dns_records", wantWrites: 1},
+		{name: "create, expired", ttl: "1ns", hostname: "app.example.com", method: http.MethodPost, path: "/dns_records", wantWrites: 2},
+		{
+			name:       "delete, disabled",
+			existing:   []dnsRecord{managedCNAME("rec-app", "app.example.com"), managedCNAME("rec-old", "old.example.com")},
+			hostname:   "app.example.com",
+			method:     http.MethodDelete,
+			path:       "/dns_records/rec-old",
+			wantWrites: 2,
+		},
+		{
+			name:       "delete, enabled",
+			ttl:        "1m",
+			existing:   []dnsRecord{managedCNAME("rec-app", "app.example.com"), managedCNAME("rec-old", "old.example.com")},
+			hostname:   "app.example.com",
+			method:     http.MethodDelete,
+			path:       "/dns_records/rec-old",
+			wantWrites: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"WRITE_CACHE_TTL": tt.ttl})
+			cf.addRecords(testZoneID, tt.existing...)
+			// Listings lag behind: a record created in the first cycle is
+			// not listed in the next one, and a deleted one still is.
+			cf.freezeListings()
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, tt.hostname)
+			for range 2 {
+				// Deleting an already deleted record fails; only the
+				// number of attempts matters then.
+				if err := SyncDNS(rt, state); err != nil && tt.method != http.MethodDelete {
+					t.Fatalf("SyncDNS: %v", err)
+				}
+			}
+
+			if got := len(cf.requestsMatching(tt.method, tt.path)); got != tt.wantWrites {
+				t.Errorf("sent %d %s %s requests, want %d", got, tt.method, tt.path, tt.wantWrites)
+			}
+		})
+	}
+}
@@ -1,17 +1,100 @@
 package sync
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log/slog"
+	"maps"
 	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	gosync "sync"
+	"time"
+	"tunnel/internal/config"
 	"tunnel/internal/runtime"
 
 	"github.com/cloudflare/cloudflare-go/v6"
 	"github.com/cloudflare/cloudflare-go/v6/option"
+	"golang.org/x/net/idna"
 )
 
-const managedCommentMarker = "managed by tunnel-manager"
+// ownerTagPrefix introduces the OWNER_ID in a managed comment, e.g.
+// "managed by tunnel-manager (owner=prod)" with the default
+// MANAGED_COMMENT_MARKER.
+const ownerTagPrefix = " (owner="
+
+// managedComment returns the comment marking records managed by this
+// instance, including OWNER_ID if set.
+func managedComment(rt *runtime.Runtime) string {
+	if rt.Config.OwnerID == "" {
+		return rt.Config.ManagedCommentMarker
+	}
+	return rt.Config.ManagedCommentMarker + ownerTagPrefix + rt.Config.OwnerID + ")"
+}
+
+// sourceTagPrefix introduces the source service in a managed comment, see
+// COMMENT_INCLUDE_SOURCE.
+const sourceTagPrefix = " svc="
+
+// maxCommentLength is the maximum record comment length accepted by
+// Cloudflare on all plans.
+const maxCommentLength = 100
+
+// recordComment returns the comment of a managed record for host: the
+// managed marker, followed by the source service if COMMENT_INCLUDE_SOURCE
+// is enabled. The source is informational only and truncated to fit the
+// comment length limit; isManagedComment ignores it.
+func recordComment(rt *runtime.Runtime, host HostConfig) string {
+	marker := managedComment(rt)
+	if !rt.Config.CommentIncludeSource || host.Source == "" {
+		return marker
+	}
+	comment := marker + sourceTagPrefix + host.Source
+	if limit := max(maxCommentLength, len(marker)); len(comment) > limit {
+		comment = comment[:limit]
+	}
+	return comment
+}
+
+// stripManagedComment removes our managed marker, and the source service
+// following it, from comment.
+func stripManagedComment(rt *runtime.Runtime, comment string) string {
+	marker := managedComment(rt)
+	i := strings.Index(comment, marker)
+	if i < 0 {
+		return comment
+	}
+	rest := comment[i+len(marker):]
+	if tag, ok := strings.CutPrefix(rest, sourceTagPrefix); ok {
+		_, rest, _ = strings.Cut(tag, " ")
+	}
+	return strings.TrimSpace(comment[:i] + rest)
+}
+
+// isManagedComment reports whether comment marks a record managed by this
+// instance: it must contain the marker, tagged with our OWNER_ID if any.
+// Records of other owners are treated as unmanaged.
+func isManagedComment(rt *runtime.Runtime, comment string) bool {
+	i := strings.Index(comment, rt.Config.ManagedCommentMarker)
+	if i < 0 {
+		return false
+	}
+	rest := comment[i+len(rt.Config.ManagedCommentMarker):]
+	// The marker of another instance may extend ours, e.g.
+	// "managed by tunnel-manager-staging".
+	if rest != "" && rest[0] != ' ' {
+		return false
+	}
+	owner := ""
+	if tag, ok := strings.CutPrefix(rest, ownerTagPrefix); ok {
+		owner, _, _ = strings.Cut(tag, ")")
+	}
+	return owner == rt.Config.OwnerID
+}
 
 // zoneSummary is a minimal representation of a Cloudflare zone.
 type zoneSummary struct {
@@ -34,6 +117,14 @@ type dnsRecord struct {
 	Name    string `json:"name"`
 	Content string `json:"content"`
 	Comment string `json:"comment"`
+	Proxied bool   `json:"proxied"`
+	TTL     int    `json:"ttl"`
+	// Proxiable is false for records Cloudflare cannot proxy, which always
+	// read back as not proxied. Nil if the API did not report it.
+	Proxiable *bool `json:"proxiable,omitempty"`
+	// ModifiedOn is when the record was last modified. Used by
+	// MAX_RECORD_AGE.
+	ModifiedOn time.Time `json:"modified_on"`
 }
 
 type dnsRecordsListResponse struct {
@@ -51,19 +142,18 @@ type dnsRecordsListResponse struct {
 //   - read all A, AAAA and CNAME records
 //   - manage only CNAMEs that contain "xxx" in the comment
 //   - if there are A/AAAA records for a hostname, it will NOT create a CNAME
-//     (to avoid conflicts)
-//   - delete managed CNAMEs for hostnames no longer present in SyncState
+//     (to avoid conflicts); the same goes for MX/NS records unless
+//     MX_NS_CONFLICT_POLICY is "ignore"
+//   - delete (or orphan, see ON_RELEASE) managed CNAMEs for hostnames no
+//     longer present in SyncState
 //   - create/update managed CNAMEs to point to "<TunnelID>.cfargotunnel.com"
+//   - if REDIRECTS_ENABLED, manage single redirect rules for redirect hostnames
 func SyncDNS(rt *runtime.Runtime, state *SyncState) error {
-	logger := rt.Logger
-	if logger == nil {
-		logger = slog.Default()
-	}
+	logger := rt.LoggerFor(moduleDNS)
 
 	if rt.Client == nil || rt.Client.CloudFlareClient == nil {
 		return fmt.Errorf("cloudflare client is nil")
 	}
-	cf := rt.Client.CloudFlareClient
 
 	if rt.Config == nil {
 		return fmt.Errorf("config is nil")
@@ -72,54 +162,95 @@ func SyncDNS(rt *runtime.Runtime, state *SyncState) error {
 	accountID := rt.Config.CloudFlareAccountID
 	tunnelID := rt.Config.CloudFlareTunnelID
 
-	if state.HostToService == nil || state.Len() == 0 {
+	if state.Hosts == nil || state.Len() == 0 {
 		logger.Info("no hostnames in SyncState; nothing to sync")
 		return nil
 	}
 
 	target := tunnelID + ".cfargotunnel.com"
+	if !isValidHostname(target) {
+		return fmt.Errorf("tunnel target %q is not a valid hostname; check CLOUDFLARE_TUNNEL_ID", target)
+	}
 
 	logger.Info("starting Cloudflare DNS sync",
 		"account_id", accountID,
 		"tunnel_id", tunnelID,
 		"target", target,
-		"hosts_count", len(state.HostToService),
+		"hosts_count", state.Len(),
 	)
 
+	hosts := dnsHosts(rt, state)
+
+	// streamed holds the zones already reconciled by syncDNSStreaming
+	// before it gave up.
+	var streamed []string
+	if rt.Config.StreamZones && !rt.StreamZonesDisabled {
+		skipped := len(rt.Skipped)
+		var err error
+		streamed, err = syncDNSStreaming(rt, accountID, hosts, state, target)
+		if !errors.Is(err, errZoneLayout) {
+			return err
+		}
+		logger.Warn("disabling STREAM_ZONES; loading all zones before reconciling them", "reason", err.Error())
+		// All hostnames are reconciled again, and so are the zones already
+		// streamed, so that a CNAME created in a parent zone before its
+		// subdomain zone was listed is removed.
+		rt.Skipped = rt.Skipped[:skipped]
+	}
+
 	// 1) Load all zones in the account.
 	zones, err := loadZones(rt, accountID)
 	if err != nil {
-		return fmt.Errorf("loading zones: %w", err)
+		err = fmt.Errorf("loading zones: %w", err)
+		failHostnames(rt, hosts, err)
+		return err
 	}
 	if len(zones) == 0 {
 		logger.Warn("no zones found for account, nothing to sync", "account_id", accountID)
 		return nil
 	}
 
+	// Zone names are unique within an account, but if the API ever returns
+	// the same name twice, pick deterministically (lowest zone ID) and warn
+	// instead of depending on the listing order.
 	zoneIDByName := make(map[string]string, len(zones))
 	for _, z := range zones {
-		zoneIDByName[z.Name] = z.ID
+		existing, ok := zoneIDByName[z.Name]
+		if !ok {
+			zoneIDByName[z.Name] = z.ID
+			continue
+		}
+		chosen := min(existing, z.ID)
+		logger.Warn("multiple zones with the same name; using the one with the lowest ID",
+			"zone_name", z.Name,
+			"zone_ids", existing+", "+z.ID,
+			"chosen_zone_id", chosen,
+		)
+		zoneIDByName[z.Name] = chosen
 	}
 
 	// 2) Distribute hostnames across zones using best suffix match.
 	zoneHosts := make(map[string][]string) // zoneName -> []hostname
-	for host := range state.HostToService {
-		hostNorm := normalizeHost(host)
-		if hostNorm == "" {
-			continue
-		}
+	for _, hostNorm := range hosts {
 		zoneName := bestMatchingZone(hostNorm, zones)
 		if zoneName == "" {
 			logger.Warn("no matching zone found for hostname; skipping",
-				"hostname", hostNorm,
+				hostnameAttr(rt, hostNorm, ""),
 				"account_id", accountID,
 			)
+			skipHostname(rt, hostNorm, skipReasonNoZone)
 			continue
 		}
 		zoneHosts[zoneName] = append(zoneHosts[zoneName], hostNorm)
 	}
+	for _, zoneName := range streamed {
+		if _, ok := zoneHosts[zoneName]; !ok {
+			zoneHosts[zoneName] = nil
+		}
+	}
 
 	// 3) For each zone, sync A/AAAA/CNAME records according to state.
+	synced := make(map[string]bool, len(zoneHosts)) // zoneName -> synced
 	for zoneName, hosts := range zoneHosts {
 		zoneID := zoneIDByName[zoneName]
 		if zoneID == "" {
@@ -130,8 +261,17 @@ func SyncDNS(rt *runtime.Runtime, state *SyncState) error {
 			continue
 		}
 
-		if err := syncZoneRecords(rt, cf, zoneID, zoneName, hosts, state, target); err != nil {
-			return fmt.Errorf("sync zone %s (%s): %w", zoneName, zoneID, err)
+		// syncZone records the failures of the hostnames of its own zone.
+		err := syncZone(rt, zoneID, zoneName, hosts, state, target)
+		synced[zoneName] = true
+		if err != nil {
+			// The zones not synced yet are left unreconciled.
+			for zoneName, hosts := range zoneHosts {
+				if !synced[zoneName] {
+					failHostnames(rt, hosts, err)
+				}
+			}
+			return err
 		}
 	}
 
@@ -141,15 +281,272 @@ func SyncDNS(rt *runtime.Runtime, state *SyncState) error {
 	return nil
 }
 
+// errZoneLayout is returned by syncDNSStreaming when a zone is nested in or
+// has the same name as a zone listed before it.
+var errZoneLayout = errors.New("subdomain zone or duplicate zone name")
+
+// syncDNSStreaming is the STREAM_ZONES variant of SyncDNS: each page of
+// zones is reconciled as soon as it is fetched, instead of loading all zones
+// of the account first. It returns the names of the zones reconciled.
+//
+// Hostnames are matched against the zones fetched so far, which is only
+// correct when no zone is nested in or has the same name as another one.
+// CheckZoneLayout verifies that at startup; a page of zones breaking it
+// later aborts the walk with errZoneLayout before any of its zones is
+// synced, and SyncDNS falls back to loading all zones first.
+func syncDNSStreaming(
+	rt *runtime.Runtime,
+	accountID string,
+	hosts []string,
+	state *SyncState,
+	target string,
+) ([]string, error) {
+	logger := rt.LoggerFor(moduleDNS)
+
+	var seenZones []zoneSummary
+	var streamed []string
+	synced := make(map[string]bool) // zoneName -> synced
+	pending := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		pending[host] = true
+	}
+
+	err := forEachZonePage(rt, accountID, func(page []zoneSummary) error {
+		for _, z := range page {
+			if other := conflictingZone(z, seenZones); other != "" {
+				rt.StreamZonesDisabled = true
+				return fmt.Errorf("zone %s conflicts with zone %s: %w", z.Name, other, errZoneLayout)
+			}
+			seenZones = append(seenZones, z)
+		}
+
+		zoneHosts := make(map[string][]string) // zoneName -> []hostname
+		for host := range pending {
+			if zoneName := bestMatchingZone(host, seenZones); zoneName != "" {
+				zoneHosts[zoneName] = append(zoneHosts[zoneName], host)
+			}
+		}
+
+		for _, z := range page {
+			synced[z.Name] = true
+
+			matched := zoneHosts[z.Name]
+			if len(matched) == 0 {
+				continue
+			}
+			sort.Strings(matched)
+			// syncZone records the failures of the hostnames of its own
+			// zone.
+			for _, host := range matched {
+				delete(pending, host)
+			}
+			streamed = append(streamed, normalizeHost(z.Name))
+			if err := syncZone(rt, z.ID, z.Name, matched, state, target); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errZoneLayout) {
+		// SyncDNS reconciles the hostnames left pending.
+		return streamed, err
+	}
+	if err != nil {
+		// Hostnames of zones not synced yet are left unreconciled.
+		failHostnames(rt, slices.Collect(maps.Keys(pending)), err)
+		return streamed, err
+	}
+
+	for host := range pending {
+		logger.Warn("no matching zone found for hostname; skipping",
+			hostnameAttr(rt, host, ""),
+			"account_id", accountID,
+		)
+		skipHostname(rt, host, skipReasonNoZone)
+	}
+
+	logger.Info("Cloudflare DNS sync finished successfully",
+		"zones", len(synced),
+	)
+	return streamed, nil
+}
+
+// dnsHosts returns the normalized hostnames of state whose DNS we manage.
+func dnsHosts(rt *runtime.Runtime, state *SyncState) []string {
+	logger := rt.LoggerFor(moduleDNS)
+
+	var hosts []string
+	for host, cfg := range state.Hosts {
+		hostNorm := normalizeHost(host)
+		if hostNorm == "" {
+			continue
+		}
+		// Ingress-only hostnames have their DNS managed elsewhere.
+		if cfg.IngressOnly {
+			continue
+		}
+		if matchesAnyPattern(rt.Config.DNSHostnameExclude, hostNorm) {
+			logger.Debug("hostname excluded from DNS by pattern",
+				hostnameAttr(rt, hostNorm, ""),
+			)
+			skipHostname(rt, hostNorm, skipReasonExcluded)
+			continue
+		}
+		hosts = append(hosts, hostNorm)
+	}
+	return hosts
+}
+
+// syncZone syncs the records, and redirects if enabled, of a single zone,
+// unless SKIP_UNCHANGED_ZONES applies, see canSkipZone.
+func syncZone(
+	rt *runtime.Runtime,
+	zoneID, zoneName string,
+	hosts []string,
+	state *SyncState,
+	target string,
+) error {
+	logger := rt.LoggerFor(moduleDNS)
+	cf := rt.Client.CloudFlareClient
+
+	if apex := normalizeHost(zoneName); slices.Contains(hosts, apex) {
+		logger.Debug("hostname is the zone apex; managing it as the apex record",
+			"zone_id", zoneID,
+			"zone_name", zoneName,
+			hostnameAttr(rt, apex, zoneName),
+			"apex_policy", rt.Config.ApexPolicy,
+		)
+	}
+
+	hash := zoneStateHash(zoneName, hosts, state, target)
+	if canSkipZone(rt, zoneID, hash) {
+		logger.Debug("desired state of zone unchanged since last sync; skipping zone",
+			"zone_id", zoneID,
+			"zone_name", zoneName,
+		)
+		// The hostnames skipped last time would still be skipped.
+		for _, item := range rt.ZoneHashes[zoneID].Skipped {
+			rt.Skip(item)
+		}
+		return nil
+	}
+
+	skipped := len(rt.Skipped)
+	converged, err := syncZoneRecords(rt, cf, zoneID, zoneName, hosts, state, target)
+	if err != nil {
+		// Hostnames that failed individually are already recorded, and the
+		// others of the zone were synced.
+		var hostErr hostnamesError
+		if !errors.As(err, &hostErr) {
+			failHostnames(rt, hosts, err)
+		}
+		return fmt.Errorf("sync zone %s (%s): %w", zoneName, zoneID, err)
+	}
+
+	if rt.Config.RedirectsEnabled {
+		if err := syncZoneRedirects(rt, cf, zoneID, zoneName, hosts, state); err != nil {
+			failHostnames(rt, hosts, err)
+			return fmt.Errorf("sync zone redirects %s (%s): %w", zoneName, zoneID, err)
+		}
+	}
+
+	if rt.ZoneHashes == nil {
+		rt.ZoneHashes = make(map[string]runtime.ZoneHash)
+	}
+	if converged {
+		rt.ZoneHashes[zoneID] = runtime.ZoneHash{
+			Hash:    hash,
+			At:      time.Now(),
+			Skipped: slices.Clone(rt.Skipped[skipped:]),
+		}
+	} else {
+		delete(rt.ZoneHashes, zoneID)
+	}
+	return nil
+}
+
+// canSkipZone reports whether SKIP_UNCHANGED_ZONES allows skipping zoneID,
+// whose desired state hashes to hash. The desired state says nothing about
+// drift on Cloudflare's side, records reaching MAX_RECORD_AGE or pending
+// soft deletes, so a zone is only skipped if none of its records await a
+// soft-delete confirmation, and is fully reconciled at least every
+// ZONE_FULL_SYNC_INTERVAL regardless.
+func canSkipZone(rt *runtime.Runtime, zoneID, hash string) bool {
+	if !rt.Config.SkipUnchangedZones {
+		return false
+	}
+	last, ok := rt.ZoneHashes[zoneID]
+	if !ok || last.Hash != hash || time.Since(last.At) >= rt.Config.ZoneFullSyncInterval {
+		return false
+	}
+	for key := range rt.SoftDeletes {
+		if strings.HasPrefix(key, zoneID+"/") {
+			return false
+		}
+	}
+	return true
+}
+
 // loadZones loads all zones for a given account ID using the generic client.Get.
 func loadZones(rt *runtime.Runtime, accountID string) ([]zoneSummary, error) {
-	logger := rt.Logger
-	if logger == nil {
-		logger = slog.Default()
+	var zones []zoneSummary
+	err := forEachZonePage(rt, accountID, func(page []zoneSummary) error {
+		zones = append(zones, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+// CheckZoneLayout checks at startup whether STREAM_ZONES can be used for the
+// zones of the account. Subdomain zones and duplicate zone names require all
+// zones to be known before a hostname is matched to a zone, so STREAM_ZONES
+// is disabled with a warning when the account has any.
+func CheckZoneLayout(rt *runtime.Runtime) error {
+	if !rt.Config.StreamZones {
+		return nil
+	}
+
+	zones, err := loadZones(rt, rt.Config.CloudFlareAccountID)
+	if err != nil {
+		return fmt.Errorf("loading zones: %w", err)
+	}
+	for i, z := range zones {
+		if other := conflictingZone(z, zones[:i]); other != "" {
+			rt.LoggerFor(moduleDNS).Warn("subdomain zone or duplicate zone name; disabling STREAM_ZONES",
+				"zone_name", z.Name,
+				"conflicting_zone_name", other,
+			)
+			rt.StreamZonesDisabled = true
+			return nil
+		}
+	}
+	return nil
+}
+
+// conflictingZone returns the name of the first zone of zones that z is
+// nested in, is the parent of or has the same name as, or "" if none.
+func conflictingZone(z zoneSummary, zones []zoneSummary) string {
+	name := normalizeHost(z.Name)
+	for _, other := range zones {
+		otherName := normalizeHost(other.Name)
+		if name == otherName ||
+			strings.HasSuffix(name, "."+otherName) ||
+			strings.HasSuffix(otherName, "."+name) {
+			return other.Name
+		}
 	}
+	return ""
+}
+
+// forEachZonePage pages through the active zones of given account ID,
+// calling fn with each page as soon as it is fetched.
+func forEachZonePage(rt *runtime.Runtime, accountID string, fn func([]zoneSummary) error) error {
+	logger := rt.LoggerFor(moduleDNS)
 	client := rt.Client.CloudFlareClient
 
-	var zones []zoneSummary
 	page := 1
 
 	for {
@@ -167,14 +564,16 @@ func loadZones(rt *runtime.Runtime, accountID string) ([]zoneSummary, error) {
 			&resp,
 			option.WithQuery("account.id", accountID),
 			option.WithQuery("page", fmt.Sprintf("%d", page)),
-			option.WithQuery("per_page", "100"),
+			option.WithQuery("per_page", pageSize(rt, minZonesPageSize, maxZonesPageSize)),
 			option.WithQuery("status", "active"),
 		)
 		if err != nil {
-			return nil, fmt.Errorf("GET /zones page %d: %w", page, err)
+			return fmt.Errorf("GET /zones page %d: %w", page, err)
 		}
 
-		zones = append(zones, resp.Result...)
+		if err := fn(resp.Result); err != nil {
+			return err
+		}
 
 		if resp.ResultInfo.Page >= resp.ResultInfo.TotalPages || resp.ResultInfo.TotalPages == 0 {
 			break
@@ -182,10 +581,12 @@ func loadZones(rt *runtime.Runtime, accountID string) ([]zoneSummary, error) {
 		page++
 	}
 
-	return zones, nil
+	return nil
 }
 
-// syncZoneRecords synchronizes A/AAAA/CNAME records for a single zone.
+// syncZoneRecords synchronizes A/AAAA/CNAME records for a single zone. It
+// reports whether the zone was fully converged, i.e. no change was deferred
+// to a later sync.
 func syncZoneRecords(
 	rt *runtime.Runtime,
 	client *cloudflare.Client,
@@ -193,11 +594,8 @@ func syncZoneRecords(
 	hosts []string,
 	state *SyncState,
 	target string,
-) error {
-	logger := rt.Logger
-	if logger == nil {
-		logger = slog.Default()
-	}
+) (bool, error) {
+	logger := rt.LoggerFor(moduleDNS)
 
 	logger.Info("syncing zone DNS",
 		"zone_id", zoneID,
@@ -210,46 +608,146 @@ func syncZoneRecords(
 		hostSet[h] = struct{}{}
 	}
 
-	// Load all records (we'll filter types in code).
-	records, err := loadDNSRecords(rt, client, zoneID)
+	// Load all records (we'll filter types in code), or only the managed ones
+	// plus the desired hostnames when filtered listing is enabled.
+	var records []dnsRecord
+	var err error
+	if rt.Config.DNSFilteredListing {
+		records, err = loadDNSRecordsFiltered(rt, client, zoneID, hosts)
+	} else {
+		records, err = loadDNSRecords(rt, client, zoneID)
+	}
 	if err != nil {
-		return fmt.Errorf("loading DNS records: %w", err)
+		return false, fmt.Errorf("loading DNS records: %w", err)
 	}
+	records = applyRecentWrites(rt, zoneID, records)
 
-	// Index CNAMEs and detect A/AAAA conflicts.
-	cnameByName := make(map[string]dnsRecord)
+	// Index CNAMEs and detect A/AAAA conflicts and hostnames owned by
+	// external-dns.
+	cnamesByName := make(map[string][]dnsRecord)
 	hasAorAAAA := make(map[string]bool)
+	addressRecords := make(map[string][]dnsRecord)
+	hasMXorNS := make(map[string]bool)
+	otherTypes := make(map[string][]string)
+	foreignOwned := make(map[string]bool)
 
 	for _, rec := range records {
 		name := normalizeHost(rec.Name)
 		switch rec.Type {
 		case "A", "AAAA":
 			hasAorAAAA[name] = true
+			addressRecords[name] = append(addressRecords[name], rec)
+		case "MX", "NS":
+			hasMXorNS[name] = true
 		case "CNAME":
 			// only care about CNAMEs for sync logic
-			cnameByName[name] = rec
+			cnamesByName[name] = append(cnamesByName[name], rec)
+		case "TXT":
+			otherTypes[name] = append(otherTypes[name], rec.Type)
+			if rt.Config.TXTOwnership && isForeignOwnershipTXT(rt, rec) {
+				foreignOwned[strings.TrimPrefix(name, ownershipTXTPrefix)] = true
+			}
+		default:
+			otherTypes[name] = append(otherTypes[name], rec.Type)
+		}
+	}
+
+	// A name should never have more than one CNAME, but API races can leave
+	// duplicates behind. Sync only one of them and handle the extras here.
+	cnameByName := make(map[string]dnsRecord, len(cnamesByName))
+	for name, recs := range cnamesByName {
+		primary, extras := pickPrimaryRecord(rt, recs)
+		cnameByName[name] = primary
+
+		for _, extra := range extras {
+			isManaged := isManagedComment(rt, extra.Comment)
+			if isManaged && rt.Config.DuplicatePolicy == config.DuplicatePolicyDelete {
+				logger.Info("deleting duplicate managed CNAME",
+					"zone_id", zoneID,
+					"zone_name", zoneName,
+					hostnameAttr(rt, name, zoneName),
+					"record_id", extra.ID,
+					"kept_record_id", primary.ID,
+				)
+				if _, err := deleteDNSRecord(rt, client, zoneID, extra); err != nil {
+					return false, fmt.Errorf("delete duplicate CNAME record %s (%s): %w", extra.ID, logHostname(rt, name, zoneName), err)
+				}
+				continue
+			}
+			logger.Warn("duplicate CNAME for hostname; leaving extra record untouched",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", extra.ID,
+				"kept_record_id", primary.ID,
+				"managed", isManaged,
+			)
 		}
 	}
 
 	seen := make(map[string]bool, len(hosts))
+	owned := make(map[string]bool, len(hosts))
+	softDeletes := make(map[string]bool) // soft deletes still pending
+	var createErrs []error
+	converged := true
 
 	// Handle existing CNAMEs according to rules.
 	for name, rec := range cnameByName {
 		_, shouldBeManaged := hostSet[name]
-		isManaged := strings.Contains(rec.Comment, managedCommentMarker)
+		isManaged := isManagedComment(rt, rec.Comment)
 
 		switch {
-		// 1) CNAME for hostname NOT in SyncState & managed -> delete.
+		// 1) CNAME for hostname NOT in SyncState & managed -> delete or
+		// orphan, depending on the release policy.
+		case !shouldBeManaged && isManaged && inCooldown(rt, zoneID, name, recordOpCreate):
+			logger.Warn("managed CNAME was created recently; deferring removal until DESTRUCTIVE_COOLDOWN elapses",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+			)
+			converged = false
+
+		// With SOFT_DELETE_CONFIRM, removal is only confirmed if the hostname
+		// is still absent from SyncState on the next sync.
+		case !shouldBeManaged && isManaged && rt.Config.SoftDeleteConfirm && !rt.SoftDeletes[softDeleteKey(zoneID, rec)]:
+			logger.Info("managed CNAME for hostname not present in SyncState; deferring removal until confirmed by the next sync",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+			)
+			markSoftDelete(rt, zoneID, rec)
+			softDeletes[softDeleteKey(zoneID, rec)] = true
+			converged = false
+
+		case !shouldBeManaged && isManaged && rt.Config.OnRelease == config.OnReleaseOrphan:
+			logger.Info("releasing managed CNAME for hostname not present in SyncState",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+				"content", rec.Content,
+			)
+			if err := releaseDNSRecord(rt, client, zoneID, rec); err != nil {
+				return false, fmt.Errorf("release CNAME record %s (%s): %w", rec.ID, logHostname(rt, name, zoneName), err)
+			}
+			markRecordOp(rt, zoneID, name, recordOpDelete)
+
 		case !shouldBeManaged && isManaged:
 			logger.Info("deleting managed CNAME for hostname not present in SyncState",
 				"zone_id", zoneID,
 				"zone_name", zoneName,
-				"hostname", name,
+				hostnameAttr(rt, name, zoneName),
 				"record_id", rec.ID,
 				"content", rec.Content,
 			)
-			if err := deleteDNSRecord(rt, client, zoneID, rec.ID); err != nil {
-				return fmt.Errorf("delete CNAME record %s (%s): %w", rec.ID, name, err)
+			deleted, err := deleteDNSRecord(rt, client, zoneID, rec)
+			if err != nil {
+				return false, fmt.Errorf("delete CNAME record %s (%s): %w", rec.ID, logHostname(rt, name, zoneName), err)
+			}
+			if deleted {
+				markRecordOp(rt, zoneID, name, recordOpDelete)
 			}
 
 		// 2) CNAME for hostname NOT in SyncState & NOT managed -> leave, log warning.
@@ -257,47 +755,120 @@ func syncZoneRecords(
 			logger.Warn("unmanaged CNAME for hostname not present in SyncState; leaving untouched",
 				"zone_id", zoneID,
 				"zone_name", zoneName,
-				"hostname", name,
+				hostnameAttr(rt, name, zoneName),
 				"record_id", rec.ID,
 				"content", rec.Content,
 			)
 
+		// CNAME for hostname present in SyncState but owned by external-dns
+		// -> warn, do not touch.
+		case shouldBeManaged && foreignOwned[name]:
+			seen[name] = true
+			logger.Warn("hostname is owned by external-dns (ownership TXT record); leaving untouched",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+			)
+			skipHostname(rt, name, skipReasonExternalDNS)
+
 		// 3) CNAME for hostname present in SyncState & managed; if target diff -> update.
 		case shouldBeManaged && isManaged:
 			seen[name] = true
+			owned[name] = true
 
-			if !equalDNSHost(rec.Content, target) {
+			proxied := resolveProxied(rt, zoneName, state.Hosts[name])
+			if !equalDNSHost(rec.Content, target) && isTunnelTarget(rec.Content) {
+				if !rt.Config.RetargetForeignTunnel {
+					logger.Warn("managed CNAME points to a different tunnel; leaving untouched per RETARGET_FOREIGN_TUNNEL",
+						"zone_id", zoneID,
+						"zone_name", zoneName,
+						hostnameAttr(rt, name, zoneName),
+						"record_id", rec.ID,
+						"content", rec.Content,
+						"tunnel_target", target,
+					)
+					break
+				}
+				logger.Warn("managed CNAME points to a different tunnel; retargeting it to the configured tunnel",
+					"zone_id", zoneID,
+					"zone_name", zoneName,
+					hostnameAttr(rt, name, zoneName),
+					"record_id", rec.ID,
+					"content", rec.Content,
+					"tunnel_target", target,
+				)
+			}
+			// Records not modified for MAX_RECORD_AGE are rewritten even if
+			// they match, to re-assert fields we do not compare (e.g. comment).
+			stale := rt.Config.MaxRecordAge > 0 && !rec.ModifiedOn.IsZero() &&
+				time.Since(rec.ModifiedOn) > rt.Config.MaxRecordAge
+			// Records that cannot be proxied read back DNS-only, with the
+			// DNS-only TTL, whatever proxied value was written.
+			ttl := recordTTL(rt, proxied && !notProxiable(rec))
+			if !equalDNSHost(rec.Content, target) || !equalProxied(rec, proxied) || rec.TTL != ttl || stale {
 				logger.Info("updating managed CNAME to tunnel target",
 					"zone_id", zoneID,
 					"zone_name", zoneName,
-					"hostname", name,
+					hostnameAttr(rt, name, zoneName),
 					"record_id", rec.ID,
 					"old_content", rec.Content,
 					"new_content", target,
+					"old_proxied", rec.Proxied,
+					"new_proxied", proxied,
+					"old_ttl", rec.TTL,
+					"new_ttl", ttl,
+					"stale", stale,
 				)
-				if err := updateCNAMERecordTarget(rt, client, zoneID, rec.ID, target); err != nil {
-					return fmt.Errorf("update CNAME record %s (%s): %w", rec.ID, name, err)
+				comment := recordComment(rt, state.Hosts[name])
+				if err := updateCNAMERecordTarget(rt, client, zoneID, rec.ID, target, comment, proxied); err != nil {
+					return false, fmt.Errorf("update CNAME record %s (%s): %w", rec.ID, logHostname(rt, name, zoneName), err)
 				}
 			} else {
 				logger.Debug("managed CNAME already pointing to tunnel; no change",
 					"zone_id", zoneID,
 					"zone_name", zoneName,
-					"hostname", name,
+					hostnameAttr(rt, name, zoneName),
 					"record_id", rec.ID,
 				)
 			}
 
 		// 4) CNAME for hostname present in SyncState but NOT managed -> warn, do not touch.
+		// CNAME for hostname present in SyncState, NOT managed, but already
+		// pointing to the tunnel, with ADOPT_RECORDS -> mark it as managed.
+		// Records of other OWNER_IDs are never adopted.
+		case shouldBeManaged && rt.Config.AdoptRecords && equalDNSHost(rec.Content, target) &&
+			!strings.Contains(rec.Comment, rt.Config.ManagedCommentMarker):
+			seen[name] = true
+			owned[name] = true
+
+			var proxied *bool
+			if rt.Config.AdoptReconcileSettings {
+				p := resolveProxied(rt, zoneName, state.Hosts[name])
+				proxied = &p
+			}
+			logger.Info("adopting unmanaged CNAME pointing to tunnel",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+				"reconcile_settings", proxied != nil,
+			)
+			if err := adoptDNSRecord(rt, client, zoneID, rec, recordComment(rt, state.Hosts[name]), proxied); err != nil {
+				return false, fmt.Errorf("adopt CNAME record %s (%s): %w", rec.ID, logHostname(rt, name, zoneName), err)
+			}
+
 		case shouldBeManaged && !isManaged:
 			seen[name] = true
 			logger.Warn("hostname present in SyncState but CNAME is not managed (no marker in comment); leaving untouched",
 				"zone_id", zoneID,
 				"zone_name", zoneName,
-				"hostname", name,
+				hostnameAttr(rt, name, zoneName),
 				"record_id", rec.ID,
 				"content", rec.Content,
 				"comment", rec.Comment,
 			)
+			skipHostname(rt, name, skipReasonUnmanaged)
 		}
 	}
 
@@ -307,45 +878,359 @@ func syncZoneRecords(
 			continue
 		}
 
+		if foreignOwned[host] {
+			logger.Warn("hostname is owned by external-dns (ownership TXT record); skipping CNAME creation",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, host, zoneName),
+			)
+			skipHostname(rt, host, skipReasonExternalDNS)
+			continue
+		}
+
+		// With the recreate annotation, managed A/AAAA records are replaced
+		// by the CNAME since they cannot be patched into one. That requires
+		// their types to be in DELETABLE_RECORD_TYPES.
+		if hasAorAAAA[host] && state.Hosts[host].Recreate && !allDeletable(rt, addressRecords[host]) {
+			logger.Warn("recreate annotation requires A and AAAA in DELETABLE_RECORD_TYPES; skipping CNAME creation",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, host, zoneName),
+			)
+			skipHostname(rt, host, skipReasonRecreateNotDeletable)
+			continue
+		}
+		if hasAorAAAA[host] && state.Hosts[host].Recreate {
+			cleared, err := deleteManagedRecords(rt, client, zoneID, addressRecords[host])
+			if err != nil {
+				return false, fmt.Errorf("delete A/AAAA records for host %s: %w", logHostname(rt, host, zoneName), err)
+			}
+			if cleared {
+				logger.Info("deleted managed A/AAAA records for hostname to recreate it as CNAME",
+					"zone_id", zoneID,
+					"zone_name", zoneName,
+					hostnameAttr(rt, host, zoneName),
+				)
+				hasAorAAAA[host] = false
+			}
+		}
+
 		if hasAorAAAA[host] {
 			logger.Warn("A/AAAA records exist for hostname; skipping CNAME creation to avoid conflict",
 				"zone_id", zoneID,
 				"zone_name", zoneName,
-				"hostname", host,
+				hostnameAttr(rt, host, zoneName),
+			)
+			skipHostname(rt, host, skipReasonAorAAAA)
+			continue
+		}
+
+		// A CNAME cannot coexist with other records; a proxied one would
+		// break mail delivery or delegation of the hostname. The apex NS
+		// records are handled by APEX_POLICY instead.
+		if hasMXorNS[host] && host != normalizeHost(zoneName) &&
+			rt.Config.MXNSConflictPolicy == config.MXNSConflictPolicySkip {
+			logger.Warn("MX/NS records exist for hostname; skipping CNAME creation to avoid breaking mail or delegation",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, host, zoneName),
 			)
+			skipHostname(rt, host, skipReasonMXorNS)
 			continue
 		}
 
-		service := state.HostToService[host]
+		// Likewise for any other record type, e.g. a TXT or SRV record at the
+		// hostname; Cloudflare would reject the CNAME anyway.
+		if types := otherTypes[host]; len(types) > 0 && host != normalizeHost(zoneName) &&
+			rt.Config.OtherTypeConflictPolicy == config.OtherTypeConflictPolicySkip {
+			slices.Sort(types)
+			logger.Warn("records of other types exist for hostname; skipping CNAME creation since a CNAME cannot coexist with them",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, host, zoneName),
+				"types", strings.Join(slices.Compact(types), ","),
+			)
+			skipHostname(rt, host, skipReasonOtherType)
+			continue
+		}
+
+		// The apex always carries NS/SOA records, so a plain CNAME there is
+		// only valid thanks to Cloudflare's CNAME flattening.
+		if host == normalizeHost(zoneName) {
+			if rt.Config.ApexPolicy == config.ApexPolicySkip {
+				logger.Warn("hostname is the zone apex; skipping CNAME creation per APEX_POLICY",
+					"zone_id", zoneID,
+					"zone_name", zoneName,
+					hostnameAttr(rt, host, zoneName),
+				)
+				skipHostname(rt, host, skipReasonApex)
+				continue
+			}
+			logger.Info("hostname is the zone apex; CNAME will be flattened by Cloudflare",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, host, zoneName),
+			)
+		}
+
+		if inCooldown(rt, zoneID, host, recordOpDelete) {
+			logger.Warn("managed CNAME was removed recently; deferring creation until DESTRUCTIVE_COOLDOWN elapses",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, host, zoneName),
+			)
+			converged = false
+			continue
+		}
+
+		service := state.Hosts[host].Service
 
 		logger.Info("creating managed CNAME for hostname",
 			"zone_id", zoneID,
 			"zone_name", zoneName,
-			"hostname", host,
+			hostnameAttr(rt, host, zoneName),
 			"target", target,
 			"service", service,
 		)
 
-		if err := createCNAMERecord(rt, client, zoneID, host, target); err != nil {
-			return fmt.Errorf("create CNAME for host %s: %w", host, err)
+		// A failure is retried up to HOSTNAME_RETRIES times, and does not
+		// prevent the remaining hostnames of the zone from being created.
+		comment := recordComment(rt, state.Hosts[host])
+		err := withRetries(rt, func() error {
+			return createCNAMERecord(rt, client, zoneID, zoneName, host, target, comment, resolveProxied(rt, zoneName, state.Hosts[host]))
+		})
+		if err != nil {
+			logger.Warn("failed to create managed CNAME for hostname",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, host, zoneName),
+				"error", err,
+			)
+			skipHostname(rt, host, skipReasonCreateFailed)
+			err = fmt.Errorf("create CNAME for host %s: %w", logHostname(rt, host, zoneName), err)
+			rt.Fail(host, err)
+			createErrs = append(createErrs, err)
+			continue
 		}
+		markRecordOp(rt, zoneID, host, recordOpCreate)
+		owned[host] = true
 	}
 
-	return nil
+	pruneSoftDeletes(rt, zoneID, softDeletes)
+
+	if err := syncZoneTXTRecords(rt, client, zoneID, zoneName, hosts, owned, state, records); err != nil {
+		return false, err
+	}
+
+	if err := errors.Join(createErrs...); err != nil {
+		return false, hostnamesError{err}
+	}
+
+	return converged, nil
+}
+
+// hostnamesError wraps the errors of hostnames whose sync failed
+// individually, already recorded with Runtime.Fail, while the rest of the
+// zone was synced.
+type hostnamesError struct {
+	err error
 }
 
-// loadDNSRecords loads all DNS records for given zone ID and filters to the
-// types we're interested in (A, AAAA, CNAME).
+func (e hostnamesError) Error() string { return e.err.Error() }
+
+func (e hostnamesError) Unwrap() error { return e.err }
+
+// hostnameRetryDelay is the delay before the first HOSTNAME_RETRIES retry,
+// growing linearly with each attempt.
+var hostnameRetryDelay = time.Second
+
+// withRetries calls fn, retrying up to HOSTNAME_RETRIES times on error with
+// a growing delay.
+func withRetries(rt *runtime.Runtime, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && attempt <= rt.Config.HostnameRetries; attempt++ {
+		rt.LoggerFor(moduleDNS).Debug("retrying after error",
+			"attempt", attempt,
+			"error", err,
+		)
+		select {
+		case <-rt.Ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * hostnameRetryDelay):
+		}
+		err = fn()
+	}
+	return err
+}
+
+// pickPrimaryRecord picks the record to sync among records sharing a name,
+// preferring managed records and then the lowest ID, and returns the rest.
+func pickPrimaryRecord(rt *runtime.Runtime, recs []dnsRecord) (dnsRecord, []dnsRecord) {
+	sorted := append([]dnsRecord(nil), recs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		mi := isManagedComment(rt, sorted[i].Comment)
+		mj := isManagedComment(rt, sorted[j].Comment)
+		if mi != mj {
+			return mi
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted[0], sorted[1:]
+}
+
+// conflictRecordTypes are the record types, besides those synced, that a
+// CNAME cannot coexist with. Only listed by DNS_PARALLEL_LISTING when
+// OTHER_TYPE_CONFLICT_POLICY is skip.
+var conflictRecordTypes = []string{
+	"CAA", "CERT", "DNSKEY", "DS", "HTTPS", "LOC", "NAPTR", "PTR",
+	"SMIMEA", "SRV", "SSHFP", "SVCB", "TLSA", "URI",
+}
+
+// loadDNSRecords loads all DNS records for given zone ID.
+//
+// With DNS_PARALLEL_LISTING, each type is listed by a separate query
+// filtered server-side, up to DNS_LISTING_CONCURRENCY of them concurrently,
+// and the merged result is sorted so that it does not depend on which query
+// finished first.
 func loadDNSRecords(
 	rt *runtime.Runtime,
 	client *cloudflare.Client,
 	zoneID string,
 ) ([]dnsRecord, error) {
-	logger := rt.Logger
-	if logger == nil {
-		logger = slog.Default()
+	if !rt.Config.DNSParallelListing {
+		return listDNSRecords(rt, client, zoneID)
+	}
+
+	types := []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT"}
+	if rt.Config.OtherTypeConflictPolicy == config.OtherTypeConflictPolicySkip {
+		types = append(types, conflictRecordTypes...)
+	}
+	results := make([][]dnsRecord, len(types))
+	errs := make([]error, len(types))
+
+	// At most DNS_LISTING_CONCURRENCY listings run at once, so that the
+	// conflict types do not burst the API rate limit.
+	sem := make(chan struct{}, rt.Config.DNSListingConcurrency)
+	var wg gosync.WaitGroup
+	for i, t := range types {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = listDNSRecords(rt, client, zoneID, option.WithQuery("type", t))
+		})
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
 	}
 
+	var records []dnsRecord
+	for _, r := range results {
+		records = append(records, r...)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Type != records[j].Type {
+			return records[i].Type < records[j].Type
+		}
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].ID < records[j].ID
+	})
+	return records, nil
+}
+
+// maxFilteredListingNames is the number of names above which filtered
+// listing falls back to a full listing: each name costs one request, so
+// past that a paginated listing of the whole zone is cheaper.
+const maxFilteredListingNames = 20
+
+// loadDNSRecordsFiltered loads only the records relevant to the sync instead
+// of the whole zone: managed records (for delete detection) via a
+// server-side comment filter, and records named after each desired hostname
+// and its ownership TXT (for update and conflict detection) via a name
+// filter. The Cloudflare API has no filter matching several names, so this
+// falls back to loadDNSRecords above maxFilteredListingNames names, or when
+// the comment filter turns out to be ignored by the API.
+func loadDNSRecordsFiltered(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID string,
+	hosts []string,
+) ([]dnsRecord, error) {
+	logger := rt.LoggerFor(moduleDNS)
+
+	names := hosts
+	if rt.Config.TXTOwnership {
+		names = make([]string, 0, 2*len(hosts))
+		for _, host := range hosts {
+			names = append(names, host, ownershipTXTPrefix+host)
+		}
+	}
+	if len(names) > maxFilteredListingNames {
+		logger.Debug("too many hostnames for filtered listing; listing the whole zone",
+			"zone_id", zoneID,
+			"names", len(names),
+		)
+		return loadDNSRecords(rt, client, zoneID)
+	}
+
+	seen := make(map[string]bool)
+	var records []dnsRecord
+
+	managed, err := listDNSRecords(rt, client, zoneID,
+		option.WithQuery("comment.contains", rt.Config.ManagedCommentMarker),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range managed {
+		if !strings.Contains(r.Comment, rt.Config.ManagedCommentMarker) {
+			continue
+		}
+		seen[r.ID] = true
+		records = append(records, r)
+	}
+	if dropped := len(managed) - len(records); dropped > 0 {
+		// The name filters are then unlikely to be honored either, and
+		// each would return the whole zone.
+		logger.Debug("comment filter returned unmanaged records; listing the whole zone",
+			"zone_id", zoneID,
+			"dropped", dropped,
+		)
+		return loadDNSRecords(rt, client, zoneID)
+	}
+
+	for _, name := range names {
+		named, err := listDNSRecords(rt, client, zoneID,
+			option.WithQuery("name", name),
+		)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range named {
+			if seen[r.ID] || !equalDNSHost(r.Name, name) {
+				continue
+			}
+			seen[r.ID] = true
+			records = append(records, r)
+		}
+	}
+
+	return records, nil
+}
+
+// listDNSRecords pages through DNS records of given zone ID, passing opts as
+// additional query filters.
+func listDNSRecords(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID string,
+	opts ...option.RequestOption,
+) ([]dnsRecord, error) {
+	logger := rt.LoggerFor(moduleDNS)
+
 	var records []dnsRecord
 	page := 1
 
@@ -357,26 +1242,23 @@ func loadDNSRecords(
 			"page", page,
 		)
 
+		reqOpts := append([]option.RequestOption{
+			option.WithQuery("page", fmt.Sprintf("%d", page)),
+			option.WithQuery("per_page", pageSize(rt, minDNSRecordsPageSize, maxDNSRecordsPageSize)),
+		}, opts...)
+
 		err := client.Get(
 			rt.Ctx,
 			fmt.Sprintf("/zones/%s/dns_records", url.PathEscape(zoneID)),
 			nil,
 			&resp,
-			option.WithQuery("page", fmt.Sprintf("%d", page)),
-			option.WithQuery("per_page", "100"),
+			reqOpts...,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("GET /zones/%s/dns_records page %d: %w", zoneID, page, err)
 		}
 
-		for _, r := range resp.Result {
-			switch r.Type {
-			case "A", "AAAA", "CNAME":
-				records = append(records, r)
-			default:
-				// ignore other record types
-			}
-		}
+		records = append(records, resp.Result...)
 
 		if resp.ResultInfo.Page >= resp.ResultInfo.TotalPages || resp.ResultInfo.TotalPages == 0 {
 			break
@@ -387,22 +1269,148 @@ func loadDNSRecords(
 	return records, nil
 }
 
-// deleteDNSRecord deletes a DNS record by ID.
+// deleteDNSRecord deletes a DNS record. As a safety net, records whose type
+// is not listed in DELETABLE_RECORD_TYPES are never deleted; a warning is
+// logged and false returned instead.
 func deleteDNSRecord(
 	rt *runtime.Runtime,
 	client *cloudflare.Client,
-	zoneID, recordID string,
-) error {
+	zoneID string,
+	rec dnsRecord,
+) (bool, error) {
+	if !slices.Contains(rt.Config.DeletableRecordTypes, rec.Type) {
+		rt.LoggerFor(moduleDNS).Warn("record type is not in DELETABLE_RECORD_TYPES; refusing to delete",
+			"zone_id", zoneID,
+			hostnameAttr(rt, rec.Name, ""),
+			"record_id", rec.ID,
+			"type", rec.Type,
+		)
+		return false, nil
+	}
+
 	var res struct{}
 	err := client.Delete(
 		rt.Ctx,
-		fmt.Sprintf("/zones/%s/dns_records/%s", url.PathEscape(zoneID), url.PathEscape(recordID)),
+		fmt.Sprintf("/zones/%s/dns_records/%s", url.PathEscape(zoneID), url.PathEscape(rec.ID)),
 		nil,
 		&res,
 	)
 	if err != nil {
-		return fmt.Errorf("DELETE /zones/%s/dns_records/%s: %w", zoneID, recordID, err)
+		return false, fmt.Errorf("DELETE /zones/%s/dns_records/%s: %w", zoneID, rec.ID, err)
+	}
+	cacheRecordDelete(rt, zoneID, rec)
+	rt.Changes++
+	return true, nil
+}
+
+// deleteManagedRecords deletes all of recs, provided they are all managed
+// by us and deletable (see DELETABLE_RECORD_TYPES). It reports whether all
+// of them were deleted; if any is unmanaged or not deletable, none is
+// deleted.
+func deleteManagedRecords(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID string,
+	recs []dnsRecord,
+) (bool, error) {
+	if !allDeletable(rt, recs) {
+		return false, nil
+	}
+	for _, rec := range recs {
+		if !isManagedComment(rt, rec.Comment) {
+			return false, nil
+		}
+	}
+	for _, rec := range recs {
+		deleted, err := deleteDNSRecord(rt, client, zoneID, rec)
+		if err != nil || !deleted {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// allDeletable reports whether the types of all of recs are listed in
+// DELETABLE_RECORD_TYPES.
+func allDeletable(rt *runtime.Runtime, recs []dnsRecord) bool {
+	for _, rec := range recs {
+		if !slices.Contains(rt.Config.DeletableRecordTypes, rec.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// adoptDNSRecord brings an unmanaged record under management by appending
+// comment (our managed marker) to its comment. If proxied is set, the
+// proxied flag and TTL are converged too (ADOPT_RECONCILE_SETTINGS).
+func adoptDNSRecord(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID string,
+	rec dnsRecord,
+	comment string,
+	proxied *bool,
+) error {
+	body := map[string]any{
+		"comment": strings.TrimSpace(rec.Comment + " " + comment),
+	}
+	if proxied != nil {
+		body["proxied"] = *proxied
+		body["ttl"] = recordTTL(rt, *proxied)
+	}
+
+	var resp struct {
+		Success bool      `json:"success"`
+		Result  dnsRecord `json:"result"`
+	}
+	err := client.Patch(
+		rt.Ctx,
+		fmt.Sprintf("/zones/%s/dns_records/%s", url.PathEscape(zoneID), url.PathEscape(rec.ID)),
+		body,
+		&resp,
+	)
+	if err != nil {
+		return fmt.Errorf("PATCH /zones/%s/dns_records/%s: %w", zoneID, rec.ID, err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("Cloudflare API reported failure adopting record")
 	}
+	cacheRecordWrite(rt, zoneID, resp.Result)
+	rt.Changes++
+	return nil
+}
+
+// releaseDNSRecord strips the managed marker from the record comment, leaving
+// the record itself intact.
+func releaseDNSRecord(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID string,
+	rec dnsRecord,
+) error {
+	body := map[string]any{
+		"comment": stripManagedComment(rt, rec.Comment),
+	}
+
+	var resp struct {
+		Success bool      `json:"success"`
+		Result  dnsRecord `json:"result"`
+	}
+	err := client.Patch(
+		rt.Ctx,
+		fmt.Sprintf("/zones/%s/dns_records/%s", url.PathEscape(zoneID), url.PathEscape(rec.ID)),
+		body,
+		&resp,
+	)
+	if err != nil {
+		return fmt.Errorf("PATCH /zones/%s/dns_records/%s: %w", zoneID, rec.ID, err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("Cloudflare API reported failure releasing record")
+	}
+	cacheRecordWrite(rt, zoneID, resp.Result)
+	rt.Changes++
 	return nil
 }
 
@@ -410,19 +1418,21 @@ func deleteDNSRecord(
 func createCNAMERecord(
 	rt *runtime.Runtime,
 	client *cloudflare.Client,
-	zoneID, hostname, target string,
+	zoneID, zoneName, hostname, target, comment string,
+	proxied bool,
 ) error {
 	body := map[string]any{
 		"type":    "CNAME",
-		"name":    hostname,
+		"name":    recordName(rt, hostname, zoneName),
 		"content": target,
-		"ttl":     1, // "auto"
-		"proxied": true,
-		"comment": managedCommentMarker,
+		"ttl":     recordTTL(rt, proxied),
+		"proxied": proxied,
+		"comment": comment,
 	}
 
 	var resp struct {
-		Success bool `json:"success"`
+		Success bool      `json:"success"`
+		Result  dnsRecord `json:"result"`
 	}
 	err := client.Post(
 		rt.Ctx,
@@ -436,22 +1446,29 @@ func createCNAMERecord(
 	if !resp.Success {
 		return fmt.Errorf("Cloudflare API reported failure creating CNAME")
 	}
+	cacheRecordWrite(rt, zoneID, resp.Result)
+	rt.Changes++
 	return nil
 }
 
-// updateCNAMERecordTarget updates the content + comment of an existing CNAME.
+// updateCNAMERecordTarget updates the content, proxied flag and comment of an
+// existing CNAME.
 func updateCNAMERecordTarget(
 	rt *runtime.Runtime,
 	client *cloudflare.Client,
-	zoneID, recordID, target string,
+	zoneID, recordID, target, comment string,
+	proxied bool,
 ) error {
 	body := map[string]any{
 		"content": target,
-		"comment": managedCommentMarker,
+		"proxied": proxied,
+		"ttl":     recordTTL(rt, proxied),
+		"comment": comment,
 	}
 
 	var resp struct {
-		Success bool `json:"success"`
+		Success bool      `json:"success"`
+		Result  dnsRecord `json:"result"`
 	}
 	err := client.Patch(
 		rt.Ctx,
@@ -465,16 +1482,37 @@ func updateCNAMERecordTarget(
 	if !resp.Success {
 		return fmt.Errorf("Cloudflare API reported failure updating CNAME")
 	}
+	cacheRecordWrite(rt, zoneID, resp.Result)
+	rt.Changes++
 	return nil
 }
 
-// bestMatchingZone chooses the zone whose name is the longest suffix of hostname.
+// matchesAnyPattern reports whether the hostname matches any of the glob
+// patterns (see path.Match; "*" does not match across dots).
+func matchesAnyPattern(patterns []string, hostname string) bool {
+	// path.Match stops wildcards at slashes; make labels path elements so
+	// that they stop at dots instead.
+	hostname = strings.ReplaceAll(hostname, ".", "/")
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ReplaceAll(pattern, ".", "/"), hostname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bestMatchingZone chooses the zone whose name is the longest suffix of
+// hostname. A zone named exactly hostname always wins, so that the hostname
+// is managed as that zone's apex.
 func bestMatchingZone(hostname string, zones []zoneSummary) string {
 	hostname = normalizeHost(hostname)
 	best := ""
 	for _, z := range zones {
 		name := normalizeHost(z.Name)
-		if hostname == name || strings.HasSuffix(hostname, "."+name) {
+		if hostname == name {
+			return name
+		}
+		if strings.HasSuffix(hostname, "."+name) {
 			if len(name) > len(best) {
 				best = name
 			}
@@ -483,13 +1521,193 @@ func bestMatchingZone(hostname string, zones []zoneSummary) string {
 	return best
 }
 
+const (
+	recordOpCreate = "create"
+	recordOpDelete = "delete"
+)
+
+// inCooldown reports whether op was performed on the record for hostname in
+// zoneID less than DESTRUCTIVE_COOLDOWN ago. It guards against flapping:
+// a record is not deleted right after being created, and vice versa.
+func inCooldown(rt *runtime.Runtime, zoneID, hostname, op string) bool {
+	if rt.Config.DestructiveCooldown <= 0 {
+		return false
+	}
+	last, ok := rt.RecentRecordOps[zoneID+"/"+hostname]
+	return ok && last.Op == op && time.Since(last.At) < rt.Config.DestructiveCooldown
+}
+
+// markRecordOp records that op was performed on the record for hostname in
+// zoneID, for inCooldown.
+func markRecordOp(rt *runtime.Runtime, zoneID, hostname, op string) {
+	if rt.Config.DestructiveCooldown <= 0 {
+		return
+	}
+	if rt.RecentRecordOps == nil {
+		rt.RecentRecordOps = make(map[string]runtime.RecordOp)
+	}
+	for key, last := range rt.RecentRecordOps {
+		if time.Since(last.At) >= rt.Config.DestructiveCooldown {
+			delete(rt.RecentRecordOps, key)
+		}
+	}
+	rt.RecentRecordOps[zoneID+"/"+hostname] = runtime.RecordOp{Op: op, At: time.Now()}
+}
+
+// zoneStateHash hashes everything syncZoneRecords derives the desired records
+// of a zone from. Out-of-band changes to the zone's records are not covered:
+// while the hash is unchanged, such changes are not corrected.
+func zoneStateHash(zoneName string, hosts []string, state *SyncState, target string) string {
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", zoneName, target)
+	for _, host := range sorted {
+		// Pointers would be hashed by address; hash the values instead.
+		hc := state.Hosts[host]
+		proxied := "default"
+		if hc.Proxied != nil {
+			proxied = strconv.FormatBool(*hc.Proxied)
+		}
+		hc.Proxied = nil
+		fmt.Fprintf(h, "%s %+v proxied=%s\n", host, hc, proxied)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// resolveProxied decides whether the managed CNAME for host in zoneName
+// should be proxied. Zones listed in DNS_ONLY_ZONES are always DNS-only;
+// otherwise the proxied annotation of
+// the service applies, then the default for the service type from
+// PROXIED_BY_SERVICE_TYPE, then the zone's default from
+// ZONE_PROXIED_DEFAULTS, falling back to CLOUDFLARE_PROXIED.
+func resolveProxied(rt *runtime.Runtime, zoneName string, host HostConfig) bool {
+	zoneName = normalizeHost(zoneName)
+	for _, z := range rt.Config.DNSOnlyZones {
+		if z == zoneName {
+			return false
+		}
+	}
+	if host.Proxied != nil {
+		return *host.Proxied
+	}
+	if proxied, ok := rt.Config.ProxiedByServiceType[host.ServiceType]; ok {
+		return proxied
+	}
+	if proxied, ok := rt.Config.ZoneProxiedDefaults[zoneName]; ok {
+		return proxied
+	}
+	return rt.Config.Proxied
+}
+
+// recordName returns the record name to send to Cloudflare for hostname in
+// zoneName, according to RECORD_NAME_FORM.
+func recordName(rt *runtime.Runtime, hostname, zoneName string) string {
+	hostname = normalizeHost(hostname)
+	if rt.Config.RecordNameForm != config.RecordNameFormRelative {
+		return hostname
+	}
+
+	zoneName = normalizeHost(zoneName)
+	if hostname == zoneName {
+		return "@"
+	}
+	return strings.TrimSuffix(hostname, "."+zoneName)
+}
+
+// isValidHostname reports whether s is a well-formed DNS hostname: at most
+// 253 characters of dot-separated labels, each 1-63 characters of letters,
+// digits and hyphens, not starting or ending with a hyphen.
+func isValidHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Page sizes allowed by the Cloudflare API for the list endpoints we use.
+const (
+	defaultPageSize       = 100
+	minZonesPageSize      = 5
+	maxZonesPageSize      = 50
+	minDNSRecordsPageSize = 5
+	maxDNSRecordsPageSize = 5000
+)
+
+// pageSize returns CLOUDFLARE_PAGE_SIZE, or the default page size if unset,
+// clamped to [lo, hi].
+func pageSize(rt *runtime.Runtime, lo, hi int) string {
+	size := rt.Config.CloudFlarePageSize
+	if size == 0 {
+		size = defaultPageSize
+	}
+	return strconv.Itoa(min(max(size, lo), hi))
+}
+
 // equalDNSHost compares DNS hostnames ignoring trailing dot & case.
 func equalDNSHost(a, b string) bool {
 	return normalizeHost(a) == normalizeHost(b)
 }
 
+// isTunnelTarget reports whether content is the CNAME target of a
+// Cloudflare tunnel.
+func isTunnelTarget(content string) bool {
+	return strings.HasSuffix(normalizeHost(content), ".cfargotunnel.com")
+}
+
+// recordTTL returns the TTL of a managed CNAME: CLOUDFLARE_DNS_TTL for
+// DNS-only records, and 1 ("auto") for proxied ones, whose TTL Cloudflare
+// always reports as auto.
+func recordTTL(rt *runtime.Runtime, proxied bool) int {
+	if proxied {
+		return 1
+	}
+	return rt.Config.DNSTTL
+}
+
+// equalProxied reports whether the proxied flag of rec matches proxied.
+// Records Cloudflare reports as not proxiable never read back as proxied, so
+// any desired value is considered equal to avoid updating them every cycle.
+func equalProxied(rec dnsRecord, proxied bool) bool {
+	if notProxiable(rec) {
+		return true
+	}
+	return rec.Proxied == proxied
+}
+
+// notProxiable reports whether Cloudflare reports rec as not proxiable.
+func notProxiable(rec dnsRecord) bool {
+	return rec.Proxiable != nil && !*rec.Proxiable
+}
+
+// hostIDNA converts hostnames to ASCII like idna.Lookup, but also accepts
+// labels that are not strictly valid domain names, e.g. "_verify" or "*".
+var hostIDNA = idna.New(idna.MapForLookup(), idna.StrictDomainName(false))
+
+// normalizeHost lowercases s, strips whitespace and trailing dots, and
+// converts internationalized names to their ASCII (punycode) form, so that
+// hostnames compare equal regardless of how Cloudflare presents them.
 func normalizeHost(s string) string {
 	s = strings.TrimSpace(s)
-	s = strings.TrimSuffix(s, ".")
-	return strings.ToLower(s)
+	s = strings.TrimRight(s, ".")
+	s = strings.ToLower(s)
+	if ascii, err := hostIDNA.ToASCII(s); err == nil {
+		return ascii
+	}
+	return s
 }
@@ -0,0 +1,1386 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"tunnel/internal/runtime"
+)
+
+func TestSyncDNSOnRelease(t *testing.T) {
+	tests := []struct {
+		name        string
+		onRelease   string
+		wantRecord  bool
+		wantComment string
+	}{
+		{name: "default deletes", onRelease: "", wantRecord: false},
+		{name: "delete", onRelease: "delete", wantRecord: false},
+		{name: "orphan keeps record without marker", onRelease: "orphan", wantRecord: true, wantComment: "owned by team-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"ON_RELEASE": tt.onRelease})
+			released := managedCNAME("rec-old", "old.example.com")
+			released.Comment = "owned by team-a managed by tunnel-manager"
+			cf.addRecords(testZoneID, released, managedCNAME("rec-app", "app.example.com"))
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			rec, ok := cf.record(testZoneID, "CNAME", "old.example.com")
+			if ok != tt.wantRecord {
+				t.Fatalf("released record present = %v, want %v", ok, tt.wantRecord)
+			}
+			if ok {
+				if rec.Comment != tt.wantComment {
+					t.Errorf("comment = %q, want %q", rec.Comment, tt.wantComment)
+				}
+				if isManagedComment(rt, rec.Comment) {
+					t.Errorf("orphaned record is still managed")
+				}
+			}
+			if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); !ok {
+				t.Errorf("desired record was removed")
+			}
+		})
+	}
+}
+
+func TestLoadDNSRecordsFiltered(t *testing.T) {
+	manyHosts := make([]string, maxFilteredListingNames+1)
+	for i := range manyHosts {
+		manyHosts[i] = fmt.Sprintf("host%d.example.com", i)
+	}
+
+	tests := []struct {
+		name          string
+		hosts         []string
+		ignoreFilters bool
+		// wantQueries are the filters of the listing requests, in order.
+		wantQueries []string
+	}{
+		{
+			name:        "comment filter plus one lookup per host",
+			hosts:       []string{"app.example.com", "api.example.com"},
+			wantQueries: []string{"comment.contains", "name=app.example.com", "name=api.example.com"},
+		},
+		{
+			name:        "too many hosts lists the whole zone",
+			hosts:       manyHosts,
+			wantQueries: []string{""},
+		},
+		{
+			name:          "ignored comment filter lists the whole zone",
+			hosts:         []string{"app.example.com"},
+			ignoreFilters: true,
+			wantQueries:   []string{"comment.contains", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"DNS_FILTERED_LISTING": "true"})
+			cf.ignoreFilters = tt.ignoreFilters
+			cf.addRecords(testZoneID,
+				managedCNAME("rec-stale", "stale.example.com"),
+				dnsRecord{ID: "rec-a", Type: "A", Name: "app.example.com", Content: "192.0.2.1"},
+				dnsRecord{ID: "rec-other", Type: "A", Name: "other.example.com", Content: "192.0.2.2"},
+			)
+
+			records, err := loadDNSRecordsFiltered(rt, rt.Client.CloudFlareClient, testZoneID, tt.hosts)
+			if err != nil {
+				t.Fatalf("loadDNSRecordsFiltered: %v", err)
+			}
+
+			var ids []string
+			for _, rec := range records {
+				ids = append(ids, rec.ID)
+			}
+			for _, want := range []string{"rec-stale", "rec-a"} {
+				if !slices.Contains(ids, want) {
+					t.Errorf("records %v missing %s", ids, want)
+				}
+			}
+
+			var queries []string
+			for _, req := range cf.requestsMatching(http.MethodGet, "/dns_records") {
+				switch {
+				case req.Query["comment.contains"] != "":
+					queries = append(queries, "comment.contains")
+				case req.Query["name"] != "":
+					queries = append(queries, "name="+req.Query["name"])
+				default:
+					queries = append(queries, "")
+				}
+			}
+			if !slices.Equal(queries, tt.wantQueries) {
+				t.Errorf("listing queries = %q, want %q", queries, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestSyncDNSRecordNameForm(t *testing.T) {
+	tests := []struct {
+		name     string
+		form     string
+		hostname string
+		wantName string
+	}{
+		{name: "fqdn subdomain", form: "fqdn", hostname: "app.example.com", wantName: "app.example.com"},
+		{name: "fqdn apex", form: "fqdn", hostname: "example.com", wantName: "example.com"},
+		{name: "relative subdomain", form: "relative", hostname: "app.example.com", wantName: "app"},
+		{name: "relative nested subdomain", form: "relative", hostname: "a.b.example.com", wantName: "a.b"},
+		{name: "relative apex", form: "relative", hostname: "example.com", wantName: "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"RECORD_NAME_FORM": tt.form})
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, tt.hostname)
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			posts := cf.requestsMatching(http.MethodPost, "/dns_records")
+			if len(posts) != 1 {
+				t.Fatalf("got %d create requests, want 1", len(posts))
+			}
+			if got := posts[0].Body["name"]; got != tt.wantName {
+				t.Errorf("sent name %v, want %q", got, tt.wantName)
+			}
+			if _, ok := cf.record(testZoneID, "CNAME", tt.hostname); !ok {
+				t.Errorf("no CNAME record for %s", tt.hostname)
+			}
+
+			// The stored record is matched again regardless of the form.
+			writes := cf.writes()
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("second SyncDNS: %v", err)
+			}
+			if got := cf.writes(); got != writes {
+				t.Errorf("second sync made %d writes, want none", got-writes)
+			}
+		})
+	}
+}
+
+func TestResolveProxied(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name string
+		env  map[string]string
+		host HostConfig
+		want bool
+	}{
+		{name: "global default", host: HostConfig{}, want: true},
+		{name: "annotation", host: HostConfig{Proxied: &no}, want: false},
+		{name: "service type default", env: map[string]string{"PROXIED_BY_SERVICE_TYPE": `{"LoadBalancer":false}`}, host: HostConfig{ServiceType: "LoadBalancer"}, want: false},
+		{name: "zone default", env: map[string]string{"ZONE_PROXIED_DEFAULTS": `{"example.com":false}`}, host: HostConfig{}, want: false},
+		{name: "dns-only zone", env: map[string]string{"DNS_ONLY_ZONES": "example.com"}, host: HostConfig{}, want: false},
+		{name: "dns-only zone overrides annotation", env: map[string]string{"DNS_ONLY_ZONES": "example.com"}, host: HostConfig{Proxied: &yes}, want: false},
+		{name: "dns-only zone is normalized", env: map[string]string{"DNS_ONLY_ZONES": "Example.COM."}, host: HostConfig{}, want: false},
+		{name: "other dns-only zone", env: map[string]string{"DNS_ONLY_ZONES": "example.org"}, host: HostConfig{}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, tt.env)
+			if got := resolveProxied(rt, testZoneName, tt.host); got != tt.want {
+				t.Errorf("resolveProxied = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncDNSDNSOnlyZone(t *testing.T) {
+	yes := true
+	rt, cf := newTestRuntime(t, map[string]string{"DNS_ONLY_ZONES": "example.com"})
+	cf.addRecords(testZoneID, managedCNAME("rec-app", "app.example.com"))
+
+	state := NewSyncState()
+	state.Hosts["app.example.com"] = HostConfig{Service: "http://app.default.svc.cluster.local:80", Proxied: &yes}
+	state.Hosts["new.example.com"] = HostConfig{Service: "http://new.default.svc.cluster.local:80"}
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("SyncDNS: %v", err)
+	}
+
+	for _, host := range []string{"app.example.com", "new.example.com"} {
+		rec, ok := cf.record(testZoneID, "CNAME", host)
+		if !ok {
+			t.Fatalf("no CNAME record for %s", host)
+		}
+		if rec.Proxied {
+			t.Errorf("%s is proxied in a DNS-only zone", host)
+		}
+	}
+}
+
+func TestSyncDNSSkipUnchangedZones(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		// between, if set, runs between the two syncs of app.example.com.
+		between    func(rt *runtime.Runtime, state *SyncState)
+		wantListed bool
+	}{
+		{
+			name:       "unchanged zone is skipped",
+			env:        map[string]string{"SKIP_UNCHANGED_ZONES": "true"},
+			wantListed: false,
+		},
+		{
+			name:       "disabled",
+			env:        map[string]string{},
+			wantListed: true,
+		},
+		{
+			name: "changed state is synced",
+			env:  map[string]string{"SKIP_UNCHANGED_ZONES": "true"},
+			between: func(rt *runtime.Runtime, state *SyncState) {
+				state.Hosts["api.example.com"] = HostConfig{Service: "http://api.default.svc.cluster.local:80"}
+			},
+			wantListed: true,
+		},
+		{
+			name: "full sync interval elapsed",
+			env:  map[string]string{"SKIP_UNCHANGED_ZONES": "true"},
+			between: func(rt *runtime.Runtime, state *SyncState) {
+				last := rt.ZoneHashes[testZoneID]
+				last.At = last.At.Add(-rt.Config.ZoneFullSyncInterval)
+				rt.ZoneHashes[testZoneID] = last
+			},
+			wantListed: true,
+		},
+		{
+			name: "pending soft delete",
+			env:  map[string]string{"SKIP_UNCHANGED_ZONES": "true"},
+			between: func(rt *runtime.Runtime, state *SyncState) {
+				rt.SoftDeletes = map[string]bool{testZoneID + "/rec-old": true}
+			},
+			wantListed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, tt.env)
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("first SyncDNS: %v", err)
+			}
+			if tt.between != nil {
+				tt.between(rt, state)
+			}
+
+			listed := len(cf.requestsMatching(http.MethodGet, "/dns_records"))
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("second SyncDNS: %v", err)
+			}
+			gotListed := len(cf.requestsMatching(http.MethodGet, "/dns_records")) > listed
+			if gotListed != tt.wantListed {
+				t.Errorf("zone listed on second sync = %v, want %v", gotListed, tt.wantListed)
+			}
+		})
+	}
+}
+
+func TestSyncDNSSkipUnchangedZonesRepairsDrift(t *testing.T) {
+	rt, cf := newTestRuntime(t, map[string]string{
+		"SKIP_UNCHANGED_ZONES":    "true",
+		"ZONE_FULL_SYNC_INTERVAL": "1ms",
+	})
+	state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("first SyncDNS: %v", err)
+	}
+
+	// The record is deleted out of band; the desired state is unchanged.
+	cf.mu.Lock()
+	cf.records[testZoneID] = nil
+	cf.mu.Unlock()
+	time.Sleep(2 * time.Millisecond)
+
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("second SyncDNS: %v", err)
+	}
+	if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); !ok {
+		t.Errorf("deleted record was not recreated after the full sync interval")
+	}
+}
+
+func TestSyncDNSDuplicateZoneNames(t *testing.T) {
+	// The same zone is picked whether or not zones are streamed.
+	for _, stream := range []string{"false", "true"} {
+		t.Run("STREAM_ZONES="+stream, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"STREAM_ZONES": stream})
+			var logs bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			// The test zone is listed first; the lowest ID is listed last.
+			cf.addZone("zone-z", testZoneName)
+			cf.addZone("zone-a", testZoneName)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			for _, zoneID := range []string{testZoneID, "zone-z", "zone-a"} {
+				_, ok := cf.record(zoneID, "CNAME", "app.example.com")
+				if want := zoneID == "zone-a"; ok != want {
+					t.Errorf("record in zone %s = %v, want %v", zoneID, ok, want)
+				}
+			}
+			if !strings.Contains(logs.String(), "multiple zones with the same name") {
+				t.Errorf("ambiguity was not logged:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestSyncDNSApexPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		wantRecord bool
+		wantSkip   string
+	}{
+		{name: "default flattens", policy: "", wantRecord: true},
+		{name: "flatten", policy: "flatten", wantRecord: true},
+		{name: "skip", policy: "skip", wantRecord: false, wantSkip: skipReasonApex},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"APEX_POLICY": tt.policy})
+			cf.addRecords(testZoneID,
+				dnsRecord{ID: "rec-ns", Type: "NS", Name: testZoneName, Content: "ns1.example.net"},
+				dnsRecord{ID: "rec-soa", Type: "SOA", Name: testZoneName, Content: "ns1.example.net"},
+			)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, testZoneName, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "CNAME", testZoneName); ok != tt.wantRecord {
+				t.Errorf("apex CNAME present = %v, want %v", ok, tt.wantRecord)
+			}
+			if got := skipReason(rt, testZoneName); got != tt.wantSkip {
+				t.Errorf("apex skip reason = %q, want %q", got, tt.wantSkip)
+			}
+			if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); !ok {
+				t.Errorf("subdomain CNAME was not created")
+			}
+			for _, typ := range []string{"NS", "SOA"} {
+				if _, ok := cf.record(testZoneID, typ, testZoneName); !ok {
+					t.Errorf("apex %s record was removed", typ)
+				}
+			}
+		})
+	}
+}
+
+func TestBestMatchingZone(t *testing.T) {
+	zones := []zoneSummary{
+		{ID: "zone-dev", Name: "dev.example.com"},
+		{ID: "zone-example", Name: "example.com"},
+		{ID: "zone-org", Name: "example.org"},
+	}
+	reversed := slices.Clone(zones)
+	slices.Reverse(reversed)
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{hostname: "example.com", want: "example.com"},
+		{hostname: "app.example.com", want: "example.com"},
+		{hostname: "dev.example.com", want: "dev.example.com"},
+		{hostname: "app.dev.example.com", want: "dev.example.com"},
+		{hostname: "App.Dev.Example.com.", want: "dev.example.com"},
+		{hostname: "notexample.com", want: ""},
+		{hostname: "example.net", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if got := bestMatchingZone(tt.hostname, zones); got != tt.want {
+				t.Errorf("bestMatchingZone(%q) = %q, want %q", tt.hostname, got, tt.want)
+			}
+			// The result must not depend on the order zones are listed in.
+			if got := bestMatchingZone(tt.hostname, reversed); got != tt.want {
+				t.Errorf("bestMatchingZone(%q) on reversed zones = %q, want %q", tt.hostname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncDNSApexOfSubzone(t *testing.T) {
+	tests := []struct {
+		policy   string
+		wantSkip string
+	}{
+		{policy: "flatten"},
+		{policy: "skip", wantSkip: skipReasonApex},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"APEX_POLICY": tt.policy})
+			var logs bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			cf.addZone("zone-dev", "dev.example.com")
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "dev.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "CNAME", "dev.example.com"); ok {
+				t.Errorf("apex of dev.example.com was created in the parent zone")
+			}
+			if _, ok := cf.record("zone-dev", "CNAME", "dev.example.com"); ok != (tt.wantSkip == "") {
+				t.Errorf("apex CNAME present = %v, want %v", ok, tt.wantSkip == "")
+			}
+			if got := skipReason(rt, "dev.example.com"); got != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, tt.wantSkip)
+			}
+			if !strings.Contains(logs.String(), "hostname is the zone apex") || !strings.Contains(logs.String(), "zone_name=dev.example.com") {
+				t.Errorf("apex handling not logged for zone dev.example.com: %s", logs.String())
+			}
+		})
+	}
+}
+
+func TestLoadDNSRecordsParallel(t *testing.T) {
+	records := []dnsRecord{
+		managedCNAME("rec-b", "b.example.com"),
+		{ID: "rec-aaaa", Type: "AAAA", Name: "v6.example.com", Content: "2001:db8::1"},
+		managedCNAME("rec-a", "a.example.com"),
+		{ID: "rec-a1", Type: "A", Name: "v4.example.com", Content: "192.0.2.1"},
+		{ID: "rec-txt", Type: "TXT", Name: "a.example.com", Content: "hello"},
+		{ID: "rec-srv", Type: "SRV", Name: "_sip._tcp.example.com", Content: "0 5 5060 sip.example.com"},
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantIDs []string
+	}{
+		{
+			name:    "sequential",
+			env:     map[string]string{"DNS_PARALLEL_LISTING": "false"},
+			wantIDs: []string{"rec-b", "rec-aaaa", "rec-a", "rec-a1", "rec-txt", "rec-srv"},
+		},
+		{
+			name:    "parallel merges sorted by type and name",
+			env:     map[string]string{"DNS_PARALLEL_LISTING": "true", "OTHER_TYPE_CONFLICT_POLICY": "ignore"},
+			wantIDs: []string{"rec-a1", "rec-aaaa", "rec-a", "rec-b", "rec-txt"},
+		},
+		{
+			name:    "parallel includes conflict types",
+			env:     map[string]string{"DNS_PARALLEL_LISTING": "true", "OTHER_TYPE_CONFLICT_POLICY": "skip"},
+			wantIDs: []string{"rec-a1", "rec-aaaa", "rec-a", "rec-b", "rec-srv", "rec-txt"},
+		},
+		{
+			name:    "parallel with concurrency 1",
+			env:     map[string]string{"DNS_PARALLEL_LISTING": "true", "DNS_LISTING_CONCURRENCY": "1"},
+			wantIDs: []string{"rec-a1", "rec-aaaa", "rec-a", "rec-b", "rec-srv", "rec-txt"},
+		},
+		{
+			name:    "parallel with concurrency 5",
+			env:     map[string]string{"DNS_PARALLEL_LISTING": "true", "DNS_LISTING_CONCURRENCY": "5"},
+			wantIDs: []string{"rec-a1", "rec-aaaa", "rec-a", "rec-b", "rec-srv", "rec-txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, tt.env)
+			cf.addRecords(testZoneID, records...)
+			cf.latency = 10 * time.Millisecond
+
+			got, err := loadDNSRecords(rt, rt.Client.CloudFlareClient, testZoneID)
+			if err != nil {
+				t.Fatalf("loadDNSRecords: %v", err)
+			}
+			var ids []string
+			for _, rec := range got {
+				ids = append(ids, rec.ID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("records = %q, want %q", ids, tt.wantIDs)
+			}
+
+			if rt.Config.DNSParallelListing {
+				var types []string
+				for _, req := range cf.requestsMatching(http.MethodGet, "/dns_records") {
+					types = append(types, req.Query["type"])
+				}
+				for _, typ := range []string{"A", "AAAA", "CNAME"} {
+					if !slices.Contains(types, typ) {
+						t.Errorf("type %s was not listed; listed %q", typ, types)
+					}
+				}
+
+				limit := int32(rt.Config.DNSListingConcurrency)
+				if got := cf.maxInFlight.Load(); got > limit || limit > 1 && got < 2 {
+					t.Errorf("listings in flight at once = %d, want at most %d and concurrent", got, limit)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncDNSInvalidTunnelTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		tunnelID string
+		wantErr  bool
+	}{
+		{name: "valid", tunnelID: testTunnelID, wantErr: false},
+		{name: "empty", tunnelID: "", wantErr: true},
+		{name: "whitespace", tunnelID: "my tunnel", wantErr: true},
+		{name: "leading hyphen", tunnelID: "-abc", wantErr: true},
+		{name: "underscore", tunnelID: "my_tunnel", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, nil)
+			rt.Config.CloudFlareTunnelID = tt.tunnelID
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			err := SyncDNS(rt, state)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SyncDNS error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				return
+			}
+			if !strings.Contains(err.Error(), "CLOUDFLARE_TUNNEL_ID") {
+				t.Errorf("error %q does not point at CLOUDFLARE_TUNNEL_ID", err)
+			}
+			if n := len(cf.requestsMatching(http.MethodGet, "")) + cf.writes(); n != 0 {
+				t.Errorf("made %d API requests, want none", n)
+			}
+		})
+	}
+}
+
+func TestSyncDNSDestructiveCooldown(t *testing.T) {
+	service := HostConfig{Service: "http://app.default.svc.cluster.local:80"}
+	tests := []struct {
+		name     string
+		cooldown string
+		// first and second are the hostnames of the two consecutive syncs;
+		// flap.example.com initially has a managed record.
+		first, second []string
+		// flapped is the hostname whose record is checked.
+		flapped    string
+		wantRecord bool
+	}{
+		{name: "create after delete is suppressed", cooldown: "1h", first: []string{"app.example.com"}, second: []string{"app.example.com", "flap.example.com"}, flapped: "flap.example.com", wantRecord: false},
+		{name: "create after delete without cooldown", cooldown: "", first: []string{"app.example.com"}, second: []string{"app.example.com", "flap.example.com"}, flapped: "flap.example.com", wantRecord: true},
+		{name: "delete after create is suppressed", cooldown: "1h", first: []string{"app.example.com", "new.example.com"}, second: []string{"app.example.com"}, flapped: "new.example.com", wantRecord: true},
+		{name: "delete after create without cooldown", cooldown: "", first: []string{"app.example.com", "new.example.com"}, second: []string{"app.example.com"}, flapped: "new.example.com", wantRecord: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"DESTRUCTIVE_COOLDOWN": tt.cooldown})
+			cf.addRecords(testZoneID, managedCNAME("rec-flap", "flap.example.com"))
+
+			if err := SyncDNS(rt, newState(service, tt.first...)); err != nil {
+				t.Fatalf("first SyncDNS: %v", err)
+			}
+			if err := SyncDNS(rt, newState(service, tt.second...)); err != nil {
+				t.Fatalf("second SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "CNAME", tt.flapped); ok != tt.wantRecord {
+				t.Errorf("%s present = %v, want %v", tt.flapped, ok, tt.wantRecord)
+			}
+		})
+	}
+}
+
+func TestSyncDNSDestructiveCooldownElapsed(t *testing.T) {
+	service := HostConfig{Service: "http://app.default.svc.cluster.local:80"}
+	rt, cf := newTestRuntime(t, map[string]string{"DESTRUCTIVE_COOLDOWN": "1h"})
+	cf.addRecords(testZoneID, managedCNAME("rec-flap", "flap.example.com"))
+
+	if err := SyncDNS(rt, newState(service, "app.example.com")); err != nil {
+		t.Fatalf("first SyncDNS: %v", err)
+	}
+	for key, op := range rt.RecentRecordOps {
+		op.At = op.At.Add(-time.Hour)
+		rt.RecentRecordOps[key] = op
+	}
+	if err := SyncDNS(rt, newState(service, "app.example.com", "flap.example.com")); err != nil {
+		t.Fatalf("second SyncDNS: %v", err)
+	}
+	if _, ok := cf.record(testZoneID, "CNAME", "flap.example.com"); !ok {
+		t.Errorf("record was not recreated after the cooldown elapsed")
+	}
+}
+
+func TestSyncDNSDuplicateRecordPolicy(t *testing.T) {
+	unmanaged := dnsRecord{ID: "rec-0", Type: "CNAME", Name: "app.example.com", Content: "elsewhere.example.net"}
+	tests := []struct {
+		name    string
+		policy  string
+		wantIDs []string
+	}{
+		{name: "default warns", policy: "", wantIDs: []string{"rec-0", "rec-a", "rec-b"}},
+		{name: "warn", policy: "warn", wantIDs: []string{"rec-0", "rec-a", "rec-b"}},
+		{name: "delete removes managed extras only", policy: "delete", wantIDs: []string{"rec-0", "rec-a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"DUPLICATE_RECORD_POLICY": tt.policy})
+			cf.addRecords(testZoneID, managedCNAME("rec-b", "app.example.com"), unmanaged, managedCNAME("rec-a", "app.example.com"))
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			var ids []string
+			for _, rec := range cf.recordsOf(testZoneID) {
+				ids = append(ids, rec.ID)
+			}
+			slices.Sort(ids)
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("records = %q, want %q", ids, tt.wantIDs)
+			}
+			if posts := cf.requestsMatching(http.MethodPost, "/dns_records"); len(posts) != 0 {
+				t.Errorf("created %d records, want none", len(posts))
+			}
+		})
+	}
+}
+
+func TestSyncDNSZoneProxiedDefaults(t *testing.T) {
+	no := false
+	tests := []struct {
+		name         string
+		proxied      *bool
+		wantPublic   bool
+		wantInternal bool
+	}{
+		{name: "zone defaults apply", proxied: nil, wantPublic: true, wantInternal: false},
+		{name: "annotation overrides zone defaults", proxied: &no, wantPublic: false, wantInternal: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"ZONE_PROXIED_DEFAULTS": `{"internal.example.org.":false}`})
+			cf.addZone("zone-internal", "internal.example.org")
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80", Proxied: tt.proxied}, "app.example.com", "app.internal.example.org")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			public, ok := cf.record(testZoneID, "CNAME", "app.example.com")
+			if !ok || public.Proxied != tt.wantPublic {
+				t.Errorf("public record %+v, want proxied %v", public, tt.wantPublic)
+			}
+			internal, ok := cf.record("zone-internal", "CNAME", "app.internal.example.org")
+			if !ok || internal.Proxied != tt.wantInternal {
+				t.Errorf("internal record %+v, want proxied %v", internal, tt.wantInternal)
+			}
+		})
+	}
+}
+
+func TestSyncDNSMXNSConflictPolicy(t *testing.T) {
+	mx := dnsRecord{ID: "rec-mx", Type: "MX", Name: "app.example.com", Content: "mail.example.com"}
+	ns := dnsRecord{ID: "rec-ns", Type: "NS", Name: "app.example.com", Content: "ns1.example.net"}
+	tests := []struct {
+		name      string
+		policy    string
+		existing  dnsRecord
+		wantCNAME bool
+	}{
+		{name: "MX skipped by default", policy: "", existing: mx, wantCNAME: false},
+		{name: "MX skipped", policy: "skip", existing: mx, wantCNAME: false},
+		{name: "NS skipped", policy: "skip", existing: ns, wantCNAME: false},
+		{name: "MX ignored", policy: "ignore", existing: mx, wantCNAME: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"MX_NS_CONFLICT_POLICY": tt.policy})
+			cf.addRecords(testZoneID, tt.existing)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); ok != tt.wantCNAME {
+				t.Errorf("CNAME created = %v, want %v", ok, tt.wantCNAME)
+			}
+			wantSkip := ""
+			if !tt.wantCNAME {
+				wantSkip = skipReasonMXorNS
+			}
+			if got := skipReason(rt, "app.example.com"); got != wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, wantSkip)
+			}
+			if _, ok := cf.record(testZoneID, tt.existing.Type, "app.example.com"); !ok {
+				t.Errorf("%s record was removed", tt.existing.Type)
+			}
+		})
+	}
+}
+
+func TestSyncDNSOtherTypeConflictPolicy(t *testing.T) {
+	txt := dnsRecord{ID: "rec-txt", Type: "TXT", Name: "app.example.com", Content: "v=spf1 -all"}
+	srv := dnsRecord{ID: "rec-srv", Type: "SRV", Name: "app.example.com", Content: "0 5 5060 sip.example.com"}
+	tests := []struct {
+		name      string
+		env       map[string]string
+		existing  dnsRecord
+		wantCNAME bool
+	}{
+		{name: "TXT skipped by default", existing: txt, wantCNAME: false},
+		{name: "TXT skipped", env: map[string]string{"OTHER_TYPE_CONFLICT_POLICY": "skip"}, existing: txt, wantCNAME: false},
+		{name: "SRV skipped", env: map[string]string{"OTHER_TYPE_CONFLICT_POLICY": "skip"}, existing: srv, wantCNAME: false},
+		{
+			name:      "SRV skipped with parallel listing",
+			env:       map[string]string{"OTHER_TYPE_CONFLICT_POLICY": "skip", "DNS_PARALLEL_LISTING": "true"},
+			existing:  srv,
+			wantCNAME: false,
+		},
+		{name: "TXT ignored", env: map[string]string{"OTHER_TYPE_CONFLICT_POLICY": "ignore"}, existing: txt, wantCNAME: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, tt.env)
+			var logs bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			cf.addRecords(testZoneID, tt.existing)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); ok != tt.wantCNAME {
+				t.Errorf("CNAME created = %v, want %v", ok, tt.wantCNAME)
+			}
+			wantSkip := ""
+			if !tt.wantCNAME {
+				wantSkip = skipReasonOtherType
+			}
+			if got := skipReason(rt, "app.example.com"); got != wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, wantSkip)
+			}
+			warned := strings.Contains(logs.String(), "records of other types exist for hostname") &&
+				strings.Contains(logs.String(), "types="+tt.existing.Type)
+			if warned == tt.wantCNAME {
+				t.Errorf("conflict warning logged = %v, want %v: %s", warned, !tt.wantCNAME, logs.String())
+			}
+			if _, ok := cf.record(testZoneID, tt.existing.Type, "app.example.com"); !ok {
+				t.Errorf("%s record was removed", tt.existing.Type)
+			}
+		})
+	}
+}
+
+func TestSyncDNSNoSpuriousUpdates(t *testing.T) {
+	notProxiable := false
+	tests := []struct {
+		name      string
+		env       map[string]string
+		record    func(rec dnsRecord) dnsRecord
+		wantPatch bool
+	}{
+		{name: "identical", record: func(rec dnsRecord) dnsRecord { return rec }},
+		{name: "trailing dot", record: func(rec dnsRecord) dnsRecord { rec.Content += "."; return rec }},
+		{name: "upper case", record: func(rec dnsRecord) dnsRecord { rec.Content = strings.ToUpper(rec.Content); return rec }},
+		{name: "name presentation", record: func(rec dnsRecord) dnsRecord { rec.Name = "App.Example.com."; return rec }},
+		{
+			name: "not proxiable reads back DNS-only",
+			env:  map[string]string{"CLOUDFLARE_DNS_TTL": "300"},
+			record: func(rec dnsRecord) dnsRecord {
+				rec.Proxied, rec.Proxiable, rec.TTL = false, &notProxiable, 300
+				return rec
+			},
+		},
+		{name: "other target", record: func(rec dnsRecord) dnsRecord { rec.Content = "other.cfargotunnel.com"; return rec }, wantPatch: true},
+		{name: "not proxied", record: func(rec dnsRecord) dnsRecord { rec.Proxied, rec.TTL = false, 300; return rec }, wantPatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, tt.env)
+			cf.addRecords(testZoneID, tt.record(managedCNAME("rec-app", "app.example.com")))
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if gotPatch := cf.writes() > 0; gotPatch != tt.wantPatch {
+				t.Errorf("record written = %v, want %v: %+v", gotPatch, tt.wantPatch, cf.requests)
+			}
+		})
+	}
+}
+
+func TestSyncDNSPageSize(t *testing.T) {
+	tests := []struct {
+		pageSize        string
+		wantZonesPage   string
+		wantRecordsPage string
+		wantRecordPages int
+	}{
+		{pageSize: "", wantZonesPage: "50", wantRecordsPage: "100", wantRecordPages: 1},
+		{pageSize: "5", wantZonesPage: "5", wantRecordsPage: "5", wantRecordPages: 3},
+		{pageSize: "1", wantZonesPage: "5", wantRecordsPage: "5", wantRecordPages: 3},
+		{pageSize: "200", wantZonesPage: "50", wantRecordsPage: "200", wantRecordPages: 1},
+		{pageSize: "10000", wantZonesPage: "50", wantRecordsPage: "5000", wantRecordPages: 1},
+	}
+	for _, tt := range tests {
+		t.Run("CLOUDFLARE_PAGE_SIZE="+tt.pageSize, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"CLOUDFLARE_PAGE_SIZE": tt.pageSize})
+			var hostnames []string
+			for i := range 12 {
+				hostname := fmt.Sprintf("app%d.example.com", i)
+				hostnames = append(hostnames, hostname)
+				cf.addRecords(testZoneID, managedCNAME(fmt.Sprintf("rec-%d", i), hostname))
+			}
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, hostnames...)
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			for _, req := range cf.requestsMatching(http.MethodGet, "/zones") {
+				want := tt.wantRecordsPage
+				if req.Path == "/zones" {
+					want = tt.wantZonesPage
+				}
+				if got := req.Query["per_page"]; got != want {
+					t.Errorf("GET %s per_page = %q, want %q", req.Path, got, want)
+				}
+			}
+			if got := len(cf.requestsMatching(http.MethodGet, "/dns_records")); got != tt.wantRecordPages {
+				t.Errorf("listed %d record pages, want %d", got, tt.wantRecordPages)
+			}
+			// All pages are read, so no record is created again.
+			if got := cf.writes(); got != 0 {
+				t.Errorf("made %d writes, want 0", got)
+			}
+		})
+	}
+}
+
+func TestDeleteDNSRecordAllowlist(t *testing.T) {
+	tests := []struct {
+		name        string
+		deletable   string
+		rec         dnsRecord
+		wantDeleted bool
+	}{
+		{name: "CNAME by default", rec: managedCNAME("rec-app", "app.example.com"), wantDeleted: true},
+		{name: "A never by default", rec: dnsRecord{ID: "rec-a", Type: "A", Name: "app.example.com", Content: "192.0.2.1"}},
+		{name: "AAAA never by default", rec: dnsRecord{ID: "rec-aaaa", Type: "AAAA", Name: "app.example.com", Content: "2001:db8::1"}},
+		{name: "TXT never by default", rec: managedTXT("rec-txt", "_verify.app.example.com", "verification=abc")},
+		{name: "TXT allowlisted", deletable: "cname,txt", rec: managedTXT("rec-txt", "_verify.app.example.com", "verification=abc"), wantDeleted: true},
+		{name: "CNAME not allowlisted", deletable: "TXT", rec: managedCNAME("rec-app", "app.example.com")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"DELETABLE_RECORD_TYPES": tt.deletable})
+			cf.addRecords(testZoneID, tt.rec)
+
+			deleted, err := deleteDNSRecord(rt, rt.Client.CloudFlareClient, testZoneID, tt.rec)
+			if err != nil {
+				t.Fatalf("deleteDNSRecord: %v", err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+			if got := len(cf.requestsMatching(http.MethodDelete, "/dns_records")); got != 0 && !tt.wantDeleted {
+				t.Errorf("sent %d DELETE requests for a non-deletable record", got)
+			}
+			if _, ok := cf.record(testZoneID, tt.rec.Type, tt.rec.Name); ok == tt.wantDeleted {
+				t.Errorf("record present = %v after deletion = %v", ok, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestSyncDNSStaleCNAMENotAllowlisted(t *testing.T) {
+	rt, cf := newTestRuntime(t, map[string]string{"DELETABLE_RECORD_TYPES": "TXT"})
+	cf.addRecords(testZoneID, managedCNAME("rec-old", "old.example.com"))
+
+	state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("SyncDNS: %v", err)
+	}
+
+	if _, ok := cf.record(testZoneID, "CNAME", "old.example.com"); !ok {
+		t.Errorf("stale CNAME deleted although CNAME is not in DELETABLE_RECORD_TYPES")
+	}
+	if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); !ok {
+		t.Errorf("desired CNAME not created")
+	}
+}
+
+func TestIsManagedCommentOwnerID(t *testing.T) {
+	tests := []struct {
+		ownerID string
+		comment string
+		want    bool
+	}{
+		{ownerID: "", comment: "managed by tunnel-manager", want: true},
+		{ownerID: "", comment: "managed by tunnel-manager (owner=b)", want: false},
+		{ownerID: "a", comment: "managed by tunnel-manager (owner=a)", want: true},
+		{ownerID: "a", comment: "managed by tunnel-manager (owner=a) svc=default/app", want: true},
+		{ownerID: "a", comment: "managed by tunnel-manager (owner=b)", want: false},
+		{ownerID: "a", comment: "managed by tunnel-manager (owner=ab)", want: false},
+		{ownerID: "a", comment: "managed by tunnel-manager", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ownerID+"/"+tt.comment, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, map[string]string{"OWNER_ID": tt.ownerID})
+			if got := isManagedComment(rt, tt.comment); got != tt.want {
+				t.Errorf("isManagedComment(%q) = %v, want %v", tt.comment, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncDNSOwnerID(t *testing.T) {
+	owned := func(id, name, owner string) dnsRecord {
+		rec := managedCNAME(id, name)
+		rec.Content = "other.cfargotunnel.com"
+		rec.Comment = "managed by tunnel-manager (owner=" + owner + ")"
+		return rec
+	}
+
+	rt, cf := newTestRuntime(t, map[string]string{"OWNER_ID": "a"})
+	cf.addRecords(testZoneID,
+		owned("rec-app-b", "app.example.com", "b"),
+		owned("rec-old-a", "old-a.example.com", "a"),
+		owned("rec-old-b", "old-b.example.com", "b"),
+	)
+
+	state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com", "new.example.com")
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("SyncDNS: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		wantPresent bool
+		wantContent string
+		wantComment string
+	}{
+		{name: "app.example.com", wantPresent: true, wantContent: "other.cfargotunnel.com", wantComment: "managed by tunnel-manager (owner=b)"},
+		{name: "new.example.com", wantPresent: true, wantContent: testTarget, wantComment: "managed by tunnel-manager (owner=a)"},
+		{name: "old-a.example.com", wantPresent: false},
+		{name: "old-b.example.com", wantPresent: true, wantContent: "other.cfargotunnel.com", wantComment: "managed by tunnel-manager (owner=b)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, ok := cf.record(testZoneID, "CNAME", tt.name)
+			if ok != tt.wantPresent {
+				t.Fatalf("record present = %v, want %v", ok, tt.wantPresent)
+			}
+			if rec.Content != tt.wantContent || rec.Comment != tt.wantComment {
+				t.Errorf("record = %q (%q), want %q (%q)", rec.Content, rec.Comment, tt.wantContent, tt.wantComment)
+			}
+		})
+	}
+	if got := skipReason(rt, "app.example.com"); got != skipReasonUnmanaged {
+		t.Errorf("app.example.com skip reason = %q, want %q", got, skipReasonUnmanaged)
+	}
+}
+
+func TestSyncDNSRetargetForeignTunnel(t *testing.T) {
+	const otherTarget = "00000000-0000-4000-8000-00000000000b.cfargotunnel.com"
+	tests := []struct {
+		name        string
+		retarget    string
+		content     string
+		wantContent string
+		wantWarning string
+	}{
+		{name: "retargeted by default", content: otherTarget, wantContent: testTarget, wantWarning: "retargeting it to the configured tunnel"},
+		{name: "retargeted", retarget: "true", content: otherTarget, wantContent: testTarget, wantWarning: "retargeting it to the configured tunnel"},
+		{name: "left untouched", retarget: "false", content: otherTarget, wantContent: otherTarget, wantWarning: "leaving untouched per RETARGET_FOREIGN_TUNNEL"},
+		{name: "non-tunnel target is always updated", retarget: "false", content: "origin.example.net", wantContent: testTarget},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"RETARGET_FOREIGN_TUNNEL": tt.retarget})
+			var buf bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+			rec := managedCNAME("rec-app", "app.example.com")
+			rec.Content = tt.content
+			cf.addRecords(testZoneID, rec)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if rec, _ := cf.record(testZoneID, "CNAME", "app.example.com"); rec.Content != tt.wantContent {
+				t.Errorf("CNAME content = %q, want %q", rec.Content, tt.wantContent)
+			}
+			if tt.wantWarning == "" {
+				if strings.Contains(buf.String(), "points to a different tunnel") {
+					t.Errorf("unexpected foreign tunnel warning: %s", buf.String())
+				}
+			} else if !strings.Contains(buf.String(), "level=WARN") || !strings.Contains(buf.String(), tt.wantWarning) {
+				t.Errorf("log %q does not warn %q", buf.String(), tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestSyncDNSMaxRecordAge(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxAge    string
+		modified  time.Duration // age of the record
+		wantPatch bool
+	}{
+		{name: "disabled", maxAge: "", modified: 30 * 24 * time.Hour, wantPatch: false},
+		{name: "younger than the max age", maxAge: "24h", modified: time.Hour, wantPatch: false},
+		{name: "older than the max age", maxAge: "24h", modified: 25 * time.Hour, wantPatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"MAX_RECORD_AGE": tt.maxAge})
+			rec := managedCNAME("rec-app", "app.example.com")
+			rec.ModifiedOn = time.Now().Add(-tt.modified)
+			cf.addRecords(testZoneID, rec)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			patches := cf.requestsMatching(http.MethodPatch, "/dns_records/rec-app")
+			if gotPatch := len(patches) > 0; gotPatch != tt.wantPatch {
+				t.Fatalf("record rewritten = %v, want %v", gotPatch, tt.wantPatch)
+			}
+			if !tt.wantPatch {
+				return
+			}
+			// A forced reconcile re-asserts all fields, not only the content.
+			body := patches[0].Body
+			for _, field := range []string{"content", "proxied", "ttl", "comment"} {
+				if _, ok := body[field]; !ok {
+					t.Errorf("PATCH body %v has no %s", body, field)
+				}
+			}
+			if updated, _ := cf.record(testZoneID, "CNAME", "app.example.com"); time.Since(updated.ModifiedOn) > time.Minute {
+				t.Errorf("record modification time not refreshed: %v", updated.ModifiedOn)
+			}
+		})
+	}
+}
+
+func TestRecordComment(t *testing.T) {
+	long := "default/" + strings.Repeat("a", 120) + ":80"
+	tests := []struct {
+		name    string
+		env     map[string]string
+		source  string
+		want    string
+		managed bool
+	}{
+		{name: "disabled", source: "default/app:80", want: "managed by tunnel-manager"},
+		{name: "with source", env: map[string]string{"COMMENT_INCLUDE_SOURCE": "true"}, source: "default/app:80", want: "managed by tunnel-manager svc=default/app:80"},
+		{name: "without source", env: map[string]string{"COMMENT_INCLUDE_SOURCE": "true"}, want: "managed by tunnel-manager"},
+		{
+			name:   "with owner and source",
+			env:    map[string]string{"COMMENT_INCLUDE_SOURCE": "true", "OWNER_ID": "prod"},
+			source: "default/app:80",
+			want:   "managed by tunnel-manager (owner=prod) svc=default/app:80",
+		},
+		{
+			name:   "truncated source",
+			env:    map[string]string{"COMMENT_INCLUDE_SOURCE": "true"},
+			source: long,
+			want:   ("managed by tunnel-manager svc=" + long)[:maxCommentLength],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, tt.env)
+			got := recordComment(rt, HostConfig{Source: tt.source})
+			if got != tt.want {
+				t.Errorf("recordComment = %q, want %q", got, tt.want)
+			}
+			if !isManagedComment(rt, got) {
+				t.Errorf("isManagedComment(%q) = false", got)
+			}
+			if stripped := stripManagedComment(rt, "note "+got); stripped != "note" {
+				t.Errorf("stripManagedComment = %q, want %q", stripped, "note")
+			}
+		})
+	}
+}
+
+func TestSyncDNSCommentIncludeSource(t *testing.T) {
+	rt, cf := newTestRuntime(t, map[string]string{"COMMENT_INCLUDE_SOURCE": "true"},
+		newNamespace("default"),
+		newService("default", "app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com,www.example.com"}),
+	)
+	// The source of an existing record is informational: a record created
+	// by another service, or before COMMENT_INCLUDE_SOURCE, is not rewritten.
+	www := managedCNAME("rec-www", "www.example.com")
+	www.Comment = "managed by tunnel-manager svc=default/old:8080"
+	cf.addRecords(testZoneID, www)
+
+	state, err := SyncKube(rt)
+	if err != nil {
+		t.Fatalf("SyncKube: %v", err)
+	}
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("SyncDNS: %v", err)
+	}
+
+	if rec, _ := cf.record(testZoneID, "CNAME", "app.example.com"); rec.Comment != "managed by tunnel-manager svc=default/app:80" {
+		t.Errorf("created record comment = %q", rec.Comment)
+	}
+	if got := len(cf.requestsMatching(http.MethodPatch, "/dns_records/rec-www")); got != 0 {
+		t.Errorf("existing record rewritten %d times for its source", got)
+	}
+}
+
+func TestSyncDNSHostnameRetries(t *testing.T) {
+	hostnameRetryDelay = time.Millisecond
+	t.Cleanup(func() { hostnameRetryDelay = time.Second })
+
+	tests := []struct {
+		name        string
+		retries     string
+		failures    int // failed creations before the API recovers
+		wantErr     bool
+		wantCreated int
+	}{
+		{name: "no retries", retries: "0", failures: 1, wantErr: true, wantCreated: 1},
+		{name: "fails once then succeeds", retries: "1", failures: 1, wantCreated: 2},
+		{name: "retries exhausted", retries: "1", failures: 2, wantErr: true, wantCreated: 1},
+	}
+	for _, tt := range tests {
+		for _, stream := range []string{"false", "true"} {
+			t.Run(tt.name+"/STREAM_ZONES="+stream, func(t *testing.T) {
+				rt, cf := newTestRuntime(t, map[string]string{"HOSTNAME_RETRIES": tt.retries, "STREAM_ZONES": stream})
+				cf.fail(http.MethodPost, "/dns_records", http.StatusInternalServerError, tt.failures)
+
+				state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "a.example.com", "b.example.com")
+				err := SyncDNS(rt, state)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("SyncDNS error = %v, want error %v", err, tt.wantErr)
+				}
+
+				if got := len(cf.recordsOf(testZoneID)); got != tt.wantCreated {
+					t.Errorf("created %d records, want %d", got, tt.wantCreated)
+				}
+				// Only the hostname whose creation failed is reported as
+				// failed, not the rest of its zone.
+				for _, hostname := range []string{"a.example.com", "b.example.com"} {
+					_, created := cf.record(testZoneID, "CNAME", hostname)
+					if _, failed := rt.Failed[hostname]; failed == created {
+						t.Errorf("%s created = %v and failed = %v: %v", hostname, created, failed, rt.Failed)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSyncDNSStreamZones(t *testing.T) {
+	tests := []struct {
+		stream string
+		// wantInterleaved is whether the records of the first page's zone
+		// are reconciled before the second page of zones is fetched.
+		wantInterleaved bool
+	}{
+		{stream: "false", wantInterleaved: false},
+		{stream: "true", wantInterleaved: true},
+	}
+	for _, tt := range tests {
+		t.Run("STREAM_ZONES="+tt.stream, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"STREAM_ZONES": tt.stream, "CLOUDFLARE_PAGE_SIZE": "5"})
+			// example.com is on the first page of zones, example5.org on
+			// the second.
+			for i := range 6 {
+				cf.addZone(fmt.Sprintf("zone-%d", i), fmt.Sprintf("example%d.org", i))
+			}
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com", "app.example5.org", "app.example.net")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); !ok {
+				t.Errorf("app.example.com not created")
+			}
+			if _, ok := cf.record("zone-5", "CNAME", "app.example5.org"); !ok {
+				t.Errorf("app.example5.org not created")
+			}
+			if got := skipReason(rt, "app.example.net"); got != skipReasonNoZone {
+				t.Errorf("app.example.net skip reason = %q, want %q", got, skipReasonNoZone)
+			}
+
+			var order []string
+			for _, req := range cf.requests {
+				switch {
+				case req.Path == "/zones":
+					order = append(order, "zones page "+req.Query["page"])
+				case strings.HasPrefix(req.Path, "/zones/"+testZoneID+"/dns_records") && req.Method == http.MethodGet:
+					order = append(order, "example.com records")
+				}
+			}
+			interleaved := slices.Index(order, "example.com records") < slices.Index(order, "zones page 2")
+			if interleaved != tt.wantInterleaved {
+				t.Errorf("request order %q, want interleaved %v", order, tt.wantInterleaved)
+			}
+		})
+	}
+}
+
+func TestSyncDNSStreamZonesSubdomainZone(t *testing.T) {
+	rt, cf := newTestRuntime(t, map[string]string{"STREAM_ZONES": "true", "CLOUDFLARE_PAGE_SIZE": "5"})
+	// example.com is on the first page of zones, its subdomain zone
+	// sub.example.com on the second.
+	for i := range 4 {
+		cf.addZone(fmt.Sprintf("zone-%d", i), fmt.Sprintf("example%d.org", i))
+	}
+	cf.addZone("zone-sub", "sub.example.com")
+
+	state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.sub.example.com")
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("SyncDNS: %v", err)
+	}
+
+	if _, ok := cf.record("zone-sub", "CNAME", "app.sub.example.com"); !ok {
+		t.Errorf("app.sub.example.com not created in sub.example.com")
+	}
+	if _, ok := cf.record(testZoneID, "CNAME", "app.sub.example.com"); ok {
+		t.Errorf("app.sub.example.com left in example.com")
+	}
+	if !rt.StreamZonesDisabled {
+		t.Errorf("StreamZonesDisabled = false, want true")
+	}
+	if len(rt.Skipped) != 0 {
+		t.Errorf("skipped = %v, want none", rt.Skipped)
+	}
+}
+
+func TestCheckZoneLayout(t *testing.T) {
+	tests := []struct {
+		name         string
+		stream       string
+		zones        []string
+		wantDisabled bool
+	}{
+		{name: "disjoint zones", stream: "true", zones: []string{"example.org"}},
+		{name: "subdomain zone", stream: "true", zones: []string{"sub.example.com"}, wantDisabled: true},
+		{name: "parent zone", stream: "true", zones: []string{"com"}, wantDisabled: true},
+		{name: "duplicate zone name", stream: "true", zones: []string{"Example.com."}, wantDisabled: true},
+		{name: "not streaming", stream: "false", zones: []string{"sub.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"STREAM_ZONES": tt.stream})
+			for i, name := range tt.zones {
+				cf.addZone(fmt.Sprintf("zone-%d", i), name)
+			}
+
+			if err := CheckZoneLayout(rt); err != nil {
+				t.Fatalf("CheckZoneLayout: %v", err)
+			}
+			if rt.StreamZonesDisabled != tt.wantDisabled {
+				t.Errorf("StreamZonesDisabled = %v, want %v", rt.StreamZonesDisabled, tt.wantDisabled)
+			}
+		})
+	}
+}
+
+func TestSyncDNSAdoptRecords(t *testing.T) {
+	handMade := dnsRecord{ID: "rec-app", Type: "CNAME", Name: "app.example.com", Content: testTarget, Comment: "hand-made", Proxied: false, TTL: 300}
+	otherTarget := handMade
+	otherTarget.Content = "origin.example.net"
+	otherOwner := handMade
+	otherOwner.Comment = "managed by tunnel-manager (owner=b)"
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		existing    dnsRecord
+		wantComment string
+		wantProxied bool
+		wantTTL     int
+		wantSkip    string
+	}{
+		{
+			name:        "disabled",
+			existing:    handMade,
+			wantComment: "hand-made",
+			wantTTL:     300,
+			wantSkip:    skipReasonUnmanaged,
+		},
+		{
+			name:        "marked only",
+			env:         map[string]string{"ADOPT_RECORDS": "true"},
+			existing:    handMade,
+			wantComment: "hand-made managed by tunnel-manager",
+			wantTTL:     300,
+		},
+		{
+			name:        "marked and corrected",
+			env:         map[string]string{"ADOPT_RECORDS": "true", "ADOPT_RECONCILE_SETTINGS": "true"},
+			existing:    handMade,
+			wantComment: "hand-made managed by tunnel-manager",
+			wantProxied: true,
+			wantTTL:     1,
+		},
+		{
+			name:        "other target",
+			env:         map[string]string{"ADOPT_RECORDS": "true", "ADOPT_RECONCILE_SETTINGS": "true"},
+			existing:    otherTarget,
+			wantComment: "hand-made",
+			wantTTL:     300,
+			wantSkip:    skipReasonUnmanaged,
+		},
+		{
+			name:        "other owner",
+			env:         map[string]string{"ADOPT_RECORDS": "true", "ADOPT_RECONCILE_SETTINGS": "true", "OWNER_ID": "a"},
+			existing:    otherOwner,
+			wantComment: "managed by tunnel-manager (owner=b)",
+			wantTTL:     300,
+			wantSkip:    skipReasonUnmanaged,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, tt.env)
+			cf.addRecords(testZoneID, tt.existing)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			rec, _ := cf.record(testZoneID, "CNAME", "app.example.com")
+			if rec.Comment != tt.wantComment || rec.Proxied != tt.wantProxied || rec.TTL != tt.wantTTL {
+				t.Errorf("record comment %q, proxied %v, TTL %d, want %q, %v, %d", rec.Comment, rec.Proxied, rec.TTL, tt.wantComment, tt.wantProxied, tt.wantTTL)
+			}
+			if rec.Content != tt.existing.Content {
+				t.Errorf("record content = %q, want %q", rec.Content, tt.existing.Content)
+			}
+			if got := skipReason(rt, "app.example.com"); got != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, tt.wantSkip)
+			}
+		})
+	}
+}
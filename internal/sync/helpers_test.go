@@ -0,0 +1,529 @@
+package sync
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tunnel/internal/client"
+	"tunnel/internal/config"
+	"tunnel/internal/runtime"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/option"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testAccountID = "0123456789abcdef0123456789abcdef"
+	testTunnelID  = "00000000-0000-4000-8000-000000000001"
+	testTarget    = testTunnelID + ".cfargotunnel.com"
+	testZoneID    = "zone-example"
+	testZoneName  = "example.com"
+)
+
+// testConfig loads a Config from the environment, with the Cloudflare
+// credentials set and env applied on top, so that tests run against the
+// same defaults as production.
+func testConfig(t *testing.T, env map[string]string) *config.Config {
+	t.Helper()
+
+	t.Setenv("CLOUDFLARE_ACCOUNT_ID", testAccountID)
+	t.Setenv("CLOUDFLARE_TUNNEL_ID", testTunnelID)
+	t.Setenv("CLOUDFLARE_API_TOKEN", "test-token")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	// LoadConfig parses the command line, which holds the test flags.
+	args := os.Args
+	os.Args = []string{"tunnel-manager"}
+	defer func() { os.Args = args }()
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+// newTestRuntime returns a runtime backed by a fake Kubernetes clientset
+// holding objects and by a fake Cloudflare API serving the example.com zone.
+func newTestRuntime(t *testing.T, env map[string]string, objects ...k8sruntime.Object) (*runtime.Runtime, *fakeCloudflare) {
+	t.Helper()
+
+	cf := newFakeCloudflare(t)
+	cf.addZone(testZoneID, testZoneName)
+
+	rt := &runtime.Runtime{
+		Ctx:    t.Context(),
+		Config: testConfig(t, env),
+		Client: &client.Client{
+			KubeClient: fake.NewClientset(objects...),
+			CloudFlareClient: cloudflare.NewClient(
+				option.WithBaseURL(cf.server.URL+"/"),
+				option.WithAPIToken("test-token"),
+				option.WithMaxRetries(0),
+			),
+			RequestCounter: client.NewRequestCounter(),
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	return rt, cf
+}
+
+// newService returns a Service in namespace with annotations and a single
+// TCP port.
+func newService(namespace, name string, port int32, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: map[string]string{"app": name},
+			Ports:    []corev1.ServicePort{{Name: "http", Port: port}},
+		},
+	}
+}
+
+// newNamespace returns a Namespace object.
+func newNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+// newState returns a SyncState mapping each hostname to host.
+func newState(host HostConfig, hostnames ...string) *SyncState {
+	state := NewSyncState()
+	for _, hostname := range hostnames {
+		state.Hosts[hostname] = host
+	}
+	return state
+}
+
+// managedCNAME returns a CNAME to the test tunnel marked as managed with
+// the default MANAGED_COMMENT_MARKER.
+func managedCNAME(id, name string) dnsRecord {
+	return dnsRecord{ID: id, Type: "CNAME", Name: name, Content: testTarget, Comment: "managed by tunnel-manager", Proxied: true, TTL: 1}
+}
+
+// skipReason returns the reason hostname was skipped during the sync, or ""
+// if it was not.
+func skipReason(rt *runtime.Runtime, hostname string) string {
+	for _, item := range rt.Skipped {
+		if item.Hostname == hostname {
+			return item.Reason
+		}
+	}
+	return ""
+}
+
+// fakeRequest is a request received by fakeCloudflare.
+type fakeRequest struct {
+	Method string
+	Path   string
+	Query  map[string]string
+	Body   map[string]any
+}
+
+// fakeFailure makes fakeCloudflare answer requests whose method matches and
+// whose path contains path with an error status, the next times requests
+// (all of them if times is zero).
+type fakeFailure struct {
+	method  string
+	path    string
+	status  int
+	times   int
+	forever bool
+}
+
+// fakeCloudflare is an in-memory stand-in for the parts of the Cloudflare
+// API used by this package.
+type fakeCloudflare struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       gosync.Mutex
+	zones    []zoneSummary
+	records  map[string][]dnsRecord // zone ID -> records
+	nextID   int
+	requests []fakeRequest
+	failures []*fakeFailure
+	// ignoreFilters makes DNS record listings ignore all filters, like an
+	// API that does not support them.
+	ignoreFilters bool
+	// frozen holds the records listed instead of the current ones, like a
+	// lagging eventually consistent API, see freezeListings.
+	frozen map[string][]dnsRecord // zone ID -> records
+	// latency delays every response, so that concurrent requests overlap;
+	// maxInFlight is the highest number of requests seen at once.
+	latency     time.Duration
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+
+	tunnelName      string
+	tunnelDeletedAt *string
+	tunnelConfig    map[string]any
+	redirectRules   map[string][]any // zone ID -> rules
+	tokenPolicies   []string         // permission group names
+}
+
+func newFakeCloudflare(t *testing.T) *fakeCloudflare {
+	f := &fakeCloudflare{
+		t:             t,
+		records:       make(map[string][]dnsRecord),
+		redirectRules: make(map[string][]any),
+		tunnelName:    "test-tunnel",
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeCloudflare) addZone(id, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.zones = append(f.zones, zoneSummary{ID: id, Name: name})
+}
+
+// addRecords stores records in zoneID, setting their modification time to
+// now unless set.
+func (f *fakeCloudflare) addRecords(zoneID string, records ...dnsRecord) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rec := range records {
+		if rec.ModifiedOn.IsZero() {
+			rec.ModifiedOn = time.Now()
+		}
+		f.records[zoneID] = append(f.records[zoneID], rec)
+	}
+}
+
+// fail registers a failure, see fakeFailure.
+func (f *fakeCloudflare) fail(method, path string, status, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, &fakeFailure{method: method, path: path, status: status, times: times, forever: times == 0})
+}
+
+// freezeListings makes DNS record listings return the current records until
+// the end of the test, ignoring later writes.
+func (f *fakeCloudflare) freezeListings() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.frozen = make(map[string][]dnsRecord)
+	for zoneID, records := range f.records {
+		f.frozen[zoneID] = slices.Clone(records)
+	}
+}
+
+// recordsOf returns a copy of the records of zoneID.
+func (f *fakeCloudflare) recordsOf(zoneID string) []dnsRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.records[zoneID])
+}
+
+// record returns the record of zoneID named name with type typ.
+func (f *fakeCloudflare) record(zoneID, typ, name string) (dnsRecord, bool) {
+	for _, rec := range f.recordsOf(zoneID) {
+		if rec.Type == typ && equalDNSHost(rec.Name, name) {
+			return rec, true
+		}
+	}
+	return dnsRecord{}, false
+}
+
+// requestsMatching returns the requests received with method whose path
+// contains path.
+func (f *fakeCloudflare) requestsMatching(method, path string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var matched []fakeRequest
+	for _, req := range f.requests {
+		if req.Method == method && strings.Contains(req.Path, path) {
+			matched = append(matched, req)
+		}
+	}
+	return matched
+}
+
+// writes returns the number of requests received that modify state.
+func (f *fakeCloudflare) writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, req := range f.requests {
+		if req.Method != http.MethodGet {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeCloudflare) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		peak := f.maxInFlight.Load()
+		if n <= peak || f.maxInFlight.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(f.latency)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	req := fakeRequest{Method: r.Method, Path: r.URL.Path, Query: make(map[string]string)}
+	for key := range r.URL.Query() {
+		req.Query[key] = r.URL.Query().Get(key)
+	}
+	if r.Body != nil {
+		data, _ := io.ReadAll(r.Body)
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &req.Body); err != nil {
+				f.t.Errorf("fake cloudflare: invalid JSON body for %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		}
+	}
+	f.requests = append(f.requests, req)
+
+	for _, failure := range f.failures {
+		if failure.method != r.Method || !strings.Contains(r.URL.Path, failure.path) {
+			continue
+		}
+		if !failure.forever {
+			if failure.times == 0 {
+				continue
+			}
+			failure.times--
+		}
+		writeError(w, failure.status)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/zones":
+		f.listZones(w, req)
+	case len(segments) == 3 && segments[0] == "zones" && segments[2] == "dns_records":
+		switch r.Method {
+		case http.MethodGet:
+			f.listRecords(w, segments[1], req)
+		case http.MethodPost:
+			f.createRecord(w, segments[1], req.Body)
+		default:
+			writeError(w, http.StatusMethodNotAllowed)
+		}
+	case len(segments) == 4 && segments[0] == "zones" && segments[2] == "dns_records":
+		switch r.Method {
+		case http.MethodPatch:
+			f.patchRecord(w, segments[1], segments[3], req.Body)
+		case http.MethodDelete:
+			f.deleteRecord(w, segments[1], segments[3])
+		default:
+			writeError(w, http.StatusMethodNotAllowed)
+		}
+	case len(segments) == 6 && segments[0] == "zones" && segments[2] == "rulesets":
+		f.serveRedirectRules(w, r.Method, segments[1], req.Body)
+	case len(segments) == 5 && segments[0] == "accounts" && segments[2] == "cfd_tunnel" && segments[4] == "configurations":
+		if r.Method != http.MethodPut {
+			writeError(w, http.StatusMethodNotAllowed)
+			return
+		}
+		f.tunnelConfig = req.Body
+		writeResult(w, req.Body)
+	case len(segments) == 4 && segments[0] == "accounts" && segments[2] == "cfd_tunnel":
+		if r.Method == http.MethodPatch {
+			f.tunnelName, _ = req.Body["name"].(string)
+		}
+		writeResult(w, map[string]any{"id": segments[3], "name": f.tunnelName, "deleted_at": f.tunnelDeletedAt})
+	case r.Method == http.MethodGet && r.URL.Path == "/user/tokens/verify":
+		writeResult(w, map[string]any{"id": "token-id", "status": "active"})
+	case r.Method == http.MethodGet && r.URL.Path == "/user/tokens/token-id":
+		var groups []map[string]any
+		for _, name := range f.tokenPolicies {
+			groups = append(groups, map[string]any{"name": name})
+		}
+		writeResult(w, map[string]any{"policies": []map[string]any{{"effect": "allow", "permission_groups": groups}}})
+	default:
+		writeError(w, http.StatusNotFound)
+	}
+}
+
+func (f *fakeCloudflare) listZones(w http.ResponseWriter, req fakeRequest) {
+	var zones []any
+	for _, z := range f.zones {
+		zones = append(zones, z)
+	}
+	writePage(w, zones, req)
+}
+
+func (f *fakeCloudflare) listRecords(w http.ResponseWriter, zoneID string, req fakeRequest) {
+	listed := f.records[zoneID]
+	if f.frozen != nil {
+		listed = f.frozen[zoneID]
+	}
+	var records []any
+	for _, rec := range listed {
+		if !f.ignoreFilters {
+			if typ, ok := req.Query["type"]; ok && rec.Type != typ {
+				continue
+			}
+			if name, ok := req.Query["name"]; ok && !equalDNSHost(rec.Name, name) {
+				continue
+			}
+			if comment, ok := req.Query["comment.contains"]; ok && !strings.Contains(rec.Comment, comment) {
+				continue
+			}
+		}
+		records = append(records, rec)
+	}
+	writePage(w, records, req)
+}
+
+func (f *fakeCloudflare) createRecord(w http.ResponseWriter, zoneID string, body map[string]any) {
+	f.nextID++
+	rec := dnsRecord{ID: "created-" + strconv.Itoa(f.nextID), ModifiedOn: time.Now()}
+	rec.Type, _ = body["type"].(string)
+	rec.Name = f.absoluteName(zoneID, body["name"])
+	rec.Content, _ = body["content"].(string)
+	rec.Comment, _ = body["comment"].(string)
+	rec.Proxied, _ = body["proxied"].(bool)
+	if ttl, ok := body["ttl"].(float64); ok {
+		rec.TTL = int(ttl)
+	}
+	f.records[zoneID] = append(f.records[zoneID], rec)
+	writeResult(w, rec)
+}
+
+func (f *fakeCloudflare) patchRecord(w http.ResponseWriter, zoneID, id string, body map[string]any) {
+	for i, rec := range f.records[zoneID] {
+		if rec.ID != id {
+			continue
+		}
+		if v, ok := body["content"].(string); ok {
+			rec.Content = v
+		}
+		if v, ok := body["comment"].(string); ok {
+			rec.Comment = v
+		}
+		if v, ok := body["proxied"].(bool); ok {
+			rec.Proxied = v
+		}
+		if v, ok := body["ttl"].(float64); ok {
+			rec.TTL = int(v)
+		}
+		rec.ModifiedOn = time.Now()
+		f.records[zoneID][i] = rec
+		writeResult(w, rec)
+		return
+	}
+	writeError(w, http.StatusNotFound)
+}
+
+func (f *fakeCloudflare) deleteRecord(w http.ResponseWriter, zoneID, id string) {
+	for i, rec := range f.records[zoneID] {
+		if rec.ID == id {
+			f.records[zoneID] = slices.Delete(f.records[zoneID], i, i+1)
+			writeResult(w, map[string]any{"id": id})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound)
+}
+
+func (f *fakeCloudflare) serveRedirectRules(w http.ResponseWriter, method, zoneID string, body map[string]any) {
+	switch method {
+	case http.MethodGet:
+		rules, ok := f.redirectRules[zoneID]
+		if !ok {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		writeResult(w, map[string]any{"rules": rules})
+	case http.MethodPut:
+		rules, _ := body["rules"].([]any)
+		f.redirectRules[zoneID] = rules
+		writeResult(w, map[string]any{"rules": rules})
+	default:
+		writeError(w, http.StatusMethodNotAllowed)
+	}
+}
+
+// absoluteName expands a relative record name the way Cloudflare does.
+func (f *fakeCloudflare) absoluteName(zoneID string, name any) string {
+	s, _ := name.(string)
+	for _, z := range f.zones {
+		if z.ID != zoneID {
+			continue
+		}
+		switch {
+		case s == "@":
+			return z.Name
+		case s == z.Name || strings.HasSuffix(s, "."+z.Name):
+			return s
+		default:
+			return s + "." + z.Name
+		}
+	}
+	return s
+}
+
+func writeResult(w http.ResponseWriter, result any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "errors": []any{}, "result": result})
+}
+
+func writeError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": false,
+		"errors":  []any{map[string]any{"code": status, "message": http.StatusText(status)}},
+	})
+}
+
+// writePage writes the page of items requested by the page and per_page
+// query parameters.
+func writePage(w http.ResponseWriter, items []any, req fakeRequest) {
+	page, _ := strconv.Atoi(req.Query["page"])
+	perPage, _ := strconv.Atoi(req.Query["per_page"])
+	page, perPage = max(page, 1), max(perPage, 1)
+	totalPages := (len(items) + perPage - 1) / perPage
+
+	start := min((page-1)*perPage, len(items))
+	end := min(start+perPage, len(items))
+	result := items[start:end]
+	if result == nil {
+		result = []any{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"errors":  []any{},
+		"result":  result,
+		"result_info": map[string]any{
+			"page":        page,
+			"per_page":    perPage,
+			"total_pages": totalPages,
+			"total_count": len(items),
+		},
+	})
+}
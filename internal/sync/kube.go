@@ -1,116 +1,324 @@
 package sync
 
 import (
+	"cmp"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"tunnel/internal/runtime"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // SyncKube reads Kubernetes services and constructs desired SyncState.
 func SyncKube(runtime *runtime.Runtime) (*SyncState, error) {
-	runtime.Logger.Info("start reading kube state")
+	logger := runtime.LoggerFor(moduleKube)
+	logger.Info("start reading kube state")
 	newState := NewSyncState()
 
-	namespacesList, err := runtime.Client.KubeClient.CoreV1().Namespaces().List(runtime.Ctx, metav1.ListOptions{})
+	namespaces, err := listNamespaces(runtime)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+		return nil, err
 	}
 
-	var namespaces []string
-	for _, ns := range namespacesList.Items {
-		namespaces = append(namespaces, ns.Name)
-	}
-	sort.Strings(namespaces)
-	runtime.Logger.Debug("read namespaces", slog.String("namespaces", strings.Join(namespaces, ", ")))
-
 	for _, namespace := range namespaces {
-		runtime.Logger.Debug("traversing namespace", slog.String("namespace", namespace))
-		svcList, err := runtime.Client.KubeClient.CoreV1().Services(namespace).List(runtime.Ctx, metav1.ListOptions{})
+		logger.Debug("traversing namespace", slog.String("namespace", namespace))
+		svcList, err := runtime.Client.KubeClient.CoreV1().Services(namespace).List(runtime.Ctx, metav1.ListOptions{
+			LabelSelector: runtime.Config.ServiceLabelSelector,
+		})
 		if err != nil {
-			runtime.Logger.Warn("failed to read services in namespace", slog.String("namespace", namespace), slog.String("error", err.Error()))
+			logger.Warn("failed to read services in namespace", slog.String("namespace", namespace), slog.String("error", err.Error()))
 			continue
 		}
 
 		for _, svc := range svcList.Items {
-			runtime.Logger.Debug("traversing service", slog.String("namespace", namespace), slog.String("service", svc.Name))
+			logger.Debug("traversing service", slog.String("namespace", namespace), slog.String("service", svc.Name))
 			hostnamesStr, ok := svc.Annotations[runtime.Config.ServiceHostnamesAnnotation]
 			if !ok || strings.TrimSpace(hostnamesStr) == "" {
-				runtime.Logger.Debug("traversing service: missing hostnames annotation, skipping", slog.String("namespace", namespace), slog.String("service", svc.Name))
+				logger.Debug("traversing service: missing hostnames annotation, skipping", slog.String("namespace", namespace), slog.String("service", svc.Name))
 				continue
 			}
 
-			// Determine upstream port:
-			// 1) Check SERVICE_UPSTREAM_PORT_LABEL (default: cloudflare-tunnel-upstream-port)
-			// 2) Fall back to first exposed port
-			// 3) If none -> skip service with warning
-			port := chooseServicePort(runtime, &svc)
-			if port == 0 {
-				runtime.Logger.Info("service has no usable port; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name))
+			host := HostConfig{
+				DNSOnly:        chooseBoolAnnotation(runtime, &svc, runtime.Config.ServiceDNSOnlyAnnotation),
+				IngressOnly:    chooseBoolAnnotation(runtime, &svc, runtime.Config.ServiceIngressOnlyAnnotation),
+				Recreate:       chooseBoolAnnotation(runtime, &svc, runtime.Config.ServiceRecreateAnnotation),
+				ServiceType:    string(svc.Spec.Type),
+				Source:         namespace + "/" + svc.Name,
+				TLSPassthrough: chooseBoolAnnotation(runtime, &svc, runtime.Config.ServicePassthroughAnnotation),
+			}
+			if host.ServiceType == "" {
+				host.ServiceType = string(corev1.ServiceTypeClusterIP)
+			}
+			host.Proxied = chooseOptionalBoolAnnotation(runtime, &svc, runtime.Config.ServiceProxiedAnnotation)
+			if raw := svc.Annotations[runtime.Config.ServiceTXTAnnotation]; raw != "" {
+				if err := validateTXTContent(raw); err != nil {
+					logger.Warn("service has invalid TXT annotation; ignoring it", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.String("error", err.Error()))
+				} else if !slices.Contains(runtime.Config.DeletableRecordTypes, "TXT") {
+					// A TXT record that could never be deleted would outlive
+					// the service.
+					logger.Warn("service has TXT annotation but TXT is not in DELETABLE_RECORD_TYPES; ignoring it", slog.String("namespace", namespace), slog.String("service", svc.Name))
+				} else {
+					host.TXT = raw
+				}
+			}
+			originRequest, err := chooseMTLSOriginRequest(runtime, &svc)
+			if err != nil {
+				logger.Warn("service has invalid mTLS annotations; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.String("error", err.Error()))
+				skipService(runtime, namespace, svc.Name, "", skipReasonInvalidMTLS)
+				continue
+			}
+			if chooseBoolAnnotation(runtime, &svc, runtime.Config.ServiceNoTLSVerifyAnnotation) {
+				if originRequest == nil {
+					originRequest = make(map[string]any)
+				}
+				originRequest["noTLSVerify"] = true
+			}
+			host.OriginRequest = originRequest
+			if host.DNSOnly && host.IngressOnly {
+				logger.Warn("service has both dns-only and ingress-only annotations set; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name))
+				skipService(runtime, namespace, svc.Name, "", skipReasonDNSAndIngressOnly)
+				continue
+			}
+			redirectTo, err := chooseRedirectTarget(runtime, &svc)
+			if err != nil {
+				logger.Warn("service has invalid redirect annotation; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.String("error", err.Error()))
+				skipService(runtime, namespace, svc.Name, "", skipReasonInvalidRedirect)
+				continue
+			}
+			// A passthrough hostname needs an ingress rule to the service, a
+			// proxied CNAME (a DNS-only CNAME to the tunnel does not resolve)
+			// and no origin TLS settings (mTLS, noTLSVerify), since TLS is not
+			// terminated by cloudflared.
+			if host.TLSPassthrough && (host.DNSOnly || redirectTo != "" || len(host.OriginRequest) > 0 || (host.Proxied != nil && !*host.Proxied)) {
+				logger.Warn("service has tls-passthrough annotation combined with dns-only, redirect, proxied=false or origin TLS annotations; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name))
+				skipService(runtime, namespace, svc.Name, "", skipReasonTLSPassthrough)
 				continue
 			}
+			if redirectTo != "" {
+				host.RedirectTo = redirectTo
+			} else {
+				// Services without a selector rely on manually managed
+				// endpoints, which may not exist.
+				if runtime.Config.RequireSelectorlessEndpoints && len(svc.Spec.Selector) == 0 {
+					ok, err := hasEndpoints(runtime, &svc)
+					if err != nil {
+						logger.Warn("failed to read endpoints of selector-less service; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.String("error", err.Error()))
+						skipService(runtime, namespace, svc.Name, "", skipReasonEndpointsError)
+						continue
+					}
+					if !ok {
+						logger.Info("selector-less service has no endpoints; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name))
+						skipService(runtime, namespace, svc.Name, "", skipReasonNoEndpoints)
+						continue
+					}
+				}
 
-			serviceFQDN := fmt.Sprintf("%s.%s.svc.cluster.local", svc.Name, namespace)
-			serviceURL := fmt.Sprintf("http://%s:%d", serviceFQDN, port)
+				// Determine upstream port:
+				// 1) Check SERVICE_UPSTREAM_PORT_LABEL (default: cloudflare-tunnel-upstream-port)
+				// 2) Fall back to lowest exposed port, unless REQUIRE_PORT_ANNOTATION
+				// 3) If none -> skip service with warning
+				if runtime.Config.RequirePortAnnotation {
+					raw := svc.Annotations[runtime.Config.ServiceUpstreamPortAnnotation]
+					if strings.TrimSpace(raw) == "" {
+						logger.Warn("service has no upstream port annotation; skipping per REQUIRE_PORT_ANNOTATION", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.String("annotation", runtime.Config.ServiceUpstreamPortAnnotation))
+						skipService(runtime, namespace, svc.Name, "", skipReasonNoPortAnnotation)
+						continue
+					}
+					if _, ok := parsePortAnnotation(raw); !ok {
+						logger.Warn("service has invalid upstream port annotation; skipping per REQUIRE_PORT_ANNOTATION", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.String("annotation", runtime.Config.ServiceUpstreamPortAnnotation), slog.String("invalidValue", strings.TrimSpace(raw)))
+						skipService(runtime, namespace, svc.Name, "", skipReasonBadPortAnnotation)
+						continue
+					}
+				}
+				port := chooseServicePort(runtime, &svc)
+				if port == 0 {
+					logger.Info("service has no usable port; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name))
+					skipService(runtime, namespace, svc.Name, "", skipReasonNoPort)
+					continue
+				}
+
+				serviceFQDN := fmt.Sprintf("%s.%s.svc.cluster.local", svc.Name, namespace)
+				scheme := chooseServiceScheme(runtime, &svc, port)
+				if host.TLSPassthrough {
+					scheme = "tcp"
+				}
+				serviceURL, err := buildServiceURL(runtime, scheme, serviceFQDN, port)
+				if err != nil {
+					logger.Warn("service produces an invalid service URL; skipping", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.String("error", err.Error()))
+					skipService(runtime, namespace, svc.Name, "", skipReasonInvalidURL)
+					continue
+				}
+				host.Service = serviceURL
+				host.Source += ":" + strconv.Itoa(int(port))
+			}
 
 			// Domains may be comma- and/or space-separated.
 			raw := strings.ReplaceAll(hostnamesStr, ",", " ")
 			rawDomains := strings.Fields(raw)
+			if runtime.Config.FailServiceOnAnyConflict {
+				if conflict := firstConflict(newState, rawDomains); conflict != "" {
+					logger.Warn("service has a conflicting hostname; skipping all of its hostnames per FAIL_SERVICE_ON_ANY_CONFLICT", slog.String("namespace", namespace), slog.String("service", svc.Name), hostnameAttr(runtime, conflict, ""), slog.String("existingService", newState.Hosts[conflict].Service))
+					skipService(runtime, namespace, svc.Name, conflict, skipReasonConflict)
+					continue
+				}
+			}
+			mapped := 0
 			for _, d := range rawDomains {
 				hostname := strings.TrimSpace(d)
 				if hostname == "" {
 					continue
 				}
 
-				runtime.Logger.Info("mapping hostname to service", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.String("hostname", hostname), slog.String("serviceURL", serviceURL))
-				err := newState.Append(hostname, serviceURL)
+				logger.Info("mapping hostname to service", slog.String("namespace", namespace), slog.String("service", svc.Name), hostnameAttr(runtime, hostname, ""), slog.String("serviceURL", host.Service), redirectAttr(runtime, host.RedirectTo))
+				err := newState.Append(hostname, host)
 				if err != nil {
-					runtime.Logger.Warn("failed to map hostname to service; skipping", slog.String("hostname", hostname), slog.String("service", serviceURL), slog.String("error", err.Error()))
+					logger.Warn("failed to map hostname to service; skipping", hostnameAttr(runtime, hostname, ""), slog.String("service", host.Service), slog.String("error", err.Error()))
+					skipService(runtime, namespace, svc.Name, hostname, skipReasonConflict)
+					continue
+				}
+				// A hostname excluded from both DNS and the tunnel by pattern
+				// contributes nothing.
+				hostNorm := normalizeHost(hostname)
+				if matchesAnyPattern(runtime.Config.DNSHostnameExclude, hostNorm) && matchesAnyPattern(runtime.Config.TunnelHostnameExclude, hostNorm) {
 					continue
 				}
+				mapped++
+			}
+			if mapped == 0 {
+				logger.Warn("service has hostnames annotated but none of them were mapped", slog.String("namespace", namespace), slog.String("service", svc.Name), slog.Int("annotated", len(rawDomains)))
 			}
 		}
 	}
-	runtime.Logger.Info("stop reading kube state", slog.Int("len", len(newState.HostToService)))
+	detectMoves(runtime, newState)
+	logger.Info("stop reading kube state", slog.Int("len", newState.Len()))
 	return newState, nil
 }
 
+// firstConflict returns the first of hostnames that is already present in
+// state, or "" if there is none.
+func firstConflict(state *SyncState, hostnames []string) string {
+	for _, hostname := range hostnames {
+		if _, exists := state.Hosts[hostname]; exists {
+			return hostname
+		}
+	}
+	return ""
+}
+
+// chooseMTLSOriginRequest returns the originRequest settings for mutual TLS
+// to the origin, from the CA pool, client certificate and client key
+// annotations. These reference files mounted into cloudflared, which are
+// expected to be mounted at the same paths here so that they can be
+// validated. Returns nil if none of the annotations is set.
+func chooseMTLSOriginRequest(runtime *runtime.Runtime, svc *corev1.Service) (map[string]any, error) {
+	fields := []struct {
+		key        string
+		annotation string
+	}{
+		{"caPool", runtime.Config.ServiceCAPoolAnnotation},
+		{"clientCert", runtime.Config.ServiceClientCertAnnotation},
+		{"clientKey", runtime.Config.ServiceClientKeyAnnotation},
+	}
+
+	var originRequest map[string]any
+	for _, f := range fields {
+		path := strings.TrimSpace(svc.Annotations[f.annotation])
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.annotation, err)
+		}
+		if originRequest == nil {
+			originRequest = make(map[string]any)
+		}
+		originRequest[f.key] = path
+	}
+
+	if (originRequest["clientCert"] == nil) != (originRequest["clientKey"] == nil) {
+		return nil, fmt.Errorf("%s and %s must be set together", runtime.Config.ServiceClientCertAnnotation, runtime.Config.ServiceClientKeyAnnotation)
+	}
+	return originRequest, nil
+}
+
+// listNamespaces returns the namespaces to read services from: those in
+// NAMESPACES that exist, or all namespaces if NAMESPACES is empty, except
+// those in EXCLUDE_NAMESPACES.
+func listNamespaces(runtime *runtime.Runtime) ([]string, error) {
+	logger := runtime.LoggerFor(moduleKube)
+
+	var namespaces []string
+	if len(runtime.Config.Namespaces) > 0 {
+		logger.Debug("reading namespaces from NAMESPACES allowlist")
+		// LoadConfig rejects namespaces that are also in EXCLUDE_NAMESPACES.
+		for _, ns := range runtime.Config.Namespaces {
+			_, err := runtime.Client.KubeClient.CoreV1().Namespaces().Get(runtime.Ctx, ns, metav1.GetOptions{})
+			if err != nil {
+				logger.Warn("failed to read namespace from NAMESPACES; skipping", slog.String("namespace", ns), slog.String("error", err.Error()))
+				continue
+			}
+			namespaces = append(namespaces, ns)
+		}
+	} else {
+		logger.Debug("reading all namespaces")
+		namespacesList, err := runtime.Client.KubeClient.CoreV1().Namespaces().List(runtime.Ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list namespaces: %w", err)
+		}
+		for _, ns := range namespacesList.Items {
+			if slices.Contains(runtime.Config.ExcludeNamespaces, ns.Name) {
+				logger.Debug("namespace is in EXCLUDE_NAMESPACES; skipping", slog.String("namespace", ns.Name))
+				continue
+			}
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+
+	sort.Strings(namespaces)
+	logger.Debug("read namespaces", slog.String("namespaces", strings.Join(namespaces, ", ")))
+	return namespaces, nil
+}
+
 // chooseServicePort:
 // - If svc has SERVICE_UPSTREAM_PORT_LABEL and it parses as a valid port, use it.
-// - Else use the first exposed port from spec.ports.
+// - Else use the lowest exposed port from spec.ports.
 // - If no ports at all, return 0 (caller will skip service and log warning).
 func chooseServicePort(runtime *runtime.Runtime, svc *corev1.Service) int32 {
+	logger := runtime.LoggerFor(moduleKube)
 	// 1) Try label
 	if raw, ok := svc.Annotations[runtime.Config.ServiceUpstreamPortAnnotation]; ok && strings.TrimSpace(raw) != "" {
-		raw = strings.TrimSpace(raw)
-		val, err := strconv.Atoi(raw)
-		if err != nil || val <= 0 || val > 65535 {
-			runtime.Logger.Warn("service has invalid port annotation; falling back to first exposed port",
+		if val, ok := parsePortAnnotation(raw); ok {
+			logger.Debug("service has port annotation; using it as upstream port",
 				slog.String("namespace", svc.Namespace),
 				slog.String("service", svc.Name),
 				slog.String("annotation", runtime.Config.ServiceUpstreamPortAnnotation),
-				slog.String("invalidValue", raw),
+				slog.Int("value", int(val)),
 			)
+			return val
 		}
 
-		runtime.Logger.Debug("service has port annotation; using it as upstream port",
+		logger.Warn("service has invalid port annotation; falling back to lowest exposed port",
 			slog.String("namespace", svc.Namespace),
 			slog.String("service", svc.Name),
 			slog.String("annotation", runtime.Config.ServiceUpstreamPortAnnotation),
-			slog.Int("value", int(val)),
+			slog.String("invalidValue", strings.TrimSpace(raw)),
 		)
-		return int32(val)
 	}
 
-	// 2) Fall back to first exposed port
+	// 2) Fall back to the lowest exposed port, ties broken by name, so the
+	// choice does not depend on the order of the ports in the spec
 	if len(svc.Spec.Ports) > 0 {
-		port := svc.Spec.Ports[0].Port
-		runtime.Logger.Debug("service has no port annotation; falling back to first exposed port",
+		port := lowestServicePort(svc.Spec.Ports).Port
+		logger.Debug("service has no port annotation; falling back to lowest exposed port",
 			slog.String("namespace", svc.Namespace),
 			slog.String("service", svc.Name),
 			slog.String("annotation", runtime.Config.ServiceUpstreamPortAnnotation),
@@ -120,7 +328,7 @@ func chooseServicePort(runtime *runtime.Runtime, svc *corev1.Service) int32 {
 	}
 
 	// 3) No ports at all → skip
-	runtime.Logger.Warn("service has no ports; cannot determine upstream port",
+	logger.Warn("service has no ports; cannot determine upstream port",
 		slog.String("namespace", svc.Namespace),
 		slog.String("service", svc.Name),
 		slog.String("annotation", runtime.Config.ServiceUpstreamPortAnnotation),
@@ -128,3 +336,174 @@ func chooseServicePort(runtime *runtime.Runtime, svc *corev1.Service) int32 {
 
 	return 0
 }
+
+// parsePortAnnotation parses an upstream port annotation value, reporting
+// false unless it is a port number in the 1-65535 range.
+func parsePortAnnotation(raw string) (int32, bool) {
+	val, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || val <= 0 || val > 65535 {
+		return 0, false
+	}
+	return int32(val), true
+}
+
+// lowestServicePort returns the port with the lowest number, and of those the
+// one with the lowest name.
+func lowestServicePort(ports []corev1.ServicePort) corev1.ServicePort {
+	return slices.MinFunc(ports, func(a, b corev1.ServicePort) int {
+		return cmp.Or(cmp.Compare(a.Port, b.Port), strings.Compare(a.Name, b.Name))
+	})
+}
+
+// serviceSchemes are the upstream schemes accepted in the scheme annotation.
+var serviceSchemes = []string{"http", "https", "tcp", "udp", "ssh", "rdp"}
+
+// chooseServiceScheme returns the scheme of the upstream service URL: the
+// scheme annotation if valid, else "https" for ports 443 and 8443 if
+// INFER_SCHEME_FROM_PORT is enabled, "http" otherwise.
+func chooseServiceScheme(runtime *runtime.Runtime, svc *corev1.Service, port int32) string {
+	if raw := strings.TrimSpace(svc.Annotations[runtime.Config.ServiceSchemeAnnotation]); raw != "" {
+		scheme := strings.ToLower(raw)
+		if slices.Contains(serviceSchemes, scheme) {
+			return scheme
+		}
+		runtime.LoggerFor(moduleKube).Warn("service has invalid scheme annotation; falling back to default scheme",
+			slog.String("namespace", svc.Namespace),
+			slog.String("service", svc.Name),
+			slog.String("annotation", runtime.Config.ServiceSchemeAnnotation),
+			slog.String("invalidValue", raw),
+		)
+	}
+	if runtime.Config.InferSchemeFromPort && (port == 443 || port == 8443) {
+		return "https"
+	}
+	return "http"
+}
+
+// buildServiceURL builds the upstream service URL, rejecting hosts that do
+// not make a valid URL, such as empty ones or ones that would need escaping.
+// With OMIT_DEFAULT_PORT, the port is left out when it is the default of the
+// scheme.
+func buildServiceURL(runtime *runtime.Runtime, scheme, host string, port int32) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("invalid service URL: empty host")
+	}
+	portStr := strconv.Itoa(int(port))
+	u := url.URL{Scheme: scheme, Host: net.JoinHostPort(host, portStr)}
+	if runtime.Config.OmitDefaultPort && (scheme == "http" && port == 80 || scheme == "https" && port == 443) {
+		// Trimming the port keeps the brackets of IPv6 hosts.
+		u.Host = strings.TrimSuffix(u.Host, ":"+portStr)
+	}
+
+	serviceURL := u.String()
+	if serviceURL != scheme+"://"+u.Host {
+		return "", fmt.Errorf("invalid service URL %q: host %q must not need escaping", serviceURL, host)
+	}
+	parsed, err := url.Parse(serviceURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid service URL %q: %w", serviceURL, err)
+	}
+	if parsed.Hostname() != host {
+		return "", fmt.Errorf("invalid service URL %q: host %q does not round-trip", serviceURL, host)
+	}
+	return serviceURL, nil
+}
+
+// chooseRedirectTarget returns the redirect target URL from the redirect
+// annotation, or "" if redirects are disabled or the annotation is not set.
+func chooseRedirectTarget(runtime *runtime.Runtime, svc *corev1.Service) (string, error) {
+	if !runtime.Config.RedirectsEnabled {
+		return "", nil
+	}
+	raw := strings.TrimSpace(svc.Annotations[runtime.Config.ServiceRedirectAnnotation])
+	if raw == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect target %q: %w", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid redirect target %q: must be an absolute http(s) URL", raw)
+	}
+	return raw, nil
+}
+
+// chooseBoolAnnotation parses a boolean annotation, treating a missing or
+// malformed value as false.
+func chooseBoolAnnotation(runtime *runtime.Runtime, svc *corev1.Service, annotation string) bool {
+	logger := runtime.LoggerFor(moduleKube)
+	raw, ok := svc.Annotations[annotation]
+	if !ok || strings.TrimSpace(raw) == "" {
+		return false
+	}
+	val, err := strconv.ParseBool(strings.TrimSpace(raw))
+	if err != nil {
+		logger.Warn("service has invalid boolean annotation; assuming false",
+			slog.String("namespace", svc.Namespace),
+			slog.String("service", svc.Name),
+			slog.String("annotation", annotation),
+			slog.String("invalidValue", raw),
+		)
+		return false
+	}
+	return val
+}
+
+// chooseOptionalBoolAnnotation is like chooseBoolAnnotation, but returns nil
+// if the annotation is not set or invalid, to fall back to a default.
+func chooseOptionalBoolAnnotation(runtime *runtime.Runtime, svc *corev1.Service, annotation string) *bool {
+	raw, ok := svc.Annotations[annotation]
+	if !ok || strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	val, err := strconv.ParseBool(strings.TrimSpace(raw))
+	if err != nil {
+		runtime.LoggerFor(moduleKube).Warn("service has invalid boolean annotation; using default",
+			slog.String("namespace", svc.Namespace),
+			slog.String("service", svc.Name),
+			slog.String("annotation", annotation),
+			slog.String("invalidValue", raw),
+		)
+		return nil
+	}
+	return &val
+}
+
+// hasEndpoints reports whether svc has at least one ready endpoint address,
+// according to its EndpointSlices. Manually managed Endpoints are mirrored
+// into EndpointSlices by Kubernetes.
+func hasEndpoints(runtime *runtime.Runtime, svc *corev1.Service) (bool, error) {
+	endpointSlices, err := runtime.Client.KubeClient.DiscoveryV1().EndpointSlices(svc.Namespace).List(runtime.Ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + svc.Name,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list endpoint slices: %w", err)
+	}
+
+	for _, slice := range endpointSlices.Items {
+		for _, ep := range slice.Endpoints {
+			if len(ep.Addresses) > 0 && (ep.Conditions.Ready == nil || *ep.Conditions.Ready) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// detectMoves logs hostnames whose upstream service changed since the
+// previous sync, and remembers the current mapping for the next one.
+func detectMoves(runtime *runtime.Runtime, state *SyncState) {
+	logger := runtime.LoggerFor(moduleKube)
+
+	current := make(map[string]string, state.Len())
+	for hostname, host := range state.Hosts {
+		current[hostname] = host.Service
+		previous, ok := runtime.PreviousServices[hostname]
+		if ok && previous != "" && host.Service != "" && previous != host.Service {
+			logger.Info("hostname moved", hostnameAttr(runtime, hostname, ""), slog.String("oldServiceURL", previous), slog.String("newServiceURL", host.Service))
+		}
+	}
+	runtime.PreviousServices = current
+}
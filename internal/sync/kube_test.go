@@ -0,0 +1,699 @@
+package sync
+
+import (
+	"bytes"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"tunnel/internal/runtime"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// serviceSkipReason returns the reason the service namespace/name was
+// skipped while reading Kubernetes state, or "" if it was not.
+func serviceSkipReason(rt *runtime.Runtime, namespace, name string) string {
+	for _, item := range rt.Skipped {
+		if item.Phase == moduleKube && item.Namespace == namespace && item.Service == name {
+			return item.Reason
+		}
+	}
+	return ""
+}
+
+// newEndpointSlice returns an EndpointSlice of the service namespace/name
+// with a single endpoint.
+func newEndpointSlice(namespace, name string, ready bool) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-manual",
+			Namespace: namespace,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: name},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses:  []string{"192.0.2.10"},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		}},
+	}
+}
+
+func TestSyncKubeSelectorlessEndpoints(t *testing.T) {
+	selectorless := func() *corev1.Service {
+		svc := newService("default", "db", 5432, map[string]string{"cloudflare-tunnel-hostnames": "db.example.com"})
+		svc.Spec.Selector = nil
+		return svc
+	}
+
+	tests := []struct {
+		name       string
+		require    string
+		objects    []k8sruntime.Object
+		wantMapped bool
+		wantSkip   string
+	}{
+		{
+			name:       "selector service is not checked",
+			require:    "true",
+			objects:    []k8sruntime.Object{newService("default", "db", 5432, map[string]string{"cloudflare-tunnel-hostnames": "db.example.com"})},
+			wantMapped: true,
+		},
+		{
+			name:       "check disabled",
+			require:    "false",
+			objects:    []k8sruntime.Object{selectorless()},
+			wantMapped: true,
+		},
+		{
+			name:       "ready endpoint",
+			require:    "true",
+			objects:    []k8sruntime.Object{selectorless(), newEndpointSlice("default", "db", true)},
+			wantMapped: true,
+		},
+		{
+			name:     "no endpoints",
+			require:  "true",
+			objects:  []k8sruntime.Object{selectorless()},
+			wantSkip: skipReasonNoEndpoints,
+		},
+		{
+			name:     "endpoint not ready",
+			require:  "true",
+			objects:  []k8sruntime.Object{selectorless(), newEndpointSlice("default", "db", false)},
+			wantSkip: skipReasonNoEndpoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := append([]k8sruntime.Object{newNamespace("default")}, tt.objects...)
+			rt, _ := newTestRuntime(t, map[string]string{"REQUIRE_SELECTORLESS_ENDPOINTS": tt.require}, objects...)
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			if _, ok := state.Hosts["db.example.com"]; ok != tt.wantMapped {
+				t.Errorf("db.example.com mapped = %v, want %v", ok, tt.wantMapped)
+			}
+			if got := serviceSkipReason(rt, "default", "db"); got != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestSyncKubeDetectMoves(t *testing.T) {
+	tests := []struct {
+		name     string
+		move     bool
+		wantLogs bool
+	}{
+		{name: "hostname moved to another service", move: true, wantLogs: true},
+		{name: "hostname unchanged", move: false, wantLogs: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, nil,
+				newNamespace("default"),
+				newService("default", "old", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+			)
+			var logs bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+			if _, err := SyncKube(rt); err != nil {
+				t.Fatalf("first SyncKube: %v", err)
+			}
+			if tt.move {
+				services := rt.Client.KubeClient.CoreV1().Services("default")
+				if err := services.Delete(rt.Ctx, "old", metav1.DeleteOptions{}); err != nil {
+					t.Fatalf("delete service: %v", err)
+				}
+				svc := newService("default", "new", 8080, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"})
+				if _, err := services.Create(rt.Ctx, svc, metav1.CreateOptions{}); err != nil {
+					t.Fatalf("create service: %v", err)
+				}
+			}
+			logs.Reset()
+			if _, err := SyncKube(rt); err != nil {
+				t.Fatalf("second SyncKube: %v", err)
+			}
+
+			out := logs.String()
+			moved := strings.Contains(out, `msg="hostname moved"`)
+			if moved != tt.wantLogs {
+				t.Fatalf("hostname moved logged = %v, want %v:\n%s", moved, tt.wantLogs, out)
+			}
+			if moved && (!strings.Contains(out, "oldServiceURL=http://old.default.svc.cluster.local:80") ||
+				!strings.Contains(out, "newServiceURL=http://new.default.svc.cluster.local:8080")) {
+				t.Errorf("move log lacks the old and new service URLs:\n%s", out)
+			}
+			if got := rt.PreviousServices["app.example.com"]; tt.move && got != "http://new.default.svc.cluster.local:8080" {
+				t.Errorf("previous service = %q, want the new one", got)
+			}
+		})
+	}
+}
+
+func TestSyncDNSAndIngressOnlyAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantSkip    string
+		wantCNAME   bool
+		wantIngress bool
+	}{
+		{name: "neither", wantCNAME: true, wantIngress: true},
+		{name: "dns-only", annotations: map[string]string{"cloudflare-tunnel-dns-only": "true"}, wantCNAME: true, wantIngress: false},
+		{name: "ingress-only", annotations: map[string]string{"cloudflare-tunnel-ingress-only": "true"}, wantCNAME: false, wantIngress: true},
+		{
+			name:        "both",
+			annotations: map[string]string{"cloudflare-tunnel-dns-only": "true", "cloudflare-tunnel-ingress-only": "true"},
+			wantSkip:    skipReasonDNSAndIngressOnly,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}
+			maps.Copy(annotations, tt.annotations)
+			rt, cf := newTestRuntime(t, nil, newNamespace("default"), newService("default", "app", 80, annotations))
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			if got := serviceSkipReason(rt, "default", "app"); got != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, tt.wantSkip)
+			}
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); ok != tt.wantCNAME {
+				t.Errorf("CNAME present = %v, want %v", ok, tt.wantCNAME)
+			}
+			ingress := false
+			for _, rule := range buildTunnelConfig(rt, state).Ingress {
+				ingress = ingress || rule.Hostname == "app.example.com"
+			}
+			if ingress != tt.wantIngress {
+				t.Errorf("ingress rule present = %v, want %v", ingress, tt.wantIngress)
+			}
+		})
+	}
+}
+
+func TestSyncKubeTLSPassthrough(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantSkip    string
+	}{
+		{name: "passthrough"},
+		{name: "with proxied=true", annotations: map[string]string{"cloudflare-tunnel-proxied": "true"}},
+		{name: "with dns-only", annotations: map[string]string{"cloudflare-tunnel-dns-only": "true"}, wantSkip: skipReasonTLSPassthrough},
+		{name: "with proxied=false", annotations: map[string]string{"cloudflare-tunnel-proxied": "false"}, wantSkip: skipReasonTLSPassthrough},
+		{name: "with redirect", annotations: map[string]string{"cloudflare-tunnel-redirect-to": "https://example.org"}, wantSkip: skipReasonTLSPassthrough},
+		{name: "with no-tls-verify", annotations: map[string]string{"cloudflare-tunnel-no-tls-verify": "true"}, wantSkip: skipReasonTLSPassthrough},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{
+				"cloudflare-tunnel-hostnames":       "db.example.com",
+				"cloudflare-tunnel-tls-passthrough": "true",
+			}
+			maps.Copy(annotations, tt.annotations)
+			env := map[string]string{"REDIRECTS_ENABLED": "true"}
+			rt, cf := newTestRuntime(t, env, newNamespace("default"), newService("default", "db", 5432, annotations))
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			if got := serviceSkipReason(rt, "default", "db"); got != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, tt.wantSkip)
+			}
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			rec, ok := cf.record(testZoneID, "CNAME", "db.example.com")
+			var rule *tunnelIngressRule
+			for _, r := range buildTunnelConfig(rt, state).Ingress {
+				if r.Hostname == "db.example.com" {
+					rule = &r
+				}
+			}
+			if tt.wantSkip != "" {
+				if ok || rule != nil {
+					t.Errorf("skipped service published: record %v, ingress rule %+v", ok, rule)
+				}
+				return
+			}
+			// The CNAME stays proxied: a DNS-only CNAME to the tunnel would
+			// not resolve.
+			if !ok || !rec.Proxied {
+				t.Errorf("record %+v (present %v), want a proxied CNAME", rec, ok)
+			}
+			if rule == nil {
+				t.Fatalf("no ingress rule for db.example.com")
+			}
+			if want := "tcp://db.default.svc.cluster.local:5432"; rule.Service != want {
+				t.Errorf("ingress service = %q, want %q", rule.Service, want)
+			}
+			if len(rule.OriginRequest) > 0 {
+				t.Errorf("ingress originRequest = %v, want none", rule.OriginRequest)
+			}
+		})
+	}
+}
+
+func TestSyncKubeWarnsWhenAllHostnamesFiltered(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		hostnames string
+		wantWarn  bool
+	}{
+		{name: "mapped", hostnames: "new.example.com", wantWarn: false},
+		{name: "all taken by another service", hostnames: "app.example.com", wantWarn: true},
+		{name: "some taken by another service", hostnames: "app.example.com,new.example.com", wantWarn: false},
+		{
+			name:      "all excluded from DNS and tunnel",
+			env:       map[string]string{"DNS_HOSTNAME_EXCLUDE": "*.example.com", "TUNNEL_HOSTNAME_EXCLUDE": "*.example.com"},
+			hostnames: "new.example.com",
+			wantWarn:  true,
+		},
+		{
+			name:      "excluded from DNS only",
+			env:       map[string]string{"DNS_HOSTNAME_EXCLUDE": "*.example.com"},
+			hostnames: "new.example.com",
+			wantWarn:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, tt.env,
+				newNamespace("default"),
+				newService("default", "a-app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+				newService("default", "b-filtered", 80, map[string]string{"cloudflare-tunnel-hostnames": tt.hostnames}),
+			)
+			var logs bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+			if _, err := SyncKube(rt); err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+
+			warned := false
+			for line := range strings.Lines(logs.String()) {
+				if strings.Contains(line, "none of them were mapped") && strings.Contains(line, "service=b-filtered") {
+					warned = strings.Contains(line, "level=WARN")
+				}
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("warned = %v, want %v:\n%s", warned, tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestChooseServiceScheme(t *testing.T) {
+	tests := []struct {
+		name       string
+		infer      string
+		annotation string
+		port       int32
+		want       string
+	}{
+		{name: "default", infer: "false", port: 443, want: "http"},
+		{name: "inferred 443", infer: "true", port: 443, want: "https"},
+		{name: "inferred 8443", infer: "true", port: 8443, want: "https"},
+		{name: "inferred other port", infer: "true", port: 8080, want: "http"},
+		{name: "annotation wins over inference", infer: "true", annotation: "http", port: 443, want: "http"},
+		{name: "annotation is case-insensitive", infer: "false", annotation: "HTTPS", port: 8080, want: "https"},
+		{name: "invalid annotation falls back to inference", infer: "true", annotation: "gopher", port: 8443, want: "https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, map[string]string{"INFER_SCHEME_FROM_PORT": tt.infer})
+			annotations := map[string]string{}
+			if tt.annotation != "" {
+				annotations["cloudflare-tunnel-upstream-scheme"] = tt.annotation
+			}
+			svc := newService("default", "app", tt.port, annotations)
+
+			if got := chooseServiceScheme(rt, svc, tt.port); got != tt.want {
+				t.Errorf("chooseServiceScheme = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncDNSProxiedByServiceType(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		annotation  string
+		wantLB      bool
+		wantCluster bool
+	}{
+		{name: "unset uses global default", policy: "", wantLB: true, wantCluster: true},
+		{name: "per service type", policy: `{"LoadBalancer":true,"ClusterIP":false}`, wantLB: true, wantCluster: false},
+		{name: "annotation overrides type default", policy: `{"LoadBalancer":true,"ClusterIP":false}`, annotation: "true", wantLB: true, wantCluster: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newService("default", "public", 80, map[string]string{"cloudflare-tunnel-hostnames": "public.example.com"})
+			lb.Spec.Type = corev1.ServiceTypeLoadBalancer
+			clusterAnnotations := map[string]string{"cloudflare-tunnel-hostnames": "internal.example.com"}
+			if tt.annotation != "" {
+				clusterAnnotations["cloudflare-tunnel-proxied"] = tt.annotation
+			}
+			cluster := newService("default", "internal", 80, clusterAnnotations)
+			rt, cf := newTestRuntime(t, map[string]string{"PROXIED_BY_SERVICE_TYPE": tt.policy}, newNamespace("default"), lb, cluster)
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			for host, want := range map[string]bool{"public.example.com": tt.wantLB, "internal.example.com": tt.wantCluster} {
+				rec, ok := cf.record(testZoneID, "CNAME", host)
+				if !ok || rec.Proxied != want {
+					t.Errorf("%s record %+v, want proxied %v", host, rec, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildServiceURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		omit    string
+		scheme  string
+		host    string
+		port    int32
+		want    string
+		wantErr bool
+	}{
+		{name: "port kept by default", omit: "false", scheme: "http", host: "app.default.svc.cluster.local", port: 80, want: "http://app.default.svc.cluster.local:80"},
+		{name: "http 80 omitted", omit: "true", scheme: "http", host: "app.default.svc.cluster.local", port: 80, want: "http://app.default.svc.cluster.local"},
+		{name: "https 443 omitted", omit: "true", scheme: "https", host: "app.default.svc.cluster.local", port: 443, want: "https://app.default.svc.cluster.local"},
+		{name: "http 443 kept", omit: "true", scheme: "http", host: "app.default.svc.cluster.local", port: 443, want: "http://app.default.svc.cluster.local:443"},
+		{name: "non-standard port kept", omit: "true", scheme: "https", host: "app.default.svc.cluster.local", port: 8443, want: "https://app.default.svc.cluster.local:8443"},
+		{name: "tcp port kept", omit: "true", scheme: "tcp", host: "db.default.svc.cluster.local", port: 5432, want: "tcp://db.default.svc.cluster.local:5432"},
+		{name: "trailing dot kept", omit: "false", scheme: "http", host: "app.default.svc.cluster.local.", port: 80, want: "http://app.default.svc.cluster.local.:80"},
+		{name: "IPv6 bracketed", omit: "false", scheme: "http", host: "2001:db8::1", port: 8080, want: "http://[2001:db8::1]:8080"},
+		{name: "IPv6 default port omitted", omit: "true", scheme: "https", host: "2001:db8::1", port: 443, want: "https://[2001:db8::1]"},
+		{name: "host with space", omit: "false", scheme: "http", host: "bad host", port: 80, wantErr: true},
+		{name: "host with port", omit: "false", scheme: "http", host: "app.default.svc.cluster.local:8080", port: 80, wantErr: true},
+		{name: "host with trailing slash", omit: "false", scheme: "http", host: "app.default.svc.cluster.local/", port: 80, wantErr: true},
+		{name: "host with path", omit: "true", scheme: "http", host: "app.default.svc.cluster.local/api v1", port: 80, wantErr: true},
+		{name: "host with escape", omit: "false", scheme: "http", host: "app%20x.default.svc.cluster.local", port: 80, wantErr: true},
+		{name: "host with userinfo", omit: "false", scheme: "http", host: "user@app.default.svc.cluster.local", port: 80, wantErr: true},
+		{name: "empty host", omit: "false", scheme: "http", host: "", port: 80, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, map[string]string{"OMIT_DEFAULT_PORT": tt.omit})
+
+			got, err := buildServiceURL(rt, tt.scheme, tt.host, tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildServiceURL error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("buildServiceURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncKubeFailServiceOnAnyConflict(t *testing.T) {
+	tests := []struct {
+		name      string
+		strict    string
+		wantHosts []string
+		wantSkip  []string // conflicting hostnames recorded for b-multi
+	}{
+		{name: "only the conflict is skipped", strict: "false", wantHosts: []string{"api.example.com", "app.example.com", "www.example.com"}, wantSkip: []string{"app.example.com"}},
+		{name: "strict mode skips the whole service", strict: "true", wantHosts: []string{"app.example.com"}, wantSkip: []string{"app.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, map[string]string{"FAIL_SERVICE_ON_ANY_CONFLICT": tt.strict},
+				newNamespace("default"),
+				newService("default", "a-app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+				newService("default", "b-multi", 8080, map[string]string{"cloudflare-tunnel-hostnames": "www.example.com,app.example.com api.example.com"}),
+			)
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			hosts := slices.Sorted(maps.Keys(state.Hosts))
+			if !slices.Equal(hosts, tt.wantHosts) {
+				t.Errorf("hostnames = %q, want %q", hosts, tt.wantHosts)
+			}
+			if got := state.Hosts["app.example.com"].Service; got != "http://a-app.default.svc.cluster.local:80" {
+				t.Errorf("app.example.com maps to %q, want the first service", got)
+			}
+
+			var skipped []string
+			for _, item := range rt.Skipped {
+				if item.Service == "b-multi" && item.Reason == skipReasonConflict {
+					skipped = append(skipped, item.Hostname)
+				}
+			}
+			if !slices.Equal(skipped, tt.wantSkip) {
+				t.Errorf("skipped conflicts = %q, want %q", skipped, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestSyncKubeRequirePortAnnotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		require     string
+		port        string // upstream port annotation, unset if empty
+		wantService string
+		wantSkip    string
+	}{
+		{name: "lenient without annotation", require: "false", wantService: "http://app.default.svc.cluster.local:80"},
+		{name: "lenient with invalid annotation", require: "false", port: "http-alt", wantService: "http://app.default.svc.cluster.local:80"},
+		{name: "strict with annotation", require: "true", port: "8080", wantService: "http://app.default.svc.cluster.local:8080"},
+		{name: "strict without annotation", require: "true", wantSkip: skipReasonNoPortAnnotation},
+		{name: "strict with blank annotation", require: "true", port: " ", wantSkip: skipReasonNoPortAnnotation},
+		{name: "strict with invalid annotation", require: "true", port: "http-alt", wantSkip: skipReasonBadPortAnnotation},
+		{name: "strict with out of range annotation", require: "true", port: "70000", wantSkip: skipReasonBadPortAnnotation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}
+			if tt.port != "" {
+				annotations["cloudflare-tunnel-upstream-port"] = tt.port
+			}
+			rt, _ := newTestRuntime(t, map[string]string{"REQUIRE_PORT_ANNOTATION": tt.require},
+				newNamespace("default"),
+				newService("default", "app", 80, annotations),
+			)
+			var buf bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+
+			if got := state.Hosts["app.example.com"].Service; got != tt.wantService {
+				t.Errorf("app.example.com maps to %q, want %q", got, tt.wantService)
+			}
+			if got := serviceSkipReason(rt, "default", "app"); got != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, tt.wantSkip)
+			}
+			if tt.wantSkip != "" && !strings.Contains(buf.String(), "level=WARN") {
+				t.Errorf("skipped service without a warning: %s", buf.String())
+			}
+		})
+	}
+}
+
+func TestSyncDNSRecreateAnnotation(t *testing.T) {
+	aRecord := dnsRecord{ID: "rec-a", Type: "A", Name: "app.example.com", Content: "192.0.2.1", Comment: "managed by tunnel-manager", TTL: 1}
+	unmanagedA := aRecord
+	unmanagedA.Comment = ""
+	aaaaRecord := dnsRecord{ID: "rec-aaaa", Type: "AAAA", Name: "app.example.com", Content: "2001:db8::1", Comment: "managed by tunnel-manager", TTL: 1}
+
+	tests := []struct {
+		name      string
+		recreate  string
+		deletable string
+		existing  []dnsRecord
+		wantCNAME bool
+		wantSkip  string
+	}{
+		{name: "managed A replaced", recreate: "true", deletable: "CNAME,A,AAAA", existing: []dnsRecord{aRecord}, wantCNAME: true},
+		{name: "managed A and AAAA replaced", recreate: "true", deletable: "CNAME,A,AAAA", existing: []dnsRecord{aRecord, aaaaRecord}, wantCNAME: true},
+		{name: "without annotation", recreate: "", deletable: "CNAME,A,AAAA", existing: []dnsRecord{aRecord}, wantSkip: skipReasonAorAAAA},
+		{name: "unmanaged A kept", recreate: "true", deletable: "CNAME,A,AAAA", existing: []dnsRecord{unmanagedA}, wantSkip: skipReasonAorAAAA},
+		{name: "A not deletable", recreate: "true", deletable: "CNAME", existing: []dnsRecord{aRecord}, wantSkip: skipReasonRecreateNotDeletable},
+		{name: "default deletable types", recreate: "true", deletable: "", existing: []dnsRecord{aRecord}, wantSkip: skipReasonRecreateNotDeletable},
+		{
+			name:      "AAAA not deletable",
+			recreate:  "true",
+			deletable: "CNAME,A",
+			existing:  []dnsRecord{aRecord, aaaaRecord},
+			wantSkip:  skipReasonRecreateNotDeletable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}
+			if tt.recreate != "" {
+				annotations["cloudflare-tunnel-recreate"] = tt.recreate
+			}
+			rt, cf := newTestRuntime(t, map[string]string{"DELETABLE_RECORD_TYPES": tt.deletable},
+				newNamespace("default"),
+				newService("default", "app", 80, annotations),
+			)
+			cf.addRecords(testZoneID, tt.existing...)
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			_, hasA := cf.record(testZoneID, "A", "app.example.com")
+			cname, hasCNAME := cf.record(testZoneID, "CNAME", "app.example.com")
+			if hasCNAME != tt.wantCNAME || hasA == tt.wantCNAME {
+				t.Errorf("A present = %v, CNAME present = %v, want CNAME %v", hasA, hasCNAME, tt.wantCNAME)
+			}
+			if hasCNAME && cname.Content != testTarget {
+				t.Errorf("CNAME content = %q, want %q", cname.Content, testTarget)
+			}
+			if got := skipReason(rt, "app.example.com"); got != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", got, tt.wantSkip)
+			}
+			// Address records are deleted all together or not at all.
+			if deletes := len(cf.requestsMatching(http.MethodDelete, "/dns_records")); !tt.wantCNAME && deletes > 0 {
+				t.Errorf("sent %d DELETE requests for a hostname left as is", deletes)
+			}
+		})
+	}
+}
+
+func TestChooseServicePort(t *testing.T) {
+	tests := []struct {
+		name       string
+		ports      []corev1.ServicePort
+		annotation string
+		want       int32
+	}{
+		{name: "out of numeric order", ports: []corev1.ServicePort{{Name: "metrics", Port: 9090}, {Name: "https", Port: 8443}, {Name: "http", Port: 8080}}, want: 8080},
+		{name: "annotation", ports: []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "admin", Port: 9000}}, annotation: "9000", want: 9000},
+		{name: "invalid annotation", ports: []corev1.ServicePort{{Name: "metrics", Port: 9090}, {Name: "http", Port: 8080}}, annotation: "http", want: 8080},
+		{name: "no ports", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, nil)
+			svc := newService("default", "app", 80, nil)
+			svc.Spec.Ports = tt.ports
+			if tt.annotation != "" {
+				svc.Annotations = map[string]string{"cloudflare-tunnel-upstream-port": tt.annotation}
+			}
+
+			// The choice does not depend on the order of the ports.
+			for range 2 {
+				if got := chooseServicePort(rt, svc); got != tt.want {
+					t.Errorf("chooseServicePort(%v) = %d, want %d", svc.Spec.Ports, got, tt.want)
+				}
+				slices.Reverse(svc.Spec.Ports)
+			}
+		})
+	}
+}
+
+func TestLowestServicePortName(t *testing.T) {
+	ports := []corev1.ServicePort{{Name: "web", Port: 80}, {Name: "http", Port: 80}, {Name: "alt", Port: 81}}
+	for range 2 {
+		if got := lowestServicePort(ports); got.Name != "http" {
+			t.Errorf("lowestServicePort(%v) = %q, want http", ports, got.Name)
+		}
+		slices.Reverse(ports)
+	}
+}
+
+func TestSyncKubeNamespaceFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		wantHosts []string
+		wantWarn  bool
+	}{
+		{name: "all namespaces", wantHosts: []string{"apps.example.com", "system.example.com", "web.example.com"}},
+		{
+			name:      "allowlist",
+			env:       map[string]string{"NAMESPACES": "apps,web"},
+			wantHosts: []string{"apps.example.com", "web.example.com"},
+		},
+		{
+			name:      "allowlist with missing namespace",
+			env:       map[string]string{"NAMESPACES": "apps,gone"},
+			wantHosts: []string{"apps.example.com"},
+			wantWarn:  true,
+		},
+		{
+			name:      "denylist",
+			env:       map[string]string{"EXCLUDE_NAMESPACES": "kube-system"},
+			wantHosts: []string{"apps.example.com", "web.example.com"},
+		},
+		{
+			name:      "denylist alias",
+			env:       map[string]string{"NAMESPACE_DENYLIST": "kube-system,web"},
+			wantHosts: []string{"apps.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []k8sruntime.Object{}
+			for ns, host := range map[string]string{"apps": "apps", "web": "web", "kube-system": "system"} {
+				objects = append(objects,
+					newNamespace(ns),
+					newService(ns, "app", 80, map[string]string{"cloudflare-tunnel-hostnames": host + ".example.com"}),
+				)
+			}
+			rt, _ := newTestRuntime(t, tt.env, objects...)
+			var logs bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+
+			hosts := slices.Sorted(maps.Keys(state.Hosts))
+			if !slices.Equal(hosts, tt.wantHosts) {
+				t.Errorf("hostnames = %q, want %q", hosts, tt.wantHosts)
+			}
+			warned := strings.Contains(logs.String(), "failed to read namespace from NAMESPACES") &&
+				strings.Contains(logs.String(), "namespace=gone")
+			if warned != tt.wantWarn {
+				t.Errorf("missing namespace warning = %v, want %v: %s", warned, tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
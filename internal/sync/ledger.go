@@ -0,0 +1,89 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"tunnel/internal/runtime"
+)
+
+// softDeleteKey identifies a record in the soft-delete ledger.
+func softDeleteKey(zoneID string, rec dnsRecord) string {
+	return zoneID + "/" + rec.ID
+}
+
+// markSoftDelete records that a managed record was found absent from the
+// desired state, see SOFT_DELETE_CONFIRM.
+func markSoftDelete(rt *runtime.Runtime, zoneID string, rec dnsRecord) {
+	if rt.SoftDeletes == nil {
+		rt.SoftDeletes = make(map[string]bool)
+	}
+	rt.SoftDeletes[softDeleteKey(zoneID, rec)] = true
+}
+
+// pruneSoftDeletes drops the ledger entries of zoneID that are not in
+// pending, i.e. records that were removed, desired again or vanished, and
+// persists the ledger if SOFT_DELETE_LEDGER_FILE is set.
+func pruneSoftDeletes(rt *runtime.Runtime, zoneID string, pending map[string]bool) {
+	for key := range rt.SoftDeletes {
+		if strings.HasPrefix(key, zoneID+"/") && !pending[key] {
+			delete(rt.SoftDeletes, key)
+		}
+	}
+	if err := saveSoftDeleteLedger(rt); err != nil {
+		rt.LoggerFor(moduleDNS).Warn("failed to persist soft-delete ledger", "error", err)
+	}
+}
+
+// LoadSoftDeleteLedger loads the soft-delete ledger from
+// SOFT_DELETE_LEDGER_FILE, if set and present, so that pending removals
+// survive restarts.
+func LoadSoftDeleteLedger(rt *runtime.Runtime) error {
+	path := rt.Config.SoftDeleteLedgerFile
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while reading soft-delete ledger: %w", err)
+	}
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("error while parsing soft-delete ledger: %w", err)
+	}
+	rt.SoftDeletes = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		rt.SoftDeletes[key] = true
+	}
+	return nil
+}
+
+// saveSoftDeleteLedger writes the soft-delete ledger to
+// SOFT_DELETE_LEDGER_FILE, if set, atomically.
+func saveSoftDeleteLedger(rt *runtime.Runtime) error {
+	path := rt.Config.SoftDeleteLedgerFile
+	if path == "" {
+		return nil
+	}
+	keys := make([]string, 0, len(rt.SoftDeletes))
+	for key := range rt.SoftDeletes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
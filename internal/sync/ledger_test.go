@@ -0,0 +1,77 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncDNSSoftDeleteConfirm(t *testing.T) {
+	app := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+	appAndOld := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com", "old.example.com")
+
+	tests := []struct {
+		name    string
+		confirm string
+		cycles  []*SyncState
+		// wantPresent is whether old.example.com exists after each cycle.
+		wantPresent []bool
+	}{
+		{name: "disabled", confirm: "false", cycles: []*SyncState{app}, wantPresent: []bool{false}},
+		{name: "confirmed by the second cycle", confirm: "true", cycles: []*SyncState{app, app}, wantPresent: []bool{true, false}},
+		{name: "desired again", confirm: "true", cycles: []*SyncState{app, appAndOld, app, app}, wantPresent: []bool{true, true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"SOFT_DELETE_CONFIRM": tt.confirm})
+			cf.addRecords(testZoneID, managedCNAME("rec-app", "app.example.com"), managedCNAME("rec-old", "old.example.com"))
+
+			for i, state := range tt.cycles {
+				if err := SyncDNS(rt, state); err != nil {
+					t.Fatalf("cycle %d: SyncDNS: %v", i+1, err)
+				}
+				if _, ok := cf.record(testZoneID, "CNAME", "old.example.com"); ok != tt.wantPresent[i] {
+					t.Errorf("cycle %d: old.example.com present = %v, want %v", i+1, ok, tt.wantPresent[i])
+				}
+			}
+			if len(rt.SoftDeletes) != 0 {
+				t.Errorf("ledger = %v after the last cycle, want empty", rt.SoftDeletes)
+			}
+		})
+	}
+}
+
+func TestSyncDNSSoftDeleteLedgerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	env := map[string]string{"SOFT_DELETE_CONFIRM": "true", "SOFT_DELETE_LEDGER_FILE": path}
+	state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+
+	rt, cf := newTestRuntime(t, env)
+	cf.addRecords(testZoneID, managedCNAME("rec-app", "app.example.com"), managedCNAME("rec-old", "old.example.com"))
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("SyncDNS: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read ledger: %v", err)
+	}
+	if want := `["` + testZoneID + `/rec-old"]`; string(data) != want {
+		t.Errorf("ledger file = %s, want %s", data, want)
+	}
+
+	// After a restart, the persisted ledger confirms the removal.
+	restarted, _ := newTestRuntime(t, env)
+	restarted.Client.CloudFlareClient = rt.Client.CloudFlareClient
+	if err := LoadSoftDeleteLedger(restarted); err != nil {
+		t.Fatalf("LoadSoftDeleteLedger: %v", err)
+	}
+	if err := SyncDNS(restarted, state); err != nil {
+		t.Fatalf("SyncDNS after restart: %v", err)
+	}
+	if _, ok := cf.record(testZoneID, "CNAME", "old.example.com"); ok {
+		t.Errorf("old.example.com not deleted after restart")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "[]" {
+		t.Errorf("ledger file = %s after deletion, want []", data)
+	}
+}
@@ -0,0 +1,119 @@
+package sync
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+	"tunnel/internal/runtime"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// acquireTunnelLock tries to acquire the TUNNEL_LOCK_LEASE Lease, so that
+// only one replica writes the tunnel configuration per SYNC_INTERVAL. It
+// returns false if another replica holds the lease.
+//
+// The lease is held for leaseDuration and renewed by the holder on each
+// sync; it is only released early by releaseTunnelLock if the write fails,
+// letting another replica retry.
+func acquireTunnelLock(rt *runtime.Runtime) (bool, error) {
+	leases := rt.Client.KubeClient.CoordinationV1().Leases(rt.Config.TunnelLockNamespace)
+	identity := rt.Config.TunnelLockIdentity
+	duration := leaseDuration(rt.Config.SyncInterval)
+	now := metav1.NewMicroTime(time.Now())
+
+	lease, err := leases.Get(rt.Ctx, rt.Config.TunnelLockLease, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      rt.Config.TunnelLockLease,
+				Namespace: rt.Config.TunnelLockNamespace,
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err := leases.Create(rt.Ctx, lease, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to create tunnel lock lease: %w", err)
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get tunnel lock lease: %w", err)
+	}
+
+	held := lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != ""
+	if held && *lease.Spec.HolderIdentity != identity && !leaseExpired(lease) {
+		rt.LoggerFor(moduleTunnel).Debug("tunnel lock held by another replica", slog.String("holder", *lease.Spec.HolderIdentity))
+		return false, nil
+	}
+
+	if !held || *lease.Spec.HolderIdentity != identity {
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+
+	// The update is conditional on the resource version we read, so only one
+	// of several replicas racing for an expired lease wins.
+	_, err = leases.Update(rt.Ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update tunnel lock lease: %w", err)
+	}
+	return true, nil
+}
+
+// releaseTunnelLock releases the TUNNEL_LOCK_LEASE Lease if we hold it.
+func releaseTunnelLock(rt *runtime.Runtime) error {
+	leases := rt.Client.KubeClient.CoordinationV1().Leases(rt.Config.TunnelLockNamespace)
+
+	lease, err := leases.Get(rt.Ctx, rt.Config.TunnelLockLease, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel lock lease: %w", err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != rt.Config.TunnelLockIdentity {
+		return nil
+	}
+
+	lease.Spec.HolderIdentity = nil
+	if _, err := leases.Update(rt.Ctx, lease, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(err) {
+		return fmt.Errorf("failed to release tunnel lock lease: %w", err)
+	}
+	return nil
+}
+
+// minLeaseDuration is the shortest tunnel lock lease duration, so that
+// short or sub-second SYNC_INTERVALs still leave the holder time to renew.
+const minLeaseDuration = 15 * time.Second
+
+// leaseDuration returns the tunnel lock lease duration, in seconds, for
+// syncInterval: twice the interval, so that a holder whose sync runs a bit
+// late does not lose the lease to another replica, and at least
+// minLeaseDuration.
+func leaseDuration(syncInterval time.Duration) int32 {
+	d := max(2*syncInterval, minLeaseDuration)
+	return int32((d + time.Second - 1) / time.Second)
+}
+
+// leaseExpired reports whether the lease was not renewed within its
+// duration.
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().After(expiry)
+}
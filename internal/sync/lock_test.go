@@ -0,0 +1,167 @@
+package sync
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testLockLease     = "tunnel-manager"
+	testLockNamespace = "kube-system"
+)
+
+// lockEnv returns the environment enabling TUNNEL_LOCK_LEASE for identity.
+func lockEnv(identity string) map[string]string {
+	return map[string]string{
+		"TUNNEL_LOCK_LEASE":     testLockLease,
+		"TUNNEL_LOCK_NAMESPACE": testLockNamespace,
+		"TUNNEL_LOCK_IDENTITY":  identity,
+	}
+}
+
+// newLease returns the tunnel lock Lease held by holder, renewed at
+// renewed for durationSeconds.
+func newLease(holder string, renewed time.Time, durationSeconds int32) *coordinationv1.Lease {
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: testLockLease, Namespace: testLockNamespace},
+		Spec: coordinationv1.LeaseSpec{
+			LeaseDurationSeconds: &durationSeconds,
+			RenewTime:            &metav1.MicroTime{Time: renewed},
+		},
+	}
+	if holder != "" {
+		lease.Spec.HolderIdentity = &holder
+	}
+	return lease
+}
+
+// leaseHolder returns the holder of the tunnel lock Lease, "" if none.
+func leaseHolder(t *testing.T, kube *fake.Clientset) string {
+	t.Helper()
+	lease, err := kube.CoordinationV1().Leases(testLockNamespace).Get(t.Context(), testLockLease, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease: %v", err)
+	}
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestAcquireTunnelLock(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name         string
+		lease        *coordinationv1.Lease
+		conflict     bool // the lease update loses a race with another replica
+		wantAcquired bool
+		wantHolder   string
+	}{
+		{name: "no lease", wantAcquired: true, wantHolder: "replica-a"},
+		{name: "released lease", lease: newLease("", now, 60), wantAcquired: true, wantHolder: "replica-a"},
+		{name: "renewed by the holder", lease: newLease("replica-a", now.Add(-30*time.Second), 60), wantAcquired: true, wantHolder: "replica-a"},
+		{name: "held by another replica", lease: newLease("replica-b", now.Add(-30*time.Second), 60), wantAcquired: false, wantHolder: "replica-b"},
+		{name: "expired lease of another replica", lease: newLease("replica-b", now.Add(-2*time.Minute), 60), wantAcquired: true, wantHolder: "replica-a"},
+		{name: "lost race for an expired lease", lease: newLease("replica-b", now.Add(-2*time.Minute), 60), conflict: true, wantAcquired: false, wantHolder: "replica-b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []k8sruntime.Object
+			if tt.lease != nil {
+				objects = append(objects, tt.lease)
+			}
+			rt, _ := newTestRuntime(t, lockEnv("replica-a"), objects...)
+			kube := rt.Client.KubeClient.(*fake.Clientset)
+			if tt.conflict {
+				kube.PrependReactor("update", "leases", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+					return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, testLockLease, nil)
+				})
+			}
+
+			acquired, err := acquireTunnelLock(rt)
+			if err != nil {
+				t.Fatalf("acquireTunnelLock: %v", err)
+			}
+			if acquired != tt.wantAcquired {
+				t.Errorf("acquired = %v, want %v", acquired, tt.wantAcquired)
+			}
+			if got := leaseHolder(t, kube); got != tt.wantHolder {
+				t.Errorf("lease holder = %q, want %q", got, tt.wantHolder)
+			}
+		})
+	}
+}
+
+func TestSyncTunnelLockContention(t *testing.T) {
+	rtA, cfA := newTestRuntime(t, lockEnv("replica-a"))
+	rtB, cfB := newTestRuntime(t, lockEnv("replica-b"))
+	// Both replicas share the Kubernetes API holding the lease.
+	kube := rtA.Client.KubeClient.(*fake.Clientset)
+	rtB.Client.KubeClient = kube
+	state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+	configPath := tunnelPath + "/configurations"
+
+	if err := SyncTunnel(rtA, state); err != nil {
+		t.Fatalf("SyncTunnel of replica-a: %v", err)
+	}
+	if err := SyncTunnel(rtB, state); err != nil {
+		t.Fatalf("SyncTunnel of replica-b: %v", err)
+	}
+	if got := len(cfA.requestsMatching(http.MethodPut, configPath)); got != 1 {
+		t.Errorf("replica-a wrote the tunnel configuration %d times, want 1", got)
+	}
+	if got := len(cfB.requestsMatching(http.MethodPut, configPath)); got != 0 {
+		t.Errorf("replica-b wrote the tunnel configuration %d times while replica-a holds the lock", got)
+	}
+	if got := leaseHolder(t, kube); got != "replica-a" {
+		t.Errorf("lease holder = %q, want replica-a", got)
+	}
+
+	// A failed write releases the lock, so that the other replica can retry.
+	cfA.fail(http.MethodPut, configPath, http.StatusInternalServerError, 1)
+	if err := SyncTunnel(rtA, state); err == nil {
+		t.Fatalf("SyncTunnel of replica-a succeeded, want the write to fail")
+	}
+	if got := leaseHolder(t, kube); got != "" {
+		t.Errorf("lease holder after a failed write = %q, want none", got)
+	}
+	if err := SyncTunnel(rtB, state); err != nil {
+		t.Fatalf("SyncTunnel of replica-b: %v", err)
+	}
+	if got := len(cfB.requestsMatching(http.MethodPut, configPath)); got != 1 {
+		t.Errorf("replica-b wrote the tunnel configuration %d times after the lock was released, want 1", got)
+	}
+	if got := leaseHolder(t, kube); got != "replica-b" {
+		t.Errorf("lease holder = %q, want replica-b", got)
+	}
+}
+
+func TestLeaseDuration(t *testing.T) {
+	tests := []struct {
+		syncInterval time.Duration
+		want         int32
+	}{
+		{syncInterval: 0, want: 15},
+		{syncInterval: 500 * time.Millisecond, want: 15},
+		{syncInterval: 7 * time.Second, want: 15},
+		{syncInterval: 30 * time.Second, want: 60},
+		{syncInterval: 10*time.Second + 300*time.Millisecond, want: 21},
+		{syncInterval: 5 * time.Minute, want: 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.syncInterval.String(), func(t *testing.T) {
+			if got := leaseDuration(tt.syncInterval); got != tt.want {
+				t.Errorf("leaseDuration(%v) = %d, want %d", tt.syncInterval, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package sync
+
+import "tunnel/internal/runtime"
+
+// Module names for runtime.LoggerFor, aliased here since most functions in
+// this package shadow the runtime package with their parameter.
+const (
+	moduleKube   = runtime.ModuleKube
+	moduleTunnel = runtime.ModuleTunnel
+	moduleDNS    = runtime.ModuleDNS
+)
@@ -0,0 +1,75 @@
+package sync
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"tunnel/internal/runtime"
+)
+
+func TestModuleLogLevels(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		// want maps "module level" to whether such lines are logged.
+		want map[string]bool
+	}{
+		{
+			name: "global level applies to all modules",
+			env:  map[string]string{"LOG_LEVEL": "info"},
+			want: map[string]bool{"kube DEBUG": false, "kube INFO": true, "dns DEBUG": false, "dns INFO": true},
+		},
+		{
+			name: "module override lowers the level",
+			env:  map[string]string{"LOG_LEVEL": "info", "LOG_LEVEL_DNS": "debug"},
+			want: map[string]bool{"kube DEBUG": false, "kube INFO": true, "dns DEBUG": true, "dns INFO": true},
+		},
+		{
+			name: "module override raises the level",
+			env:  map[string]string{"LOG_LEVEL": "debug", "LOG_LEVEL_KUBE": "warn"},
+			want: map[string]bool{"kube DEBUG": false, "kube INFO": false, "dns DEBUG": true, "dns INFO": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, _ := newTestRuntime(t, tt.env,
+				newNamespace("default"),
+				newService("default", "app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+			)
+			// Loggers are built the way main builds them.
+			var logs bytes.Buffer
+			handler := slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})
+			rt.Logger = runtime.NewLeveledLogger(handler, rt.Config.LogLevel, "")
+			rt.ModuleLoggers = map[string]*slog.Logger{
+				runtime.ModuleKube:   runtime.NewLeveledLogger(handler, rt.Config.LogLevelKube, runtime.ModuleKube),
+				runtime.ModuleTunnel: runtime.NewLeveledLogger(handler, rt.Config.LogLevelTunnel, runtime.ModuleTunnel),
+				runtime.ModuleDNS:    runtime.NewLeveledLogger(handler, rt.Config.LogLevelDNS, runtime.ModuleDNS),
+			}
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			got := make(map[string]bool)
+			for line := range strings.Lines(logs.String()) {
+				for _, module := range []string{"kube", "dns"} {
+					for _, level := range []string{"DEBUG", "INFO"} {
+						if strings.Contains(line, "level="+level) && strings.Contains(line, "module="+module) {
+							got[module+" "+level] = true
+						}
+					}
+				}
+			}
+			for key, want := range tt.want {
+				if got[key] != want {
+					t.Errorf("%s lines logged = %v, want %v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package sync
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"tunnel/internal/config"
+	"tunnel/internal/runtime"
+)
+
+type tokenVerifyResponse struct {
+	Result struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	} `json:"result"`
+}
+
+type tokenResponse struct {
+	Result struct {
+		Policies []struct {
+			Effect           string `json:"effect"`
+			PermissionGroups []struct {
+				Name string `json:"name"`
+			} `json:"permission_groups"`
+		} `json:"policies"`
+	} `json:"result"`
+}
+
+// ProbePermissions checks at startup whether the API token can edit DNS
+// records and the tunnel configuration, and warns about missing scopes. With
+// PERMISSION_PROBE=disable, the corresponding sync phase is disabled instead
+// of failing deep into every cycle.
+//
+// Reading the token's policies requires the token to be allowed to read
+// itself; if it is not, the scopes are assumed to be present.
+func ProbePermissions(rt *runtime.Runtime) error {
+	if rt.Config.PermissionProbe == config.PermissionProbeOff {
+		return nil
+	}
+	logger := rt.Logger
+
+	var verify tokenVerifyResponse
+	if err := rt.Client.CloudFlareClient.Get(rt.Ctx, "/user/tokens/verify", nil, &verify); err != nil {
+		return fmt.Errorf("error while verifying API token: %w", err)
+	}
+	if verify.Result.Status != "active" {
+		return fmt.Errorf("API token %s is %s", verify.Result.ID, verify.Result.Status)
+	}
+
+	var token tokenResponse
+	path := fmt.Sprintf("/user/tokens/%s", url.PathEscape(verify.Result.ID))
+	if err := rt.Client.CloudFlareClient.Get(rt.Ctx, path, nil, &token); err != nil {
+		logger.Warn("cannot read API token permissions; skipping permission probe", slog.String("error", err.Error()))
+		return nil
+	}
+
+	granted := make(map[string]bool)
+	for _, policy := range token.Result.Policies {
+		if policy.Effect != "allow" {
+			continue
+		}
+		for _, group := range policy.PermissionGroups {
+			granted[strings.ToLower(group.Name)] = true
+		}
+	}
+
+	disable := rt.Config.PermissionProbe == config.PermissionProbeDisable
+	if !granted["dns write"] {
+		logger.Warn("API token lacks the DNS Write permission; DNS sync will fail", slog.Bool("disabled", disable))
+		rt.DNSSyncDisabled = disable
+	}
+	if !granted["cloudflare tunnel write"] && !granted["argo tunnel write"] {
+		logger.Warn("API token lacks the Cloudflare Tunnel Write permission; tunnel sync will fail", slog.Bool("disabled", disable))
+		rt.TunnelSyncDisabled = disable
+	}
+	return nil
+}
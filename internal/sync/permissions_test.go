@@ -0,0 +1,76 @@
+package sync
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestProbePermissions(t *testing.T) {
+	tests := []struct {
+		name               string
+		probe              string
+		policies           []string
+		wantDNSDisabled    bool
+		wantTunnelDisabled bool
+		wantWarnings       []string
+	}{
+		{
+			name:     "all permissions",
+			probe:    "disable",
+			policies: []string{"DNS Write", "Cloudflare Tunnel Write"},
+		},
+		{
+			name:            "missing DNS edit disables DNS sync",
+			probe:           "disable",
+			policies:        []string{"DNS Read", "Cloudflare Tunnel Write"},
+			wantDNSDisabled: true,
+			wantWarnings:    []string{"lacks the DNS Write permission"},
+		},
+		{
+			name:         "missing DNS edit only warns",
+			probe:        "warn",
+			policies:     []string{"DNS Read", "Argo Tunnel Write"},
+			wantWarnings: []string{"lacks the DNS Write permission"},
+		},
+		{
+			name:               "missing tunnel edit disables tunnel sync",
+			probe:              "disable",
+			policies:           []string{"DNS Write"},
+			wantTunnelDisabled: true,
+			wantWarnings:       []string{"lacks the Cloudflare Tunnel Write permission"},
+		},
+		{
+			name:  "off",
+			probe: "off",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"PERMISSION_PROBE": tt.probe})
+			cf.tokenPolicies = tt.policies
+			var buf bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+			if err := ProbePermissions(rt); err != nil {
+				t.Fatalf("ProbePermissions: %v", err)
+			}
+
+			if rt.DNSSyncDisabled != tt.wantDNSDisabled {
+				t.Errorf("DNSSyncDisabled = %v, want %v", rt.DNSSyncDisabled, tt.wantDNSDisabled)
+			}
+			if rt.TunnelSyncDisabled != tt.wantTunnelDisabled {
+				t.Errorf("TunnelSyncDisabled = %v, want %v", rt.TunnelSyncDisabled, tt.wantTunnelDisabled)
+			}
+			if got := strings.Count(buf.String(), "level=WARN"); got != len(tt.wantWarnings) {
+				t.Errorf("logged %d warnings, want %d: %s", got, len(tt.wantWarnings), buf.String())
+			}
+			for _, want := range tt.wantWarnings {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("log %q does not contain %q", buf.String(), want)
+				}
+			}
+		})
+	}
+}
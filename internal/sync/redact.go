@@ -0,0 +1,71 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"tunnel/internal/runtime"
+)
+
+// hostnameAttr builds the "hostname" log attribute, redacting the hostname
+// if LOG_REDACT_HOSTNAMES is enabled. zone is the zone the hostname belongs
+// to, if known.
+func hostnameAttr(rt *runtime.Runtime, hostname, zone string) slog.Attr {
+	return slog.String("hostname", logHostname(rt, hostname, zone))
+}
+
+// logHostname returns hostname as it may appear in log lines and error
+// messages: redacted if LOG_REDACT_HOSTNAMES is enabled, as is otherwise.
+func logHostname(rt *runtime.Runtime, hostname, zone string) string {
+	if rt.Config == nil || !rt.Config.LogRedactHostnames {
+		return hostname
+	}
+	return redactHostname(hostname, zone)
+}
+
+// redirectAttr builds the "redirectTo" log attribute, redacting the host of
+// the redirect target URL if LOG_REDACT_HOSTNAMES is enabled.
+func redirectAttr(rt *runtime.Runtime, redirectTo string) slog.Attr {
+	if rt.Config == nil || !rt.Config.LogRedactHostnames || redirectTo == "" {
+		return slog.String("redirectTo", redirectTo)
+	}
+	u, err := url.Parse(redirectTo)
+	if err != nil || u.Hostname() == "" {
+		return slog.String("redirectTo", "redacted")
+	}
+	host := redactHostname(u.Hostname(), "")
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
+	return slog.String("redirectTo", u.String())
+}
+
+// redactHostname replaces the subdomain part of hostname with a short hash,
+// keeping the zone suffix so that log lines remain useful for debugging.
+// If zone is empty, the last two labels are kept.
+//
+// The hash keeps distinct hostnames distinguishable across log lines without
+// revealing them.
+func redactHostname(hostname, zone string) string {
+	hostname = normalizeHost(hostname)
+	zone = normalizeHost(zone)
+
+	suffix := zone
+	if suffix == "" || !strings.HasSuffix(hostname, "."+suffix) {
+		if hostname == suffix && suffix != "" {
+			return hostname
+		}
+		labels := strings.Split(hostname, ".")
+		if len(labels) <= 2 {
+			return hostname
+		}
+		suffix = strings.Join(labels[len(labels)-2:], ".")
+	}
+
+	sum := sha256.Sum256([]byte(hostname))
+	return "redacted-" + hex.EncodeToString(sum[:4]) + "." + suffix
+}
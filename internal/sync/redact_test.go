@@ -0,0 +1,106 @@
+package sync
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"tunnel/internal/config"
+	"tunnel/internal/runtime"
+)
+
+func TestRedactHostname(t *testing.T) {
+	tests := []struct {
+		name       string
+		hostname   string
+		zone       string
+		wantSuffix string
+		wantPlain  bool
+	}{
+		{name: "subdomain of zone", hostname: "app.example.com", zone: "example.com", wantSuffix: ".example.com"},
+		{name: "nested subdomain of zone", hostname: "a.b.example.co.uk", zone: "example.co.uk", wantSuffix: ".example.co.uk"},
+		{name: "unknown zone keeps two labels", hostname: "app.internal.example.com", wantSuffix: ".example.com"},
+		{name: "apex is kept", hostname: "example.com", zone: "example.com", wantPlain: true},
+		{name: "two labels are kept", hostname: "example.com", wantPlain: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactHostname(tt.hostname, tt.zone)
+			if tt.wantPlain {
+				if got != tt.hostname {
+					t.Errorf("redactHostname(%q, %q) = %q, want it unchanged", tt.hostname, tt.zone, got)
+				}
+				return
+			}
+			if !strings.HasPrefix(got, "redacted-") || !strings.HasSuffix(got, tt.wantSuffix) {
+				t.Errorf("redactHostname(%q, %q) = %q, want redacted-<hash>%s", tt.hostname, tt.zone, got, tt.wantSuffix)
+			}
+			if strings.Contains(got, strings.TrimSuffix(tt.hostname, tt.wantSuffix)) {
+				t.Errorf("redactHostname(%q, %q) = %q leaks the subdomain", tt.hostname, tt.zone, got)
+			}
+			if again := redactHostname(tt.hostname, tt.zone); again != got {
+				t.Errorf("redactHostname is not stable: %q != %q", again, got)
+			}
+		})
+	}
+
+	if redactHostname("a.example.com", "example.com") == redactHostname("b.example.com", "example.com") {
+		t.Errorf("distinct hostnames redact to the same name")
+	}
+}
+
+func TestRedirectAttr(t *testing.T) {
+	tests := []struct {
+		name       string
+		redact     bool
+		redirectTo string
+		want       string
+	}{
+		{name: "disabled", redirectTo: "https://secret.example.com/path", want: "https://secret.example.com/path"},
+		{name: "empty", redact: true, redirectTo: "", want: ""},
+		{name: "host is redacted", redact: true, redirectTo: "https://secret.example.com/path", want: "https://" + redactHostname("secret.example.com", "") + "/path"},
+		{name: "port is kept", redact: true, redirectTo: "https://secret.example.com:8443/", want: "https://" + redactHostname("secret.example.com", "") + ":8443/"},
+		{name: "unparsable target", redact: true, redirectTo: "secret.example.com/path", want: "redacted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &runtime.Runtime{Config: &config.Config{LogRedactHostnames: tt.redact}}
+			if got := redirectAttr(rt, tt.redirectTo).Value.String(); got != tt.want {
+				t.Errorf("redirectAttr(%q) = %q, want %q", tt.redirectTo, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncDNSRedactsHostnames(t *testing.T) {
+	tests := []struct {
+		name     string
+		redact   string
+		wantLeak bool
+	}{
+		{name: "redacted", redact: "true", wantLeak: false},
+		{name: "not redacted", redact: "false", wantLeak: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"LOG_REDACT_HOSTNAMES": tt.redact})
+			var logs bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			cf.fail(http.MethodPost, "/dns_records", http.StatusInternalServerError, 0)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "secret-app.example.com")
+			err := SyncDNS(rt, state)
+			if err == nil {
+				t.Fatalf("SyncDNS succeeded, want the create failure")
+			}
+
+			if leaked := strings.Contains(err.Error(), "secret-app"); leaked != tt.wantLeak {
+				t.Errorf("error %q contains the hostname = %v, want %v", err, leaked, tt.wantLeak)
+			}
+			if leaked := strings.Contains(logs.String(), "secret-app"); leaked != tt.wantLeak {
+				t.Errorf("logs contain the hostname = %v, want %v:\n%s", leaked, tt.wantLeak, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"tunnel/internal/runtime"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+)
+
+// redirectPhase is the ruleset phase holding single redirect rules.
+const redirectPhase = "http_request_dynamic_redirect"
+
+// Rules are kept as generic maps so that unmanaged rules are sent back to
+// Cloudflare unchanged.
+type redirectRulesetResponse struct {
+	Result struct {
+		Rules []map[string]any `json:"rules"`
+	} `json:"result"`
+}
+
+// syncZoneRedirects reconciles the managed single redirect rules of a zone
+// with the redirect hostnames in SyncState. Managed rules carry the managed
+// marker in their description; all other rules are left untouched.
+func syncZoneRedirects(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID, zoneName string,
+	hosts []string,
+	state *SyncState,
+) error {
+	logger := rt.LoggerFor(moduleDNS)
+
+	existing, err := loadRedirectRules(rt, client, zoneID)
+	if err != nil {
+		return fmt.Errorf("loading redirect rules: %w", err)
+	}
+
+	rules := make([]map[string]any, 0, len(existing))
+	current := make(map[string]string) // description -> target URL
+	for _, rule := range existing {
+		desc, _ := rule["description"].(string)
+		if !isManagedComment(rt, redirectRuleMarker(desc)) {
+			rules = append(rules, rule)
+			continue
+		}
+		current[desc] = redirectRuleTarget(rule)
+	}
+
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+
+	desired := make(map[string]string)
+	for _, host := range sorted {
+		redirectTo := state.Hosts[host].RedirectTo
+		if redirectTo == "" {
+			continue
+		}
+		rule := newRedirectRule(rt, host, redirectTo)
+		desired[rule["description"].(string)] = redirectTo
+		rules = append(rules, rule)
+	}
+
+	if maps.Equal(current, desired) {
+		logger.Debug("managed redirect rules up to date; no change",
+			"zone_id", zoneID,
+			"zone_name", zoneName,
+		)
+		return nil
+	}
+
+	logger.Info("updating managed redirect rules",
+		"zone_id", zoneID,
+		"zone_name", zoneName,
+		"old_count", len(current),
+		"new_count", len(desired),
+	)
+
+	var resp struct {
+		Success bool `json:"success"`
+	}
+	path := fmt.Sprintf("/zones/%s/rulesets/phases/%s/entrypoint", url.PathEscape(zoneID), redirectPhase)
+	if err := client.Put(rt.Ctx, path, map[string]any{"rules": rules}, &resp); err != nil {
+		return fmt.Errorf("PUT %s: %w", path, err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("Cloudflare API reported failure updating redirect rules")
+	}
+	rt.Changes++
+	return nil
+}
+
+// loadRedirectRules loads the rules of the zone's redirect entrypoint
+// ruleset. A missing entrypoint yields no rules.
+func loadRedirectRules(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID string,
+) ([]map[string]any, error) {
+	var resp redirectRulesetResponse
+	path := fmt.Sprintf("/zones/%s/rulesets/phases/%s/entrypoint", url.PathEscape(zoneID), redirectPhase)
+	if err := client.Get(rt.Ctx, path, nil, &resp); err != nil {
+		var apiErr *cloudflare.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GET %s: %w", path, err)
+	}
+
+	// Drop read-only fields so the rules can be sent back as they are.
+	for _, rule := range resp.Result.Rules {
+		delete(rule, "version")
+		delete(rule, "last_updated")
+	}
+	return resp.Result.Rules, nil
+}
+
+// newRedirectRule builds a managed single redirect rule for hostname.
+func newRedirectRule(rt *runtime.Runtime, hostname, redirectTo string) map[string]any {
+	return map[string]any{
+		"action":      "redirect",
+		"expression":  fmt.Sprintf("(http.host eq %q)", hostname),
+		"description": managedComment(rt) + ": " + hostname,
+		"enabled":     true,
+		"action_parameters": map[string]any{
+			"from_value": map[string]any{
+				"target_url": map[string]any{
+					"value": redirectTo,
+				},
+				"status_code":           http.StatusMovedPermanently,
+				"preserve_query_string": true,
+			},
+		},
+	}
+}
+
+// redirectRuleMarker returns the managed marker part of the description of
+// a redirect rule, without the ": <hostname>" suffix added by
+// newRedirectRule.
+func redirectRuleMarker(description string) string {
+	if i := strings.LastIndex(description, ": "); i >= 0 {
+		return description[:i]
+	}
+	return description
+}
+
+// redirectRuleTarget extracts the static target URL of a redirect rule.
+func redirectRuleTarget(rule map[string]any) string {
+	params, _ := rule["action_parameters"].(map[string]any)
+	from, _ := params["from_value"].(map[string]any)
+	target, _ := from["target_url"].(map[string]any)
+	value, _ := target["value"].(string)
+	return value
+}
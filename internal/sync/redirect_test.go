@@ -0,0 +1,94 @@
+package sync
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestSyncDNSRedirectRules(t *testing.T) {
+	unmanaged := map[string]any{"action": "redirect", "expression": "(http.host eq \"legacy.example.com\")", "description": "added by hand"}
+	managed := func(host, target string) map[string]any {
+		return map[string]any{
+			"action":      "redirect",
+			"description": "managed by tunnel-manager: " + host,
+			"action_parameters": map[string]any{
+				"from_value": map[string]any{"target_url": map[string]any{"value": target}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		existing  []any // nil means no entrypoint ruleset
+		redirects map[string]string
+		wantPut   bool
+		wantRules []string // descriptions, in order
+	}{
+		{
+			name:      "create",
+			redirects: map[string]string{"www.example.com": "https://example.com"},
+			wantPut:   true,
+			wantRules: []string{"managed by tunnel-manager: www.example.com"},
+		},
+		{
+			name:      "unchanged",
+			existing:  []any{managed("www.example.com", "https://example.com")},
+			redirects: map[string]string{"www.example.com": "https://example.com"},
+			wantPut:   false,
+			wantRules: []string{"managed by tunnel-manager: www.example.com"},
+		},
+		{
+			name:      "retarget",
+			existing:  []any{managed("www.example.com", "https://old.example.com")},
+			redirects: map[string]string{"www.example.com": "https://example.com"},
+			wantPut:   true,
+			wantRules: []string{"managed by tunnel-manager: www.example.com"},
+		},
+		{
+			name:      "delete keeps unmanaged rules",
+			existing:  []any{unmanaged, managed("old.example.com", "https://example.com")},
+			wantPut:   true,
+			wantRules: []string{"added by hand"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"REDIRECTS_ENABLED": "true"})
+			if tt.existing != nil {
+				cf.redirectRules[testZoneID] = tt.existing
+			}
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			for host, target := range tt.redirects {
+				state.Hosts[host] = HostConfig{RedirectTo: target}
+			}
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if gotPut := len(cf.requestsMatching(http.MethodPut, "/rulesets/")) > 0; gotPut != tt.wantPut {
+				t.Errorf("ruleset PUT = %v, want %v", gotPut, tt.wantPut)
+			}
+			var descriptions []string
+			for _, rule := range cf.redirectRules[testZoneID] {
+				desc, _ := rule.(map[string]any)["description"].(string)
+				descriptions = append(descriptions, desc)
+			}
+			if !slices.Equal(descriptions, tt.wantRules) {
+				t.Errorf("rules = %q, want %q", descriptions, tt.wantRules)
+			}
+
+			for host := range tt.redirects {
+				rec, ok := cf.record(testZoneID, "CNAME", host)
+				if !ok {
+					t.Errorf("no CNAME record for redirect %s", host)
+					continue
+				}
+				if !rec.Proxied || !isManagedComment(rt, rec.Comment) {
+					t.Errorf("redirect record %+v is not proxied and managed", rec)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package sync
+
+import (
+	"fmt"
+	"tunnel/internal/runtime"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tunnelConfigSecretKey is the key of the TUNNEL_CONFIG_SECRET data holding
+// the applied tunnel configuration.
+const tunnelConfigSecretKey = "config.json"
+
+// writeTunnelConfigSecret upserts the TUNNEL_CONFIG_SECRET Secret with the
+// tunnel configuration last applied, for audit and rollback.
+func writeTunnelConfigSecret(rt *runtime.Runtime, applied []byte) error {
+	secrets := rt.Client.KubeClient.CoreV1().Secrets(rt.Config.TunnelConfigSecretNamespace)
+	name := rt.Config.TunnelConfigSecret
+
+	secret, err := secrets.Get(rt.Ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: rt.Config.TunnelConfigSecretNamespace,
+			},
+			Data: map[string][]byte{tunnelConfigSecretKey: applied},
+		}
+		if _, err := secrets.Create(rt.Ctx, secret, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create tunnel config secret: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel config secret: %w", err)
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[tunnelConfigSecretKey] = applied
+	if _, err := secrets.Update(rt.Ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update tunnel config secret: %w", err)
+	}
+	return nil
+}
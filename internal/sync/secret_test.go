@@ -0,0 +1,101 @@
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// secretWrites returns the number of Secret creations and updates made
+// through kube.
+func secretWrites(kube *fake.Clientset) int {
+	n := 0
+	for _, action := range kube.Actions() {
+		if action.GetResource().Resource == "secrets" && (action.GetVerb() == "create" || action.GetVerb() == "update") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSyncTunnelConfigSecret(t *testing.T) {
+	existing := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "tunnel-config", Namespace: "default"},
+		Data:       map[string][]byte{"note": []byte("kept"), tunnelConfigSecretKey: []byte("{}")},
+	}
+	app := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+	appAndAPI := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com", "api.example.com")
+
+	tests := []struct {
+		name     string
+		existing *corev1.Secret
+		cycles   []*SyncState
+		// wantWrites is the number of Secret writes after each cycle.
+		wantWrites []int
+	}{
+		{name: "created", cycles: []*SyncState{app}, wantWrites: []int{1}},
+		{name: "updated on the first sync", existing: existing, cycles: []*SyncState{app}, wantWrites: []int{1}},
+		{name: "written only on change", cycles: []*SyncState{app, app, appAndAPI, appAndAPI}, wantWrites: []int{1, 1, 2, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"TUNNEL_CONFIG_SECRET": "tunnel-config", "TUNNEL_CONFIG_SECRET_NAMESPACE": "default"}
+			rt, cf := newTestRuntime(t, env)
+			kube := rt.Client.KubeClient.(*fake.Clientset)
+			if tt.existing != nil {
+				kube.Tracker().Add(tt.existing.DeepCopy())
+			}
+
+			for i, state := range tt.cycles {
+				if err := SyncTunnel(rt, state); err != nil {
+					t.Fatalf("cycle %d: SyncTunnel: %v", i+1, err)
+				}
+				if got := secretWrites(kube); got != tt.wantWrites[i] {
+					t.Errorf("cycle %d: %d Secret writes, want %d", i+1, got, tt.wantWrites[i])
+				}
+			}
+
+			secret, err := kube.CoreV1().Secrets("default").Get(t.Context(), "tunnel-config", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get Secret: %v", err)
+			}
+			var stored map[string]any
+			if err := json.Unmarshal(secret.Data[tunnelConfigSecretKey], &stored); err != nil {
+				t.Fatalf("Secret does not hold JSON: %v", err)
+			}
+			if !reflect.DeepEqual(stored, cf.tunnelConfig) {
+				t.Errorf("Secret holds %v, want the applied config %v", stored, cf.tunnelConfig)
+			}
+			if tt.existing != nil && string(secret.Data["note"]) != "kept" {
+				t.Errorf("other Secret data not kept: %v", secret.Data)
+			}
+		})
+	}
+}
+
+func TestSyncTunnelConfigSecretNotWrittenOnFailure(t *testing.T) {
+	env := map[string]string{"TUNNEL_CONFIG_SECRET": "tunnel-config", "TUNNEL_CONFIG_SECRET_NAMESPACE": "default"}
+	rt, cf := newTestRuntime(t, env)
+	cf.fail(http.MethodPut, tunnelPath+"/configurations", http.StatusInternalServerError, 1)
+	state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+
+	if err := SyncTunnel(rt, state); err == nil {
+		t.Fatalf("SyncTunnel succeeded, want the write to fail")
+	}
+	if got := secretWrites(rt.Client.KubeClient.(*fake.Clientset)); got != 0 {
+		t.Errorf("%d Secret writes after a failed tunnel update, want 0", got)
+	}
+
+	// The next successful sync writes it.
+	if err := SyncTunnel(rt, state); err != nil {
+		t.Fatalf("SyncTunnel: %v", err)
+	}
+	if got := secretWrites(rt.Client.KubeClient.(*fake.Clientset)); got != 1 {
+		t.Errorf("%d Secret writes, want 1", got)
+	}
+}
@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"log/slog"
+	"tunnel/internal/runtime"
+)
+
+// Reasons for skipping a service or hostname, see runtime.SkippedItem.
+const (
+	skipReasonDNSAndIngressOnly    = "both dns-only and ingress-only"
+	skipReasonInvalidRedirect      = "invalid redirect annotation"
+	skipReasonInvalidMTLS          = "invalid mTLS annotations"
+	skipReasonTLSPassthrough       = "tls-passthrough combined with incompatible annotations"
+	skipReasonEndpointsError       = "failed to read endpoints"
+	skipReasonNoEndpoints          = "selector-less service has no endpoints"
+	skipReasonNoPort               = "no usable port"
+	skipReasonNoPortAnnotation     = "missing upstream port annotation"
+	skipReasonBadPortAnnotation    = "invalid upstream port annotation"
+	skipReasonInvalidURL           = "invalid service URL"
+	skipReasonConflict             = "hostname conflict"
+	skipReasonExcluded             = "excluded by pattern"
+	skipReasonNoZone               = "no matching zone"
+	skipReasonExternalDNS          = "owned by external-dns"
+	skipReasonAorAAAA              = "A/AAAA conflict"
+	skipReasonRecreateNotDeletable = "recreate requires A/AAAA in DELETABLE_RECORD_TYPES"
+	skipReasonMXorNS               = "MX/NS conflict"
+	skipReasonOtherType            = "conflict with other record types"
+	skipReasonApex                 = "zone apex"
+	skipReasonUnmanaged            = "existing unmanaged CNAME"
+	skipReasonCreateFailed         = "CNAME creation failed"
+)
+
+// skipService records a service, or one of its hostnames if hostname is
+// set, skipped while reading Kubernetes state.
+func skipService(rt *runtime.Runtime, namespace, service, hostname, reason string) {
+	rt.Skip(runtime.SkippedItem{
+		Phase:     moduleKube,
+		Namespace: namespace,
+		Service:   service,
+		Hostname:  hostname,
+		Reason:    reason,
+	})
+}
+
+// skipHostname records a hostname skipped while syncing DNS.
+func skipHostname(rt *runtime.Runtime, hostname, reason string) {
+	rt.Skip(runtime.SkippedItem{
+		Phase:    moduleDNS,
+		Hostname: hostname,
+		Reason:   reason,
+	})
+}
+
+// failHostnames records the hostnames whose sync failed with err.
+func failHostnames(rt *runtime.Runtime, hostnames []string, err error) {
+	for _, hostname := range hostnames {
+		rt.Fail(normalizeHost(hostname), err)
+	}
+}
+
+// PrintSkipped logs the services and hostnames skipped during the current
+// sync cycle. For zones skipped by SKIP_UNCHANGED_ZONES, the hostnames
+// skipped when the zone was last reconciled are reported again.
+func PrintSkipped(rt *runtime.Runtime) {
+	for _, item := range rt.Skipped {
+		rt.Logger.Info("skipped",
+			slog.String("phase", item.Phase),
+			slog.String("namespace", item.Namespace),
+			slog.String("service", item.Service),
+			hostnameAttr(rt, item.Hostname, ""),
+			slog.String("reason", item.Reason),
+		)
+	}
+}
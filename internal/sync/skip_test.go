@@ -0,0 +1,52 @@
+package sync
+
+import (
+	"slices"
+	"testing"
+	"tunnel/internal/runtime"
+)
+
+func TestSyncSkippedItems(t *testing.T) {
+	noPort := newService("default", "no-port", 80, map[string]string{"cloudflare-tunnel-hostnames": "noport.example.com"})
+	noPort.Spec.Ports = nil
+	rt, cf := newTestRuntime(t, nil,
+		newNamespace("default"),
+		noPort,
+		newService("default", "both-only", 80, map[string]string{
+			"cloudflare-tunnel-hostnames":    "both.example.com",
+			"cloudflare-tunnel-dns-only":     "true",
+			"cloudflare-tunnel-ingress-only": "true",
+		}),
+		newService("default", "a-app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+		newService("default", "b-app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+		newService("default", "legacy", 80, map[string]string{"cloudflare-tunnel-hostnames": "legacy.example.com"}),
+		newService("default", "foreign", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.org"}),
+	)
+	cf.addRecords(testZoneID, dnsRecord{ID: "rec-a", Type: "A", Name: "legacy.example.com", Content: "192.0.2.1", TTL: 1})
+
+	state, err := SyncKube(rt)
+	if err != nil {
+		t.Fatalf("SyncKube: %v", err)
+	}
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("SyncDNS: %v", err)
+	}
+
+	tests := []runtime.SkippedItem{
+		{Phase: moduleKube, Namespace: "default", Service: "no-port", Reason: skipReasonNoPort},
+		{Phase: moduleKube, Namespace: "default", Service: "both-only", Reason: skipReasonDNSAndIngressOnly},
+		{Phase: moduleKube, Namespace: "default", Service: "b-app", Hostname: "app.example.com", Reason: skipReasonConflict},
+		{Phase: moduleDNS, Hostname: "legacy.example.com", Reason: skipReasonAorAAAA},
+		{Phase: moduleDNS, Hostname: "app.example.org", Reason: skipReasonNoZone},
+	}
+	for _, want := range tests {
+		t.Run(want.Reason, func(t *testing.T) {
+			if !slices.Contains(rt.Skipped, want) {
+				t.Errorf("skipped items %+v do not contain %+v", rt.Skipped, want)
+			}
+		})
+	}
+	if len(rt.Skipped) != len(tests) {
+		t.Errorf("skipped %d items, want %d: %+v", len(rt.Skipped), len(tests), rt.Skipped)
+	}
+}
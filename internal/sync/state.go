@@ -3,34 +3,77 @@ package sync
 import (
 	"fmt"
 	"log/slog"
+	"tunnel/internal/runtime"
 )
 
-// SyncState represents desired DNS/tunnel state: hostname -> service.
-// Service is carried mostly for logging/context purposes in this module.
+// HostConfig is the desired configuration of a single hostname.
+type HostConfig struct {
+	// Service is the upstream service URL used in the tunnel ingress rule.
+	Service string
+	// RedirectTo, if set, makes the hostname a redirect to this URL instead
+	// of a tunnel ingress rule.
+	RedirectTo string
+	// DNSOnly hostnames get a managed CNAME but no tunnel ingress rule.
+	DNSOnly bool
+	// IngressOnly hostnames get a tunnel ingress rule but no managed CNAME.
+	IngressOnly bool
+	// TXT, if set, is the content of a managed TXT record created alongside
+	// the CNAME, at TXT_RECORD_PREFIX.<hostname>.
+	TXT string
+	// ServiceType is the type of the Kubernetes service the hostname comes
+	// from, e.g. "ClusterIP" or "LoadBalancer".
+	ServiceType string
+	// OriginRequest holds the originRequest settings of the tunnel ingress
+	// rule, e.g. the mTLS caPool/clientCert/clientKey paths or noTLSVerify.
+	OriginRequest map[string]any
+	// Proxied, if set, overrides the default proxied flag of the managed
+	// CNAME, see resolveProxied.
+	Proxied *bool
+	// TLSPassthrough hostnames are routed to the service as raw TCP, so TLS
+	// is terminated by the service itself. Their CNAME stays proxied, as a
+	// tunnel hostname only resolves through Cloudflare's edge; clients
+	// reach them with `cloudflared access tcp`.
+	TLSPassthrough bool
+	// Recreate allows replacing managed records of the wrong type (A/AAAA)
+	// at the hostname by the CNAME.
+	Recreate bool
+	// Source identifies the Kubernetes service the hostname comes from, as
+	// "namespace/name:port" (or "namespace/name" for redirects).
+	Source string
+}
+
+// SyncState represents desired DNS/tunnel state: hostname -> host config.
 type SyncState struct {
-	HostToService map[string]string
+	Hosts map[string]HostConfig
 }
 
 func NewSyncState() *SyncState {
 	return &SyncState{
-		HostToService: make(map[string]string),
+		Hosts: make(map[string]HostConfig),
 	}
 }
 
 func (s *SyncState) Len() int {
-	return len(s.HostToService)
+	return len(s.Hosts)
 }
 
-func (s *SyncState) Append(hostname, service string) error {
-	if _, exists := s.HostToService[hostname]; exists {
-		return fmt.Errorf("hostname %q is already mapped to service %q", hostname, s.HostToService[hostname])
+// Append maps hostname to host, failing if hostname is already mapped. The
+// error leaves the hostname out, so that it can be logged as is regardless
+// of LOG_REDACT_HOSTNAMES.
+func (s *SyncState) Append(hostname string, host HostConfig) error {
+	if existing, exists := s.Hosts[hostname]; exists {
+		return fmt.Errorf("hostname is already mapped to service %q", existing.Service)
 	}
-	s.HostToService[hostname] = service
+	s.Hosts[hostname] = host
 	return nil
 }
 
-func (s *SyncState) Print(logger *slog.Logger) {
-	for host, service := range s.HostToService {
-		logger.Info("hostname -> service", slog.String("hostname", host), slog.String("service", service))
+func (s *SyncState) Print(runtime *runtime.Runtime) {
+	for hostname, host := range s.Hosts {
+		if host.RedirectTo != "" {
+			runtime.Logger.Info("hostname -> redirect", hostnameAttr(runtime, hostname, ""), redirectAttr(runtime, host.RedirectTo))
+			continue
+		}
+		runtime.Logger.Info("hostname -> service", hostnameAttr(runtime, hostname, ""), slog.String("service", host.Service))
 	}
 }
@@ -0,0 +1,136 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"tunnel/internal/runtime"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Service statuses written to SERVICE_STATUS_ANNOTATION, followed by ": " and
+// the reason for skipped and error.
+const (
+	serviceStatusPublished = "published"
+	serviceStatusSkipped   = "skipped"
+	serviceStatusError     = "error"
+)
+
+// WriteServiceStatus writes the outcome of the current sync cycle to the
+// SERVICE_STATUS_ANNOTATION of each service in state or skipped during the
+// cycle. A service is in error if the sync of one of its hostnames failed,
+// see runtime.Fail, or if stateErr, an error preventing the whole state
+// from being applied, is set. Services are only patched when their status
+// changes, and the annotation is removed from services we no longer see.
+func WriteServiceStatus(rt *runtime.Runtime, state *SyncState, stateErr error) {
+	logger := rt.LoggerFor(moduleKube)
+
+	statuses := make(map[string]string)
+	// Hostnames skipped while syncing DNS are normalized, see dnsHosts.
+	sources := make(map[string]string, len(state.Hosts)) // normalized hostname -> source
+	for hostname, host := range state.Hosts {
+		sources[normalizeHost(hostname)] = host.Source
+		service, _, _ := strings.Cut(host.Source, ":")
+		if service != "" {
+			statuses[service] = serviceStatusPublished
+		}
+	}
+	for _, item := range rt.Skipped {
+		service := item.Namespace + "/" + item.Service
+		if item.Service == "" {
+			// Hostnames skipped while syncing DNS.
+			source, ok := sources[item.Hostname]
+			if !ok {
+				continue
+			}
+			service, _, _ = strings.Cut(source, ":")
+		}
+		reason := item.Reason
+		if item.Hostname != "" {
+			reason = item.Hostname + ": " + reason
+		}
+		statuses[service] = serviceStatusSkipped + ": " + reason
+	}
+	hostnames := slices.Sorted(maps.Keys(state.Hosts))
+	for _, hostname := range slices.Backward(hostnames) {
+		// Iterated backwards so that the first failed hostname of a
+		// service, in order, ends up in its status.
+		reason, ok := rt.Failed[normalizeHost(hostname)]
+		if !ok {
+			continue
+		}
+		service, _, _ := strings.Cut(state.Hosts[hostname].Source, ":")
+		if service != "" {
+			statuses[service] = serviceStatusError + ": " + hostname + ": " + strings.ReplaceAll(reason, "\n", "; ")
+		}
+	}
+	if stateErr != nil {
+		reason := strings.ReplaceAll(stateErr.Error(), "\n", "; ")
+		for service := range statuses {
+			statuses[service] = serviceStatusError + ": " + reason
+		}
+	}
+
+	if rt.ServiceStatuses == nil {
+		rt.ServiceStatuses = make(map[string]string)
+	}
+	for service, status := range statuses {
+		if rt.ServiceStatuses[service] == status {
+			continue
+		}
+		namespace, name, _ := strings.Cut(service, "/")
+		if err := patchServiceStatus(rt, namespace, name, status); err != nil {
+			logger.Warn("failed to write service status",
+				slog.String("namespace", namespace),
+				slog.String("service", name),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		rt.ServiceStatuses[service] = status
+	}
+
+	for service := range rt.ServiceStatuses {
+		if _, ok := statuses[service]; ok {
+			continue
+		}
+		namespace, name, _ := strings.Cut(service, "/")
+		if err := patchServiceStatus(rt, namespace, name, ""); err != nil && !apierrors.IsNotFound(err) {
+			logger.Warn("failed to clear service status",
+				slog.String("namespace", namespace),
+				slog.String("service", name),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		delete(rt.ServiceStatuses, service)
+	}
+}
+
+// patchServiceStatus sets the SERVICE_STATUS_ANNOTATION of a service, or
+// removes it if status is empty.
+func patchServiceStatus(rt *runtime.Runtime, namespace, name, status string) error {
+	var value any = status
+	if status == "" {
+		value = nil
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{rt.Config.ServiceStatusAnnotation: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	services := rt.Client.KubeClient.CoreV1().Services(namespace)
+	if _, err := services.Patch(rt.Ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch service: %w", err)
+	}
+	return nil
+}
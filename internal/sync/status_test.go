@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+	"tunnel/internal/runtime"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// syncStatusCycle runs a Kubernetes and DNS sync and writes the service
+// statuses, like a sync cycle with WRITE_SERVICE_STATUS enabled.
+func syncStatusCycle(t *testing.T, rt *runtime.Runtime, stateErr error) {
+	t.Helper()
+	rt.Skipped, rt.Failed = nil, nil
+	state, err := SyncKube(rt)
+	if err != nil {
+		t.Fatalf("SyncKube: %v", err)
+	}
+	if stateErr == nil {
+		// Failures of single hostnames are reported in the statuses.
+		SyncDNS(rt, state)
+	}
+	WriteServiceStatus(rt, state, stateErr)
+}
+
+// serviceStatuses returns the status annotation of each service in the
+// default namespace, "" if unset.
+func serviceStatuses(t *testing.T, rt *runtime.Runtime) map[string]string {
+	t.Helper()
+	services, err := rt.Client.KubeClient.CoreV1().Services("default").List(t.Context(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list services: %v", err)
+	}
+	statuses := make(map[string]string)
+	for _, svc := range services.Items {
+		statuses[svc.Name] = svc.Annotations["cloudflare-tunnel-status"]
+	}
+	return statuses
+}
+
+func TestWriteServiceStatus(t *testing.T) {
+	noPort := newService("default", "no-port", 80, map[string]string{"cloudflare-tunnel-hostnames": "noport.example.com"})
+	noPort.Spec.Ports = nil
+	rt, cf := newTestRuntime(t, nil,
+		newNamespace("default"),
+		newService("default", "app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+		newService("default", "api", 80, map[string]string{"cloudflare-tunnel-hostnames": "api.example.com"}),
+		newService("default", "legacy", 80, map[string]string{"cloudflare-tunnel-hostnames": "legacy.example.com"}),
+		newService("default", "plain", 80, nil),
+		noPort,
+	)
+	cf.addRecords(testZoneID,
+		managedCNAME("rec-app", "app.example.com"),
+		dnsRecord{ID: "rec-a", Type: "A", Name: "legacy.example.com", Content: "192.0.2.1", TTL: 1},
+	)
+
+	// Only the creation of api.example.com fails.
+	cf.fail(http.MethodPost, "/dns_records", http.StatusInternalServerError, 1)
+	syncStatusCycle(t, rt, nil)
+	got := serviceStatuses(t, rt)
+	want := map[string]string{
+		"app":     "published",
+		"api":     "error: api.example.com: ",
+		"legacy":  "skipped: legacy.example.com: " + skipReasonAorAAAA,
+		"no-port": "skipped: " + skipReasonNoPort,
+		"plain":   "",
+	}
+	for name, status := range want {
+		if !strings.HasPrefix(got[name], status) || (status == "") != (got[name] == "") {
+			t.Errorf("cycle 1: %s status = %q, want %q", name, got[name], status)
+		}
+	}
+
+	// The next cycle succeeds, and no-port is no longer annotated.
+	svc, err := rt.Client.KubeClient.CoreV1().Services("default").Get(t.Context(), "no-port", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(svc.Annotations, "cloudflare-tunnel-hostnames")
+	if _, err := rt.Client.KubeClient.CoreV1().Services("default").Update(t.Context(), svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	syncStatusCycle(t, rt, nil)
+	got = serviceStatuses(t, rt)
+	want = map[string]string{
+		"app":     "published",
+		"api":     "published",
+		"legacy":  "skipped: legacy.example.com: " + skipReasonAorAAAA,
+		"no-port": "",
+		"plain":   "",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("cycle 2: statuses = %v, want %v", got, want)
+	}
+
+	// Unchanged statuses are not patched again.
+	kube := rt.Client.KubeClient.(*fake.Clientset)
+	kube.ClearActions()
+	syncStatusCycle(t, rt, nil)
+	for _, action := range kube.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("cycle 3: unchanged status patched: %v", action)
+		}
+	}
+
+	// An error preventing the whole state from being applied is reported on
+	// every service.
+	syncStatusCycle(t, rt, errors.New("desired state exceeds MAX_TOTAL_HOSTNAMES"))
+	got = serviceStatuses(t, rt)
+	for _, name := range []string{"app", "api", "legacy"} {
+		if want := "error: desired state exceeds MAX_TOTAL_HOSTNAMES"; got[name] != want {
+			t.Errorf("cycle 4: %s status = %q, want %q", name, got[name], want)
+		}
+	}
+}
+
+func TestWriteServiceStatusNormalizedHostnames(t *testing.T) {
+	rt, cf := newTestRuntime(t, nil,
+		newNamespace("default"),
+		newService("default", "mixed-case", 80, map[string]string{"cloudflare-tunnel-hostnames": "Legacy.Example.com"}),
+		newService("default", "trailing-dot", 80, map[string]string{"cloudflare-tunnel-hostnames": "other.example.com."}),
+	)
+	cf.addRecords(testZoneID,
+		dnsRecord{ID: "rec-legacy", Type: "A", Name: "legacy.example.com", Content: "192.0.2.1", TTL: 1},
+		dnsRecord{ID: "rec-other", Type: "A", Name: "other.example.com", Content: "192.0.2.2", TTL: 1},
+	)
+
+	syncStatusCycle(t, rt, nil)
+	got := serviceStatuses(t, rt)
+	want := map[string]string{
+		"mixed-case":   "skipped: legacy.example.com: " + skipReasonAorAAAA,
+		"trailing-dot": "skipped: other.example.com: " + skipReasonAorAAAA,
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+}
+
+func TestWriteServiceStatusSkipUnchangedZones(t *testing.T) {
+	rt, cf := newTestRuntime(t, map[string]string{"SKIP_UNCHANGED_ZONES": "true"},
+		newNamespace("default"),
+		newService("default", "app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+		newService("default", "legacy", 80, map[string]string{"cloudflare-tunnel-hostnames": "legacy.example.com"}),
+	)
+	cf.addRecords(testZoneID,
+		dnsRecord{ID: "rec-a", Type: "A", Name: "legacy.example.com", Content: "192.0.2.1", TTL: 1},
+	)
+
+	want := map[string]string{
+		"app":    "published",
+		"legacy": "skipped: legacy.example.com: " + skipReasonAorAAAA,
+	}
+	for cycle := 1; cycle <= 2; cycle++ {
+		syncStatusCycle(t, rt, nil)
+		if got := serviceStatuses(t, rt); !maps.Equal(got, want) {
+			t.Errorf("cycle %d: statuses = %v, want %v", cycle, got, want)
+		}
+	}
+	// The second cycle skipped the zone.
+	if got := len(cf.requestsMatching(http.MethodGet, "/dns_records")); got != 1 {
+		t.Errorf("listed records %d times, want 1", got)
+	}
+}
@@ -1,9 +1,16 @@
 package sync
 
 import (
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"os"
 	"sort"
+	"strings"
+	"time"
 	"tunnel/internal/runtime"
+
+	"sigs.k8s.io/yaml"
 )
 
 type tunnelConfigRequest struct {
@@ -20,14 +27,126 @@ type tunnelIngressRule struct {
 	OriginRequest map[string]any `json:"originRequest,omitempty"`
 }
 
+type tunnelResponse struct {
+	Result struct {
+		ID        string  `json:"id"`
+		Name      string  `json:"name"`
+		DeletedAt *string `json:"deleted_at"`
+	} `json:"result"`
+}
+
 // SyncTunnel updates the Cloudflare Tunnel configuration to match the desired state.
-func SyncTunnel(runtime *runtime.Runtime, state *SyncState) error {
+// On failure, the hostnames of the ingress rules are recorded as failed.
+func SyncTunnel(runtime *runtime.Runtime, state *SyncState) (err error) {
+	reqBody := tunnelConfigRequest{
+		Config: buildTunnelConfig(runtime, state),
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, rule := range reqBody.Config.Ingress {
+			if rule.Hostname != "" {
+				failHostnames(runtime, []string{rule.Hostname}, err)
+			}
+		}
+	}()
+
+	// Dumping is a dry run: nothing else is written, not even
+	// INGRESS_OUTPUT_FILE, which may be the live cloudflared configuration.
+	if runtime.Config.DumpTunnelConfigPath != "" {
+		data, err := json.MarshalIndent(reqBody, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error while marshaling tunnel configuration: %w", err)
+		}
+		if err := os.WriteFile(runtime.Config.DumpTunnelConfigPath, data, 0o644); err != nil {
+			return fmt.Errorf("error while dumping tunnel configuration: %w", err)
+		}
+		runtime.LoggerFor(moduleTunnel).Info("dumped tunnel configuration instead of applying it", slog.String("path", runtime.Config.DumpTunnelConfigPath))
+		return nil
+	}
+
+	if runtime.Config.IngressOutputFile != "" {
+		if err := writeIngressFile(runtime.Config.IngressOutputFile, reqBody.Config); err != nil {
+			return err
+		}
+		runtime.LoggerFor(moduleTunnel).Debug("wrote ingress rules to file", slog.String("path", runtime.Config.IngressOutputFile))
+	}
+	if runtime.Config.IngressOutputOnly {
+		return nil
+	}
+
+	if err := verifyTunnel(runtime); err != nil {
+		return err
+	}
+
+	if err := syncTunnelName(runtime); err != nil {
+		return err
+	}
+
+	if runtime.Config.TunnelLockLease != "" {
+		acquired, err := acquireTunnelLock(runtime)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			runtime.LoggerFor(moduleTunnel).Info("tunnel lock held by another replica; skipping tunnel configuration update")
+			return nil
+		}
+	}
+
+	var resp map[string]any
+	path := fmt.Sprintf("/accounts/%s/cfd_tunnel/%s/configurations", runtime.Config.CloudFlareAccountID, runtime.Config.CloudFlareTunnelID)
+
+	if err := runtime.Client.CloudFlareClient.Put(runtime.Ctx, path, reqBody, &resp); err != nil {
+		if runtime.Config.TunnelLockLease != "" {
+			if err := releaseTunnelLock(runtime); err != nil {
+				runtime.LoggerFor(moduleTunnel).Warn("failed to release tunnel lock", slog.String("error", err.Error()))
+			}
+		}
+		return fmt.Errorf("error while updating tunnel configuration: %w", err)
+	}
+
+	applied, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("error while marshaling tunnel configuration: %w", err)
+	}
+	if string(applied) == runtime.LastTunnelConfig {
+		return nil
+	}
+
+	// The Secret is written on the first sync, as it may be stale from a
+	// previous run, and then only when the configuration changes. It is
+	// written before LastTunnelConfig is updated, so that a failed write is
+	// retried on the next sync.
+	if runtime.Config.TunnelConfigSecret != "" {
+		if err := writeTunnelConfigSecret(runtime, applied); err != nil {
+			return err
+		}
+	}
+	runtime.LastTunnelConfig = string(applied)
+	runtime.Changes++
+
+	return nil
+}
+
+// buildTunnelConfig builds the tunnel ingress configuration for the desired state.
+func buildTunnelConfig(runtime *runtime.Runtime, state *SyncState) tunnelConfig {
 	ingressRules := make([]tunnelIngressRule, 0)
 
-	for host, service := range state.HostToService {
+	for hostname, host := range state.Hosts {
+		// Redirects are served by Cloudflare and never reach the tunnel;
+		// DNS-only hostnames have their ingress managed elsewhere.
+		if host.RedirectTo != "" || host.DNSOnly {
+			continue
+		}
+		if matchesAnyPattern(runtime.Config.TunnelHostnameExclude, strings.ToLower(hostname)) {
+			continue
+		}
 		ingressRules = append(ingressRules, tunnelIngressRule{
-			Hostname: host,
-			Service:  service,
+			Hostname:      hostname,
+			Service:       host.Service,
+			OriginRequest: host.OriginRequest,
 		})
 	}
 
@@ -38,21 +157,89 @@ func SyncTunnel(runtime *runtime.Runtime, state *SyncState) error {
 	})
 
 	ingressRules = append(ingressRules, tunnelIngressRule{
-		Service: "http_status:404",
+		Service: runtime.Config.CatchAllService,
 	})
 
-	reqBody := tunnelConfigRequest{
-		Config: tunnelConfig{
-			Ingress: ingressRules,
-		},
+	return tunnelConfig{
+		Ingress: ingressRules,
 	}
+}
 
-	var resp map[string]any
-	path := fmt.Sprintf("/accounts/%s/cfd_tunnel/%s/configurations", runtime.Config.CloudFlareAccountID, runtime.Config.CloudFlareTunnelID)
+// writeIngressFile writes the ingress rules to path in the shape of a
+// cloudflared config file, for connectors running with a local config.
+func writeIngressFile(path string, config tunnelConfig) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("error while marshaling ingress rules: %w", err)
+	}
 
-	if err := runtime.Client.CloudFlareClient.Put(runtime.Ctx, path, reqBody, &resp); err != nil {
-		return fmt.Errorf("error while updating tunnel configuration: %w", err)
+	// Write to a temporary file first so that cloudflared never reads a
+	// partially written config.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("error while writing ingress file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error while writing ingress file: %w", err)
+	}
+	return nil
+}
+
+// verifyTunnel checks that the configured tunnel exists and has not been
+// deleted, at most once per TUNNEL_CHECK_INTERVAL. The check is disabled if
+// the interval is not set.
+func verifyTunnel(runtime *runtime.Runtime) error {
+	interval := runtime.Config.TunnelCheckInterval
+	if interval <= 0 {
+		return nil
+	}
+	if !runtime.LastTunnelCheck.IsZero() && time.Since(runtime.LastTunnelCheck) < interval {
+		runtime.LoggerFor(moduleTunnel).Debug("tunnel verified recently; skipping check", slog.Time("lastCheck", runtime.LastTunnelCheck))
+		return nil
 	}
 
+	var resp tunnelResponse
+	path := fmt.Sprintf("/accounts/%s/cfd_tunnel/%s", runtime.Config.CloudFlareAccountID, runtime.Config.CloudFlareTunnelID)
+	if err := runtime.Client.CloudFlareClient.Get(runtime.Ctx, path, nil, &resp); err != nil {
+		return fmt.Errorf("error while verifying tunnel: %w", err)
+	}
+	if resp.Result.DeletedAt != nil {
+		return fmt.Errorf("tunnel %s was deleted at %s", runtime.Config.CloudFlareTunnelID, *resp.Result.DeletedAt)
+	}
+
+	runtime.LoggerFor(moduleTunnel).Debug("tunnel verified", slog.String("tunnelID", resp.Result.ID), slog.String("name", resp.Result.Name))
+	runtime.LastTunnelCheck = time.Now()
+	return nil
+}
+
+// syncTunnelName checks that the tunnel is named TUNNEL_NAME, warning about
+// drift (e.g. an accidental rename) and, with TUNNEL_NAME_FIX, renaming it
+// back.
+func syncTunnelName(runtime *runtime.Runtime) error {
+	expected := runtime.Config.TunnelName
+	if expected == "" {
+		return nil
+	}
+	logger := runtime.LoggerFor(moduleTunnel)
+
+	var resp tunnelResponse
+	path := fmt.Sprintf("/accounts/%s/cfd_tunnel/%s", runtime.Config.CloudFlareAccountID, runtime.Config.CloudFlareTunnelID)
+	if err := runtime.Client.CloudFlareClient.Get(runtime.Ctx, path, nil, &resp); err != nil {
+		return fmt.Errorf("error while reading tunnel: %w", err)
+	}
+	if resp.Result.Name == expected {
+		return nil
+	}
+
+	logger.Warn("tunnel name does not match TUNNEL_NAME", slog.String("name", resp.Result.Name), slog.String("expected", expected), slog.Bool("fix", runtime.Config.TunnelNameFix))
+	if !runtime.Config.TunnelNameFix {
+		return nil
+	}
+
+	if err := runtime.Client.CloudFlareClient.Patch(runtime.Ctx, path, map[string]any{"name": expected}, &resp); err != nil {
+		return fmt.Errorf("error while renaming tunnel: %w", err)
+	}
+	logger.Info("renamed tunnel", slog.String("name", expected))
+	runtime.Changes++
 	return nil
 }
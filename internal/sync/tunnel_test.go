@@ -0,0 +1,406 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tunnelPath is the path of the test tunnel in the Cloudflare API.
+const tunnelPath = "/accounts/" + testAccountID + "/cfd_tunnel/" + testTunnelID
+
+// tunnelGets returns the number of GET requests for the test tunnel itself.
+func tunnelGets(cf *fakeCloudflare) int {
+	n := 0
+	for _, req := range cf.requestsMatching(http.MethodGet, tunnelPath) {
+		if req.Path == tunnelPath {
+			n++
+		}
+	}
+	return n
+}
+
+func TestVerifyTunnel(t *testing.T) {
+	deletedAt := "2024-01-01T00:00:00Z"
+	tests := []struct {
+		name      string
+		interval  string
+		lastCheck time.Duration // ago; zero means never checked
+		deletedAt *string
+		wantGets  int
+		wantErr   bool
+	}{
+		{name: "disabled", interval: "", wantGets: 0},
+		{name: "first check", interval: "5m", wantGets: 1},
+		{name: "within interval", interval: "5m", lastCheck: time.Minute, wantGets: 0},
+		{name: "interval elapsed", interval: "5m", lastCheck: 6 * time.Minute, wantGets: 1},
+		{name: "deleted tunnel", interval: "5m", deletedAt: &deletedAt, wantGets: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"TUNNEL_CHECK_INTERVAL": tt.interval})
+			cf.tunnelDeletedAt = tt.deletedAt
+			if tt.lastCheck > 0 {
+				rt.LastTunnelCheck = time.Now().Add(-tt.lastCheck)
+			}
+			before := rt.LastTunnelCheck
+
+			err := verifyTunnel(rt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyTunnel error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := tunnelGets(cf); got != tt.wantGets {
+				t.Errorf("tunnel was read %d times, want %d", got, tt.wantGets)
+			}
+			checked := rt.LastTunnelCheck != before
+			if want := tt.wantGets > 0 && !tt.wantErr; checked != want {
+				t.Errorf("LastTunnelCheck updated = %v, want %v", checked, want)
+			}
+		})
+	}
+}
+
+func TestSyncTunnelIngressOutputFile(t *testing.T) {
+	const wantYAML = `ingress:
+- hostname: api.example.com
+  originRequest:
+    noTLSVerify: true
+  service: https://api.default.svc.cluster.local:443
+- hostname: app.example.com
+  service: http://app.default.svc.cluster.local:80
+- service: http_status:404
+`
+	tests := []struct {
+		name    string
+		only    string
+		wantPut bool
+	}{
+		{name: "file and API", only: "false", wantPut: true},
+		{name: "file only", only: "true", wantPut: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			rt, cf := newTestRuntime(t, map[string]string{
+				"INGRESS_OUTPUT_FILE": path,
+				"INGRESS_OUTPUT_ONLY": tt.only,
+			})
+			state := NewSyncState()
+			state.Hosts["app.example.com"] = HostConfig{Service: "http://app.default.svc.cluster.local:80"}
+			state.Hosts["api.example.com"] = HostConfig{Service: "https://api.default.svc.cluster.local:443", OriginRequest: map[string]any{"noTLSVerify": true}}
+			state.Hosts["www.example.com"] = HostConfig{RedirectTo: "https://example.com"}
+
+			if err := SyncTunnel(rt, state); err != nil {
+				t.Fatalf("SyncTunnel: %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read ingress file: %v", err)
+			}
+			if string(data) != wantYAML {
+				t.Errorf("ingress file =\n%s\nwant\n%s", data, wantYAML)
+			}
+			if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("temporary file left behind: %v", err)
+			}
+			if gotPut := len(cf.requestsMatching(http.MethodPut, "/configurations")) > 0; gotPut != tt.wantPut {
+				t.Errorf("tunnel configuration PUT = %v, want %v", gotPut, tt.wantPut)
+			}
+		})
+	}
+}
+
+func TestSyncDNSOnlyHostname(t *testing.T) {
+	rt, cf := newTestRuntime(t, nil,
+		newNamespace("default"),
+		newService("default", "app", 80, map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}),
+		newService("default", "docs", 80, map[string]string{
+			"cloudflare-tunnel-hostnames": "docs.example.com",
+			"cloudflare-tunnel-dns-only":  "true",
+		}),
+	)
+
+	state, err := SyncKube(rt)
+	if err != nil {
+		t.Fatalf("SyncKube: %v", err)
+	}
+	if !state.Hosts["docs.example.com"].DNSOnly {
+		t.Fatalf("docs.example.com is not DNS-only in %+v", state.Hosts)
+	}
+	if err := SyncDNS(rt, state); err != nil {
+		t.Fatalf("SyncDNS: %v", err)
+	}
+	if err := SyncTunnel(rt, state); err != nil {
+		t.Fatalf("SyncTunnel: %v", err)
+	}
+
+	for _, host := range []string{"app.example.com", "docs.example.com"} {
+		if _, ok := cf.record(testZoneID, "CNAME", host); !ok {
+			t.Errorf("no CNAME record for %s", host)
+		}
+	}
+	var hostnames []string
+	for _, rule := range buildTunnelConfig(rt, state).Ingress {
+		hostnames = append(hostnames, rule.Hostname)
+	}
+	if want := []string{"app.example.com", ""}; !slices.Equal(hostnames, want) {
+		t.Errorf("ingress hostnames = %q, want %q", hostnames, want)
+	}
+	ingress, _ := cf.tunnelConfig["config"].(map[string]any)["ingress"].([]any)
+	if len(ingress) != 2 {
+		t.Errorf("applied %d ingress rules, want 2: %v", len(ingress), ingress)
+	}
+}
+
+func TestSyncTunnelDumpConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		ingressFile bool
+		ingressOnly string
+	}{
+		{name: "dump only"},
+		{name: "with ingress file", ingressFile: true, ingressOnly: "false"},
+		{name: "with ingress file only", ingressFile: true, ingressOnly: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "tunnel.json")
+			env := map[string]string{
+				"DUMP_TUNNEL_CONFIG":             path,
+				"TUNNEL_CONFIG_SECRET":           "tunnel-config",
+				"TUNNEL_CONFIG_SECRET_NAMESPACE": "default",
+				"INGRESS_OUTPUT_ONLY":            tt.ingressOnly,
+			}
+			ingressPath := filepath.Join(dir, "config.yaml")
+			if tt.ingressFile {
+				env["INGRESS_OUTPUT_FILE"] = ingressPath
+			}
+			rt, cf := newTestRuntime(t, env)
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+
+			if err := SyncTunnel(rt, state); err != nil {
+				t.Fatalf("SyncTunnel: %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read dump: %v", err)
+			}
+			var dumped tunnelConfigRequest
+			if err := json.Unmarshal(data, &dumped); err != nil {
+				t.Fatalf("dump is not a tunnel configuration: %v", err)
+			}
+			if want := buildTunnelConfig(rt, state); !reflect.DeepEqual(dumped.Config, want) {
+				t.Errorf("dumped %+v, want %+v", dumped.Config, want)
+			}
+
+			// The ingress file may be the live cloudflared configuration,
+			// so a dump must leave it alone.
+			if _, err := os.Stat(ingressPath); !os.IsNotExist(err) {
+				t.Errorf("ingress file was written during a dump: %v", err)
+			}
+			if n := len(cf.requestsMatching(http.MethodGet, "")) + cf.writes(); n != 0 {
+				t.Errorf("made %d API requests, want none", n)
+			}
+			if _, err := rt.Client.KubeClient.CoreV1().Secrets("default").Get(rt.Ctx, "tunnel-config", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("tunnel config Secret was written: %v", err)
+			}
+			if rt.LastTunnelConfig != "" || rt.Changes != 0 {
+				t.Errorf("dump recorded an applied configuration")
+			}
+		})
+	}
+}
+
+func TestHostnameExcludePatterns(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantCNAME   bool
+		wantIngress bool
+	}{
+		{name: "no patterns", wantCNAME: true, wantIngress: true},
+		{name: "excluded from DNS", env: map[string]string{"DNS_HOSTNAME_EXCLUDE": "*.internal.example.com"}, wantCNAME: false, wantIngress: true},
+		{name: "excluded from tunnel", env: map[string]string{"TUNNEL_HOSTNAME_EXCLUDE": "*.internal.example.com"}, wantCNAME: true, wantIngress: false},
+		{name: "pattern case is ignored", env: map[string]string{"DNS_HOSTNAME_EXCLUDE": "*.INTERNAL.example.com"}, wantCNAME: false, wantIngress: true},
+		{name: "star does not cross dots", env: map[string]string{"DNS_HOSTNAME_EXCLUDE": "*.example.com"}, wantCNAME: true, wantIngress: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, tt.env)
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.internal.example.com")
+
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+			if _, ok := cf.record(testZoneID, "CNAME", "app.internal.example.com"); ok != tt.wantCNAME {
+				t.Errorf("CNAME present = %v, want %v", ok, tt.wantCNAME)
+			}
+			ingress := false
+			for _, rule := range buildTunnelConfig(rt, state).Ingress {
+				ingress = ingress || rule.Hostname == "app.internal.example.com"
+			}
+			if ingress != tt.wantIngress {
+				t.Errorf("ingress rule present = %v, want %v", ingress, tt.wantIngress)
+			}
+		})
+	}
+}
+
+func TestSyncCountsChanges(t *testing.T) {
+	rt, cf := newTestRuntime(t, nil)
+	state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+
+	tests := []struct {
+		name        string
+		wantChanges bool
+	}{
+		{name: "first sync applies the state", wantChanges: true},
+		{name: "unchanged state applies nothing", wantChanges: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt.Changes = 0
+			if err := SyncTunnel(rt, state); err != nil {
+				t.Fatalf("SyncTunnel: %v", err)
+			}
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+			if got := rt.Changes > 0; got != tt.wantChanges {
+				t.Errorf("Changes = %d, want changes %v", rt.Changes, tt.wantChanges)
+			}
+		})
+	}
+	if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); !ok {
+		t.Errorf("CNAME not created")
+	}
+}
+
+func TestSyncTunnelMTLSAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ca.pem", "client.pem", "client.key"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("test"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caPool, clientCert, clientKey := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+
+	tests := []struct {
+		name              string
+		annotations       map[string]string
+		wantOriginRequest map[string]any // nil if the service is skipped
+	}{
+		{
+			name:              "CA pool",
+			annotations:       map[string]string{"cloudflare-tunnel-ca-pool": caPool},
+			wantOriginRequest: map[string]any{"caPool": caPool},
+		},
+		{
+			name: "client certificate",
+			annotations: map[string]string{
+				"cloudflare-tunnel-ca-pool":     caPool,
+				"cloudflare-tunnel-client-cert": clientCert,
+				"cloudflare-tunnel-client-key":  clientKey,
+			},
+			wantOriginRequest: map[string]any{"caPool": caPool, "clientCert": clientCert, "clientKey": clientKey},
+		},
+		{
+			name:        "missing file",
+			annotations: map[string]string{"cloudflare-tunnel-ca-pool": filepath.Join(dir, "missing.pem")},
+		},
+		{
+			name:        "certificate without key",
+			annotations: map[string]string{"cloudflare-tunnel-client-cert": clientCert},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"cloudflare-tunnel-hostnames": "app.example.com"}
+			maps.Copy(annotations, tt.annotations)
+			rt, cf := newTestRuntime(t, nil,
+				newNamespace("default"),
+				newService("default", "app", 443, annotations),
+			)
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			if tt.wantOriginRequest == nil {
+				if got := serviceSkipReason(rt, "default", "app"); got != skipReasonInvalidMTLS {
+					t.Errorf("skip reason = %q, want %q", got, skipReasonInvalidMTLS)
+				}
+				return
+			}
+			if err := SyncTunnel(rt, state); err != nil {
+				t.Fatalf("SyncTunnel: %v", err)
+			}
+
+			ingress, _ := cf.tunnelConfig["config"].(map[string]any)["ingress"].([]any)
+			if len(ingress) == 0 {
+				t.Fatalf("no ingress rules applied")
+			}
+			rule, _ := ingress[0].(map[string]any)
+			if got := rule["originRequest"]; !reflect.DeepEqual(got, tt.wantOriginRequest) {
+				t.Errorf("originRequest = %v, want %v", got, tt.wantOriginRequest)
+			}
+		})
+	}
+}
+
+func TestSyncTunnelName(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		current     string
+		wantName    string
+		wantWarning bool
+	}{
+		{name: "disabled", current: "renamed", wantName: "renamed"},
+		{name: "matching", env: map[string]string{"TUNNEL_NAME": "prod"}, current: "prod", wantName: "prod"},
+		{name: "renamed, warned", env: map[string]string{"TUNNEL_NAME": "prod"}, current: "renamed", wantName: "renamed", wantWarning: true},
+		{name: "renamed, corrected", env: map[string]string{"TUNNEL_NAME": "prod", "TUNNEL_NAME_FIX": "true"}, current: "renamed", wantName: "prod", wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, tt.env)
+			cf.tunnelName = tt.current
+			var buf bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+
+			if err := SyncTunnel(rt, state); err != nil {
+				t.Fatalf("SyncTunnel: %v", err)
+			}
+
+			if cf.tunnelName != tt.wantName {
+				t.Errorf("tunnel name = %q, want %q", cf.tunnelName, tt.wantName)
+			}
+			if got := strings.Contains(buf.String(), "tunnel name does not match TUNNEL_NAME"); got != tt.wantWarning {
+				t.Errorf("drift warning logged = %v, want %v: %s", got, tt.wantWarning, buf.String())
+			}
+			wantPatches := 0
+			if tt.wantName != tt.current {
+				wantPatches = 1
+			}
+			if got := len(cf.requestsMatching(http.MethodPatch, tunnelPath)); got != wantPatches {
+				t.Errorf("sent %d tunnel PATCH requests, want %d", got, wantPatches)
+			}
+		})
+	}
+}
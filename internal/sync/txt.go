@@ -0,0 +1,260 @@
+package sync
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"tunnel/internal/config"
+	"tunnel/internal/runtime"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+)
+
+// maxTXTContentLength is the maximum length of TXT record content accepted
+// by Cloudflare.
+const maxTXTContentLength = 2048
+
+// ownershipTXTPrefix prefixes the name of ownership TXT records of CNAMEs,
+// following the external-dns registry naming.
+const ownershipTXTPrefix = "cname-"
+
+// defaultOwnershipOwnerID is the external-dns owner ID written into ownership
+// TXT records if OWNER_ID is not set.
+const defaultOwnershipOwnerID = "tunnel-manager"
+
+// syncZoneTXTRecords synchronizes the managed TXT records of a single zone:
+//   - one per hostname with a TXT annotation, named TXT_RECORD_PREFIX.<hostname>
+//   - if TXT_OWNERSHIP is enabled, an external-dns style ownership record,
+//     named cname-<hostname>, per hostname whose CNAME we own
+//
+// Managed TXT records no longer desired are deleted (or orphaned, see
+// ON_RELEASE). Deletion requires TXT to be listed in DELETABLE_RECORD_TYPES.
+func syncZoneTXTRecords(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID, zoneName string,
+	hosts []string,
+	owned map[string]bool,
+	state *SyncState,
+	records []dnsRecord,
+) error {
+	logger := rt.LoggerFor(moduleDNS)
+
+	desired := make(map[string]string) // record name -> content
+	for _, host := range hosts {
+		if content := state.Hosts[host].TXT; content != "" {
+			desired[txtRecordName(rt, host)] = content
+		}
+		if rt.Config.TXTOwnership && owned[host] {
+			desired[ownershipTXTPrefix+host] = ownershipTXTContent(rt)
+		}
+	}
+
+	seen := make(map[string]bool, len(desired))
+	for _, rec := range records {
+		if rec.Type != "TXT" || !isManagedComment(rt, rec.Comment) {
+			continue
+		}
+		name := normalizeHost(rec.Name)
+		content, ok := desired[name]
+
+		switch {
+		case !ok && rt.Config.OnRelease == config.OnReleaseOrphan:
+			logger.Info("releasing managed TXT for hostname not present in SyncState",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+			)
+			if err := releaseDNSRecord(rt, client, zoneID, rec); err != nil {
+				return fmt.Errorf("release TXT record %s (%s): %w", rec.ID, logHostname(rt, name, zoneName), err)
+			}
+
+		case !ok:
+			logger.Info("deleting managed TXT for hostname not present in SyncState",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+			)
+			if _, err := deleteDNSRecord(rt, client, zoneID, rec); err != nil {
+				return fmt.Errorf("delete TXT record %s (%s): %w", rec.ID, logHostname(rt, name, zoneName), err)
+			}
+
+		case seen[name]:
+			logger.Warn("duplicate managed TXT record; leaving untouched",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+			)
+
+		default:
+			seen[name] = true
+			if unquoteTXT(rec.Content) == content {
+				continue
+			}
+			logger.Info("updating managed TXT content",
+				"zone_id", zoneID,
+				"zone_name", zoneName,
+				hostnameAttr(rt, name, zoneName),
+				"record_id", rec.ID,
+			)
+			if err := updateTXTRecordContent(rt, client, zoneID, rec.ID, content); err != nil {
+				return fmt.Errorf("update TXT record %s (%s): %w", rec.ID, logHostname(rt, name, zoneName), err)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		logger.Info("creating managed TXT",
+			"zone_id", zoneID,
+			"zone_name", zoneName,
+			hostnameAttr(rt, name, zoneName),
+		)
+		if err := createTXTRecord(rt, client, zoneID, name, desired[name]); err != nil {
+			return fmt.Errorf("create TXT for %s: %w", logHostname(rt, name, zoneName), err)
+		}
+	}
+
+	return nil
+}
+
+// createTXTRecord creates a new managed TXT record.
+func createTXTRecord(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID, name, content string,
+) error {
+	body := map[string]any{
+		"type":    "TXT",
+		"name":    name,
+		"content": content,
+		"ttl":     1, // "auto"
+		"comment": managedComment(rt),
+	}
+
+	var resp struct {
+		Success bool      `json:"success"`
+		Result  dnsRecord `json:"result"`
+	}
+	err := client.Post(
+		rt.Ctx,
+		fmt.Sprintf("/zones/%s/dns_records", url.PathEscape(zoneID)),
+		body,
+		&resp,
+	)
+	if err != nil {
+		return fmt.Errorf("POST /zones/%s/dns_records: %w", zoneID, err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("Cloudflare API reported failure creating TXT")
+	}
+	cacheRecordWrite(rt, zoneID, resp.Result)
+	rt.Changes++
+	return nil
+}
+
+// updateTXTRecordContent updates the content + comment of an existing TXT.
+func updateTXTRecordContent(
+	rt *runtime.Runtime,
+	client *cloudflare.Client,
+	zoneID, recordID, content string,
+) error {
+	body := map[string]any{
+		"content": content,
+		"comment": managedComment(rt),
+	}
+
+	var resp struct {
+		Success bool      `json:"success"`
+		Result  dnsRecord `json:"result"`
+	}
+	err := client.Patch(
+		rt.Ctx,
+		fmt.Sprintf("/zones/%s/dns_records/%s", url.PathEscape(zoneID), url.PathEscape(recordID)),
+		body,
+		&resp,
+	)
+	if err != nil {
+		return fmt.Errorf("PATCH /zones/%s/dns_records/%s: %w", zoneID, recordID, err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("Cloudflare API reported failure updating TXT")
+	}
+	cacheRecordWrite(rt, zoneID, resp.Result)
+	rt.Changes++
+	return nil
+}
+
+// txtRecordName returns the name of the managed TXT record for hostname.
+func txtRecordName(rt *runtime.Runtime, hostname string) string {
+	return normalizeHost(rt.Config.TXTRecordPrefix + "." + hostname)
+}
+
+// ownershipTXTContent returns the content of ownership TXT records, in the
+// external-dns registry format so that external-dns leaves our records alone.
+func ownershipTXTContent(rt *runtime.Runtime) string {
+	return "heritage=external-dns,external-dns/owner=" + ownershipOwnerID(rt)
+}
+
+// ownershipOwnerID returns the external-dns owner ID we write into ownership
+// TXT records: OWNER_ID, or defaultOwnershipOwnerID if unset.
+func ownershipOwnerID(rt *runtime.Runtime) string {
+	if rt.Config.OwnerID == "" {
+		return defaultOwnershipOwnerID
+	}
+	return rt.Config.OwnerID
+}
+
+// isForeignOwnershipTXT reports whether rec is an external-dns ownership
+// record that was not written by us, i.e. whose owner is not our owner ID.
+// Records of ours that lost their managed comment are not foreign, so they
+// do not lock us out of our own hostnames.
+func isForeignOwnershipTXT(rt *runtime.Runtime, rec dnsRecord) bool {
+	if isManagedComment(rt, rec.Comment) {
+		return false
+	}
+	content := unquoteTXT(rec.Content)
+	if !strings.Contains(content, "heritage=external-dns") {
+		return false
+	}
+	for field := range strings.SplitSeq(content, ",") {
+		if owner, ok := strings.CutPrefix(strings.TrimSpace(field), "external-dns/owner="); ok {
+			return owner != ownershipOwnerID(rt)
+		}
+	}
+	return true
+}
+
+// validateTXTContent checks that content can be stored in a TXT record.
+func validateTXTContent(content string) error {
+	if len(content) > maxTXTContentLength {
+		return fmt.Errorf("TXT content is longer than %d characters", maxTXTContentLength)
+	}
+	for _, c := range content {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("TXT content contains non-printable or non-ASCII character %q", c)
+		}
+	}
+	return nil
+}
+
+// unquoteTXT strips the quotes Cloudflare may wrap TXT content in when
+// reading it back.
+func unquoteTXT(content string) string {
+	if len(content) >= 2 && strings.HasPrefix(content, `"`) && strings.HasSuffix(content, `"`) {
+		return content[1 : len(content)-1]
+	}
+	return content
+}
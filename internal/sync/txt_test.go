@@ -0,0 +1,200 @@
+package sync
+
+import (
+	"bytes"
+	"log/slog"
+	"maps"
+	"strings"
+	"testing"
+)
+
+// managedTXT returns a TXT record marked as managed with the default
+// MANAGED_COMMENT_MARKER.
+func managedTXT(id, name, content string) dnsRecord {
+	return dnsRecord{ID: id, Type: "TXT", Name: name, Content: content, Comment: "managed by tunnel-manager", TTL: 1}
+}
+
+func TestSyncDNSManagedTXT(t *testing.T) {
+	tests := []struct {
+		name      string
+		deletable string
+		existing  []dnsRecord
+		txt       string // TXT annotation of app.example.com
+		// wantContent is the content of _verify.app.example.com, "" if absent.
+		wantContent string
+	}{
+		{
+			name:        "create",
+			txt:         "verification=abc",
+			wantContent: "verification=abc",
+		},
+		{
+			name:        "update",
+			existing:    []dnsRecord{managedTXT("rec-txt", "_verify.app.example.com", `"verification=old"`)},
+			txt:         "verification=abc",
+			wantContent: "verification=abc",
+		},
+		{
+			name:        "unchanged quoted content",
+			existing:    []dnsRecord{managedTXT("rec-txt", "_verify.app.example.com", `"verification=abc"`)},
+			txt:         "verification=abc",
+			wantContent: `"verification=abc"`,
+		},
+		{
+			name:        "delete",
+			deletable:   "CNAME,TXT",
+			existing:    []dnsRecord{managedTXT("rec-txt", "_verify.app.example.com", "verification=abc")},
+			wantContent: "",
+		},
+		{
+			name:        "delete refused for non-deletable type",
+			existing:    []dnsRecord{managedTXT("rec-txt", "_verify.app.example.com", "verification=abc")},
+			wantContent: "verification=abc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"DELETABLE_RECORD_TYPES": tt.deletable})
+			cf.addRecords(testZoneID, tt.existing...)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80", TXT: tt.txt}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			rec, ok := cf.record(testZoneID, "TXT", "_verify.app.example.com")
+			if rec.Content != tt.wantContent {
+				t.Errorf("TXT content = %q, want %q", rec.Content, tt.wantContent)
+			}
+			if ok && !isManagedComment(rt, rec.Comment) {
+				t.Errorf("TXT record %+v is not managed", rec)
+			}
+		})
+	}
+}
+
+func TestValidateTXTContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "printable", content: "v=spf1 include:example.com ~all", wantErr: false},
+		{name: "maximum length", content: strings.Repeat("a", maxTXTContentLength), wantErr: false},
+		{name: "too long", content: strings.Repeat("a", maxTXTContentLength+1), wantErr: true},
+		{name: "newline", content: "a\nb", wantErr: true},
+		{name: "non-ASCII", content: "zażółć", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateTXTContent(tt.content); (err != nil) != tt.wantErr {
+				t.Errorf("validateTXTContent error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSyncDNSForeignOwnershipTXT(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		txt       dnsRecord
+		wantCNAME bool
+	}{
+		{
+			name:      "other owner",
+			txt:       dnsRecord{ID: "rec-own", Type: "TXT", Name: "cname-app.example.com", Content: `"heritage=external-dns,external-dns/owner=cluster-b"`},
+			wantCNAME: false,
+		},
+		{
+			name:      "our default owner",
+			txt:       dnsRecord{ID: "rec-own", Type: "TXT", Name: "cname-app.example.com", Content: `"heritage=external-dns,external-dns/owner=tunnel-manager"`},
+			wantCNAME: true,
+		},
+		{
+			name:      "our OWNER_ID",
+			env:       map[string]string{"OWNER_ID": "cluster-a"},
+			txt:       dnsRecord{ID: "rec-own", Type: "TXT", Name: "cname-app.example.com", Content: "heritage=external-dns,external-dns/owner=cluster-a,external-dns/resource=service/default/app"},
+			wantCNAME: true,
+		},
+		{
+			name:      "other owner than OWNER_ID",
+			env:       map[string]string{"OWNER_ID": "cluster-a"},
+			txt:       dnsRecord{ID: "rec-own", Type: "TXT", Name: "cname-app.example.com", Content: "heritage=external-dns,external-dns/owner=tunnel-manager"},
+			wantCNAME: false,
+		},
+		{
+			name:      "no owner field",
+			txt:       dnsRecord{ID: "rec-own", Type: "TXT", Name: "cname-app.example.com", Content: "heritage=external-dns"},
+			wantCNAME: false,
+		},
+		{
+			name:      "managed ownership record of ours",
+			txt:       dnsRecord{ID: "rec-own", Type: "TXT", Name: "cname-app.example.com", Content: "heritage=external-dns,external-dns/owner=someone", Comment: "managed by tunnel-manager"},
+			wantCNAME: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"TXT_OWNERSHIP": "true", "DELETABLE_RECORD_TYPES": "CNAME,TXT"}
+			maps.Copy(env, tt.env)
+			rt, cf := newTestRuntime(t, env)
+			cf.addRecords(testZoneID, tt.txt)
+
+			state := newState(HostConfig{Service: "http://app.default.svc.cluster.local:80"}, "app.example.com")
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); ok != tt.wantCNAME {
+				t.Errorf("CNAME created = %v, want %v", ok, tt.wantCNAME)
+			}
+			if got := skipReason(rt, "app.example.com"); (got == skipReasonExternalDNS) == tt.wantCNAME {
+				t.Errorf("skip reason = %q with CNAME created = %v", got, tt.wantCNAME)
+			}
+		})
+	}
+}
+
+func TestSyncKubeTXTAnnotationRequiresDeletableTXT(t *testing.T) {
+	tests := []struct {
+		deletable string
+		wantTXT   bool
+	}{
+		{deletable: "", wantTXT: false},
+		{deletable: "CNAME", wantTXT: false},
+		{deletable: "CNAME,TXT", wantTXT: true},
+	}
+	for _, tt := range tests {
+		t.Run("DELETABLE_RECORD_TYPES="+tt.deletable, func(t *testing.T) {
+			rt, cf := newTestRuntime(t, map[string]string{"DELETABLE_RECORD_TYPES": tt.deletable},
+				newNamespace("default"),
+				newService("default", "app", 80, map[string]string{
+					"cloudflare-tunnel-hostnames": "app.example.com",
+					"cloudflare-tunnel-txt":       "verification=abc",
+				}),
+			)
+			var logs bytes.Buffer
+			rt.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+			state, err := SyncKube(rt)
+			if err != nil {
+				t.Fatalf("SyncKube: %v", err)
+			}
+			if err := SyncDNS(rt, state); err != nil {
+				t.Fatalf("SyncDNS: %v", err)
+			}
+
+			if _, ok := cf.record(testZoneID, "TXT", "_verify.app.example.com"); ok != tt.wantTXT {
+				t.Errorf("TXT created = %v, want %v", ok, tt.wantTXT)
+			}
+			if _, ok := cf.record(testZoneID, "CNAME", "app.example.com"); !ok {
+				t.Errorf("CNAME was not created")
+			}
+			warned := strings.Contains(logs.String(), "TXT is not in DELETABLE_RECORD_TYPES")
+			if warned == tt.wantTXT {
+				t.Errorf("warning logged = %v, want %v: %s", warned, !tt.wantTXT, logs.String())
+			}
+		})
+	}
+}